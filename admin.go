@@ -0,0 +1,173 @@
+package mqtt
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/client"
+	"github.com/davidfantasy/embedded-mqtt-broker/event"
+	"github.com/davidfantasy/embedded-mqtt-broker/packets"
+)
+
+var (
+	//clientId对应的客户端不在线
+	ErrClientNotFound = errors.New("client not found")
+	//clientId对应的会话不存在或已过期
+	ErrSessionNotFound = errors.New("session not found")
+	//会话没有订阅该topic过滤器
+	ErrSubscriptionNotFound = errors.New("subscription not found")
+)
+
+//在线客户端的信息
+type ClientInfo struct {
+	ClientId        string    `json:"clientId"`
+	SessionId       string    `json:"sessionId"`
+	Username        string    `json:"username"`
+	RemoteAddr      string    `json:"remoteAddr"`
+	Listener        string    `json:"listener"`
+	ProtocolVersion byte      `json:"protocolVersion"`
+	CleanSession    bool      `json:"cleanSession"`
+	Keepalive       uint16    `json:"keepalive"`
+	ConnectedTime   time.Time `json:"connectedTime"`
+	//该连接收发的字节数
+	BytesReceived int64 `json:"bytesReceived"`
+	BytesSent     int64 `json:"bytesSent"`
+}
+
+//会话对某个topic过滤器的订阅
+type SubscriptionInfo struct {
+	Filter string `json:"filter"`
+	Qos    byte   `json:"qos"`
+}
+
+//会话的信息，包含离线但尚未过期的持久会话
+type SessionInfo struct {
+	client.SessionInfo
+	//会话的订阅数量
+	Subscriptions int `json:"subscriptions"`
+}
+
+func newClientInfo(c *client.Client) ClientInfo {
+	info := ClientInfo{
+		ClientId:        c.Id,
+		SessionId:       c.SessionId,
+		Username:        c.Username,
+		RemoteAddr:      c.RemoteAddr(),
+		Listener:        c.Listener,
+		ProtocolVersion: c.ProtocolVersion,
+		CleanSession:    c.CleanSession,
+		Keepalive:       c.Keepalive,
+		ConnectedTime:   c.ConnectedTime,
+	}
+	if conn, ok := c.Conn.(*statsConn); ok {
+		info.BytesReceived = atomic.LoadInt64(&conn.bytesReceived)
+		info.BytesSent = atomic.LoadInt64(&conn.bytesSent)
+	}
+	return info
+}
+
+//所有在线客户端的信息，按clientId排序
+func (s *MqttServer) Clients() []ClientInfo {
+	clients := s.clients.Clients()
+	infos := make([]ClientInfo, len(clients))
+	for i, c := range clients {
+		infos[i] = newClientInfo(c)
+	}
+	return infos
+}
+
+//查询某个在线客户端的信息
+func (s *MqttServer) Client(clientId string) (ClientInfo, error) {
+	c := s.clients.FindClient(clientId)
+	if c == nil {
+		return ClientInfo{}, ErrClientNotFound
+	}
+	return newClientInfo(c), nil
+}
+
+//查询clientId对应会话的所有订阅，客户端离线时也可以查询持久会话的订阅
+func (s *MqttServer) ClientSubscriptions(clientId string) ([]SubscriptionInfo, error) {
+	session, ok := s.clients.FindSession(clientId)
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return s.subscriptions.sessionSubscriptions(session.Id), nil
+}
+
+//所有会话的信息，按clientId排序
+func (s *MqttServer) Sessions() []SessionInfo {
+	sessions := s.clients.Sessions()
+	infos := make([]SessionInfo, len(sessions))
+	for i, session := range sessions {
+		infos[i] = SessionInfo{SessionInfo: session, Subscriptions: len(s.subscriptions.sessionSubscriptions(session.Id))}
+	}
+	return infos
+}
+
+//断开某个在线的客户端，mqtt 5.0的客户端会收到原因码为0x98（Administrative action）的DISCONNECT，
+//持久会话会被保留，需要同时清除会话时使用ExpireSession
+func (s *MqttServer) KickClient(clientId string) error {
+	c := s.clients.FindClient(clientId)
+	if c == nil {
+		return ErrClientNotFound
+	}
+	c.Disconnect(packets.ReasonAdministrativeAction)
+	return nil
+}
+
+//立即清除clientId对应的会话及其所有订阅，客户端在线时会先被断开
+func (s *MqttServer) ExpireSession(clientId string) error {
+	if !s.clients.ExpireSession(clientId, packets.ReasonAdministrativeAction) {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+//以clientId对应会话的身份订阅topic过滤器，客户端离线时订阅会保存在持久会话中。
+//该操作不经过权限检查和钩子，客户端在线时会立即收到匹配的保留消息
+func (s *MqttServer) AddSubscription(clientId string, filter string, qos byte) error {
+	if qos > 2 {
+		return ErrInvalidQos
+	}
+	group, _, err := parseSubscription(filter)
+	if err != nil {
+		return err
+	}
+	session, ok := s.clients.FindSession(clientId)
+	if !ok {
+		return ErrSessionNotFound
+	}
+	if err := s.subscriptions.Subscribe(filter, session.Id, qos); err != nil {
+		return err
+	}
+	s.publishEvent(&event.Subscribed{ClientId: clientId, Filter: filter, Qos: qos})
+	if c := s.clients.FindClientBySessionId(session.Id); c != nil && len(group) == 0 {
+		for _, msg := range s.retained.GetRetainedMessages(filter) {
+			msgQos := msg.Qos
+			if qos < msgQos {
+				msgQos = qos
+			}
+			if !s.onDeliver(session.Id, msg, msgQos, true) {
+				continue
+			}
+			if err := c.Deliver(msg, msgQos, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//取消clientId对应会话对topic过滤器的订阅
+func (s *MqttServer) RemoveSubscription(clientId string, filter string) error {
+	session, ok := s.clients.FindSession(clientId)
+	if !ok {
+		return ErrSessionNotFound
+	}
+	if !s.subscriptions.Unsubscribe(filter, session.Id) {
+		return ErrSubscriptionNotFound
+	}
+	s.publishEvent(&event.Unsubscribed{ClientId: clientId, Filter: filter})
+	return nil
+}
@@ -0,0 +1,191 @@
+package mqtt
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/logger"
+	"github.com/davidfantasy/embedded-mqtt-broker/trie"
+)
+
+//管理接口返回的订阅，包含订阅所属的clientId
+type clientSubscription struct {
+	ClientId string `json:"clientId"`
+	SubscriptionInfo
+}
+
+//GET /clients/{id}的返回值
+type clientDetail struct {
+	ClientInfo
+	Subscriptions []SubscriptionInfo `json:"subscriptions"`
+}
+
+//保留消息，payload按字符串返回
+type retainedMessage struct {
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+	Qos     byte   `json:"qos"`
+}
+
+//POST /publish的请求体
+type publishRequest struct {
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+	Qos     byte   `json:"qos"`
+	Retain  bool   `json:"retain"`
+}
+
+//返回以JSON格式提供管理接口的http.Handler，可以挂载到已有的http服务上：
+//
+//	GET    /clients           在线客户端列表
+//	GET    /clients/{id}      客户端的信息及其订阅
+//	DELETE /clients/{id}      断开客户端
+//	GET    /subscriptions     所有会话的订阅
+//	GET    /sessions          所有会话
+//	GET    /topics/retained   保留消息，可以通过filter参数指定topic过滤器，默认为#
+//	POST   /publish           发布消息
+//
+//token不为空时请求需要携带"Authorization: Bearer {token}"请求头，为空时不做校验，
+//此时只应在可信的网络中开放该接口
+func (s *MqttServer) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/clients", allowMethod(http.MethodGet, s.serveClients))
+	mux.HandleFunc("/clients/", s.serveClient)
+	mux.HandleFunc("/subscriptions", allowMethod(http.MethodGet, s.serveSubscriptions))
+	mux.HandleFunc("/sessions", allowMethod(http.MethodGet, s.serveSessions))
+	mux.HandleFunc("/topics/retained", allowMethod(http.MethodGet, s.serveRetained))
+	mux.HandleFunc("/publish", allowMethod(http.MethodPost, s.servePublish))
+	if len(token) == 0 {
+		return mux
+	}
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func allowMethod(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.WARN.Println("write admin response failed:", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (s *MqttServer) serveClients(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Clients())
+}
+
+func (s *MqttServer) serveClient(w http.ResponseWriter, r *http.Request) {
+	clientId := strings.TrimPrefix(r.URL.Path, "/clients/")
+	if len(clientId) == 0 || strings.Contains(clientId, "/") {
+		writeJSONError(w, http.StatusNotFound, ErrClientNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		info, err := s.Client(clientId)
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, err)
+			return
+		}
+		subscriptions, err := s.ClientSubscriptions(clientId)
+		if err != nil {
+			//客户端刚好断开并且会话已被清除
+			subscriptions = []SubscriptionInfo{}
+		}
+		writeJSON(w, http.StatusOK, clientDetail{ClientInfo: info, Subscriptions: subscriptions})
+	case http.MethodDelete:
+		if err := s.KickClient(clientId); err != nil {
+			writeJSONError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+func (s *MqttServer) serveSubscriptions(w http.ResponseWriter, r *http.Request) {
+	subscriptions := make([]clientSubscription, 0)
+	for _, session := range s.clients.Sessions() {
+		for _, sub := range s.subscriptions.sessionSubscriptions(session.Id) {
+			subscriptions = append(subscriptions, clientSubscription{ClientId: session.ClientId, SubscriptionInfo: sub})
+		}
+	}
+	writeJSON(w, http.StatusOK, subscriptions)
+}
+
+func (s *MqttServer) serveSessions(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Sessions())
+}
+
+func (s *MqttServer) serveRetained(w http.ResponseWriter, r *http.Request) {
+	filter := r.URL.Query().Get("filter")
+	if len(filter) == 0 {
+		filter = "#"
+	}
+	if err := trie.ValidateTopicFilter(filter); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	messages := make([]retainedMessage, 0)
+	for _, msg := range s.retained.GetRetainedMessages(filter) {
+		messages = append(messages, retainedMessage{Topic: msg.TopicName, Payload: string(msg.Payload), Qos: msg.Qos})
+	}
+	writeJSON(w, http.StatusOK, messages)
+}
+
+func (s *MqttServer) servePublish(w http.ResponseWriter, r *http.Request) {
+	var req publishRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := trie.ValidateTopicName(req.Topic); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Qos > 2 {
+		writeJSONError(w, http.StatusBadRequest, ErrInvalidQos)
+		return
+	}
+	err := s.Publish(req.Topic, []byte(req.Payload), req.Qos, req.Retain)
+	if errors.Is(err, ErrServerClosed) {
+		writeJSONError(w, http.StatusServiceUnavailable, err)
+		return
+	} else if errors.Is(err, ErrInvalidHookMessage) {
+		//钩子将消息修改成了不合法的消息，消息没有被发布
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		//消息已经发布，但部分订阅者投递失败
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,120 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/client"
+	"github.com/davidfantasy/embedded-mqtt-broker/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+func adminRequest(t *testing.T, handler http.Handler, method string, path string, body string, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+//将指定topic的消息修改为不合法的qos
+type invalidPublishHook struct {
+	HookBase
+}
+
+func (h *invalidPublishHook) OnPublish(c *client.Client, msg *Message) bool {
+	if msg.Topic == "http/invalid" {
+		msg.Qos = 3
+	}
+	return true
+}
+
+func TestAdminHandler(t *testing.T) {
+	server := newTestServer()
+	handler := server.AdminHandler("secret")
+	c := connectTestClient(t, server, "http-client", false)
+	defer c.Close()
+	subscribeTestTopic(t, c, "http/+", 1)
+
+	rec := adminRequest(t, handler, http.MethodGet, "/clients", "", "")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = adminRequest(t, handler, http.MethodGet, "/clients", "", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = adminRequest(t, handler, http.MethodGet, "/clients", "", "secret")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var clients []ClientInfo
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &clients))
+	assert.Len(t, clients, 1)
+	assert.Equal(t, "http-client", clients[0].ClientId)
+
+	rec = adminRequest(t, handler, http.MethodGet, "/clients/http-client", "", "secret")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var detail clientDetail
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &detail))
+	assert.Equal(t, "http-client", detail.ClientId)
+	assert.Equal(t, []SubscriptionInfo{{Filter: "http/+", Qos: 1}}, detail.Subscriptions)
+	rec = adminRequest(t, handler, http.MethodGet, "/clients/unknown", "", "secret")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = adminRequest(t, handler, http.MethodGet, "/subscriptions", "", "secret")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var subscriptions []clientSubscription
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &subscriptions))
+	assert.Equal(t, []clientSubscription{{ClientId: "http-client", SubscriptionInfo: SubscriptionInfo{Filter: "http/+", Qos: 1}}}, subscriptions)
+
+	rec = adminRequest(t, handler, http.MethodGet, "/sessions", "", "secret")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var sessions []SessionInfo
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &sessions))
+	assert.Len(t, sessions, 1)
+	assert.True(t, sessions[0].Online)
+	assert.Equal(t, 1, sessions[0].Subscriptions)
+
+	//发布的消息会投递给管道另一端的客户端，需要在测试协程中读取
+	published := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		published <- adminRequest(t, handler, http.MethodPost, "/publish", `{"topic":"http/status","payload":"online"}`, "secret")
+	}()
+	msg, ok := readTestPacket(t, c).(*packets.PublishPacket)
+	assert.True(t, ok)
+	assert.Equal(t, "http/status", msg.TopicName)
+	assert.Equal(t, http.StatusNoContent, (<-published).Code)
+	rec = adminRequest(t, handler, http.MethodPost, "/publish", `{"topic":"device/status","payload":"online","qos":1,"retain":true}`, "secret")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	rec = adminRequest(t, handler, http.MethodPost, "/publish", `{"topic":"http/#","payload":"x"}`, "secret")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = adminRequest(t, handler, http.MethodPost, "/publish", `{"topic":"http/a","qos":3}`, "secret")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = adminRequest(t, handler, http.MethodGet, "/publish", "", "secret")
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	//被钩子修改成不合法的消息没有发布
+	server.AddHook(&invalidPublishHook{})
+	rec = adminRequest(t, handler, http.MethodPost, "/publish", `{"topic":"http/invalid","payload":"x"}`, "secret")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = adminRequest(t, handler, http.MethodGet, "/topics/retained", "", "secret")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var retained []retainedMessage
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &retained))
+	assert.Equal(t, []retainedMessage{{Topic: "device/status", Payload: "online", Qos: 1}}, retained)
+	rec = adminRequest(t, handler, http.MethodGet, "/topics/retained?filter=other/%23", "", "secret")
+	assert.Equal(t, "[]\n", rec.Body.String())
+
+	rec = adminRequest(t, handler, http.MethodDelete, "/clients/http-client", "", "secret")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Len(t, server.Clients(), 0)
+	rec = adminRequest(t, handler, http.MethodDelete, "/clients/http-client", "", "secret")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	//token为空时不校验
+	rec = adminRequest(t, server.AdminHandler(""), http.MethodGet, "/clients", "", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "[]\n", rec.Body.String())
+}
@@ -0,0 +1,112 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdmin(t *testing.T) {
+	server := newTestServer()
+	cp := newTestConnectPacket("admin-client", false)
+	cp.ProtocolVersion = packets.MQTT5
+	cp.UsernameFlag = true
+	cp.Username = "admin"
+	cp.Keepalive = 30
+	expiry := uint32(60)
+	cp.Properties = &packets.Properties{SessionExpiryInterval: &expiry}
+	c := connectTestClientWith(t, server, cp)
+	defer c.Close()
+
+	clients := server.Clients()
+	assert.Len(t, clients, 1)
+	assert.Equal(t, "admin-client", clients[0].ClientId)
+	assert.Equal(t, "admin", clients[0].Username)
+	assert.Equal(t, uint16(30), clients[0].Keepalive)
+	assert.Equal(t, "test", clients[0].Listener)
+	assert.False(t, clients[0].ConnectedTime.IsZero())
+	assert.True(t, clients[0].BytesReceived > 0)
+	//管道的写入在对端读取后才返回，计数可能稍晚于客户端收到CONNACK
+	assert.Eventually(t, func() bool {
+		info, err := server.Client("admin-client")
+		return err == nil && info.BytesSent > 0
+	}, time.Second, 10*time.Millisecond)
+	_, err := server.Client("unknown")
+	assert.ErrorIs(t, err, ErrClientNotFound)
+
+	sp := packets.NewMqttPacketWithVersion(packets.Subscribe, packets.MQTT5).(*packets.SubscribePacket)
+	sp.MessageID = 1
+	sp.Topics = []string{"status/+"}
+	sp.Qoss = []byte{0}
+	assert.NoError(t, sp.Write(c))
+	_, ok := readTestPacketWithVersion(t, c, packets.MQTT5).(*packets.SubackPacket)
+	assert.True(t, ok)
+
+	//代替会话订阅时会立即收到匹配的保留消息
+	assert.NoError(t, server.Publish("admin/x", []byte("retained"), 1, true))
+	added := make(chan error, 1)
+	go func() {
+		added <- server.AddSubscription("admin-client", "admin/x", 1)
+	}()
+	retained, ok := readTestPacketWithVersion(t, c, packets.MQTT5).(*packets.PublishPacket)
+	assert.True(t, ok)
+	assert.Equal(t, "admin/x", retained.TopicName)
+	assert.True(t, retained.Retain)
+	assert.NoError(t, <-added)
+	subscriptions, err := server.ClientSubscriptions("admin-client")
+	assert.NoError(t, err)
+	assert.Equal(t, []SubscriptionInfo{{Filter: "admin/x", Qos: 1}, {Filter: "status/+", Qos: 0}}, subscriptions)
+	assert.ErrorIs(t, server.AddSubscription("admin-client", "admin/x", 3), ErrInvalidQos)
+	assert.Error(t, server.AddSubscription("admin-client", "admin/#/x", 0))
+	assert.ErrorIs(t, server.AddSubscription("unknown", "admin/x", 0), ErrSessionNotFound)
+	assert.NoError(t, server.RemoveSubscription("admin-client", "status/+"))
+	assert.ErrorIs(t, server.RemoveSubscription("admin-client", "status/+"), ErrSubscriptionNotFound)
+
+	sessions := server.Sessions()
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, "admin-client", sessions[0].ClientId)
+	assert.True(t, sessions[0].Online)
+	assert.Equal(t, 1, sessions[0].Subscriptions)
+
+	//踢下线的mqtt 5.0客户端会收到原因码0x98，持久会话被保留
+	kicked := make(chan error, 1)
+	go func() {
+		kicked <- server.KickClient("admin-client")
+	}()
+	disconnect, ok := readTestPacketWithVersion(t, c, packets.MQTT5).(*packets.DisconnectPacket)
+	assert.True(t, ok)
+	assert.Equal(t, byte(packets.ReasonAdministrativeAction), disconnect.ReasonCode)
+	assert.NoError(t, <-kicked)
+	assert.Len(t, server.Clients(), 0)
+	assert.ErrorIs(t, server.KickClient("admin-client"), ErrClientNotFound)
+	sessions = server.Sessions()
+	assert.Len(t, sessions, 1)
+	assert.False(t, sessions[0].Online)
+	assert.True(t, sessions[0].ExpireAt.After(time.Now()))
+	subscriptions, err = server.ClientSubscriptions("admin-client")
+	assert.NoError(t, err)
+	assert.Len(t, subscriptions, 1)
+
+	assert.NoError(t, server.ExpireSession("admin-client"))
+	assert.ErrorIs(t, server.ExpireSession("admin-client"), ErrSessionNotFound)
+	assert.Len(t, server.Sessions(), 0)
+	_, err = server.ClientSubscriptions("admin-client")
+	assert.ErrorIs(t, err, ErrSessionNotFound)
+	assert.Eventually(t, func() bool {
+		return server.subscriptions.CountSubscriptions() == 0
+	}, time.Second, 10*time.Millisecond)
+
+	//clean session的客户端断开时会话已经被清除，同样视为清除成功
+	clean := connectTestClient(t, server, "admin-clean", true)
+	defer clean.Close()
+	expired := make(chan error, 1)
+	go func() {
+		expired <- server.ExpireSession("admin-clean")
+	}()
+	packets.ReadPacket(clean)
+	assert.NoError(t, <-expired)
+	assert.Len(t, server.Clients(), 0)
+	assert.Len(t, server.Sessions(), 0)
+}
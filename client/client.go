@@ -1,17 +1,27 @@
 package client
 
 import (
+	"fmt"
 	"net"
+	"sort"
 	"sync"
 	"time"
 
-	"github.com/davidfantasy/embedded-mqtt-broker/config"
+	"github.com/davidfantasy/embedded-mqtt-broker/event"
 	"github.com/davidfantasy/embedded-mqtt-broker/logger"
 	"github.com/davidfantasy/embedded-mqtt-broker/packets"
 	"github.com/davidfantasy/embedded-mqtt-broker/security"
 )
 
-var clientMap sync.Map
+//服务端主动断开客户端连接的原因
+type DisconnectError struct {
+	//mqtt 5.0的原因码，例如会话被接管、keepalive超时或服务端关闭
+	ReasonCode byte
+}
+
+func (e *DisconnectError) Error() string {
+	return fmt.Sprintf("disconnected by server,reason code:0x%02X", e.ReasonCode)
+}
 
 const (
 	Unknown      = 0
@@ -29,32 +39,140 @@ type Client struct {
 	authentication *security.Authentication
 	LastPingTime   time.Time
 	ConnectedTime  time.Time
-	CleanSession   bool
-	Keepalive      uint16
-	pingChan       chan struct{}
-	pubAuthCache   map[string]bool
+	//连接时使用的用户名
+	Username     string
+	CleanSession bool
+	Keepalive    uint16
+	//连接使用的mqtt协议版本
+	ProtocolVersion byte
+	//客户端接入的监听名称
+	Listener string
+	//客户端断开后会话的保留时间
+	SessionExpiryInterval time.Duration
+	pingChan              chan struct{}
+	//连接断开后关闭，用于通知该客户端的后台协程退出
+	done         chan struct{}
+	pubAuthCache map[string]bool
+	session      *Session
+	//保证同一时刻只有一个协程向连接写入数据
+	writeMu sync.Mutex
+	//写入数据的超时时间，0表示不限制
+	writeTimeout time.Duration
+	//mqtt 5.0客户端允许接收的最大报文长度，0表示不限制
+	maxPacketSize uint32
+	//等待写入连接的消息，以及是否已经有协程在负责写入，都需要在session.queueMu的保护下使用
+	outbox   []*packets.PublishPacket
+	flushing bool
+	//qos>0的消息未收到确认时的重发间隔
+	retryInterval time.Duration
+	//客户端所属的注册表
+	registry *Registry
+	//服务端主动断开连接的原因，客户端自行断开时为nil
+	closeReason error
+	//遗嘱消息，连接非正常断开时发布
+	will   *packets.PublishPacket
+	willMu sync.Mutex
 }
 
-func NewClient(cp *packets.ConnectPacket, conn net.Conn, authentication *security.Authentication, serverConfig *config.ServerConfig) (*Client, bool) {
+func (r *Registry) NewClient(cp *packets.ConnectPacket, conn net.Conn, authentication *security.Authentication, listener string) (*Client, bool) {
+	serverConfig := r.config
 	logger.DEBUG.Println("新客户端连接头为：%s", cp.String())
 	client := &Client{Id: cp.ClientId, ConnectedTime: time.Now(), status: Connected, Conn: conn, Keepalive: cp.Keepalive}
 	client.pingChan = make(chan struct{})
+	client.done = make(chan struct{})
 	client.authentication = authentication
 	client.pubAuthCache = make(map[string]bool)
+	//客户端注册后就可能收到投递的消息，在SendConnack发送CONNACK之前这些消息只放入outbox，不写入连接
+	client.flushing = true
 	client.CleanSession = cp.CleanSession
-	sessionId, sessionPresent := createSession(client.Id, serverConfig.SessionExpiryInterval, !client.CleanSession)
-	client.SessionId = sessionId
+	client.ProtocolVersion = cp.ProtocolVersion
+	client.Listener = listener
+	client.Username = cp.Username
+	client.registry = r
+	client.SessionExpiryInterval = serverConfig.SessionExpiryInterval
+	if len(client.Id) == 0 {
+		//客户端没有提供clientId时由服务端分配一个唯一的id
+		client.Id = "auto-" + snowflakeNode.Generate().String()
+	}
+	if cp.ProtocolVersion == packets.MQTT5 {
+		//mqtt 5.0中会话在断开后是否保留由会话过期时间决定，最长不超过服务端配置的时间
+		var expiry uint32
+		if cp.Properties != nil && cp.Properties.SessionExpiryInterval != nil {
+			expiry = *cp.Properties.SessionExpiryInterval
+		}
+		client.CleanSession = expiry == 0
+		if expiry != 0xFFFFFFFF && time.Duration(expiry)*time.Second < client.SessionExpiryInterval {
+			client.SessionExpiryInterval = time.Duration(expiry) * time.Second
+		}
+	}
+	if cp.ProtocolVersion == packets.MQTT5 && cp.Properties != nil && cp.Properties.MaximumPacketSize != nil {
+		client.maxPacketSize = *cp.Properties.MaximumPacketSize
+	}
+	if cp.WillFlag {
+		will := client.NewPacket(packets.Publish).(*packets.PublishPacket)
+		will.TopicName = cp.WillTopic
+		will.Payload = cp.WillMessage
+		will.Qos = cp.WillQos
+		will.Retain = cp.WillRetain
+		will.Properties = cp.WillProperties
+		client.will = will
+	}
+	r.clientMapMu.Lock()
+	//同一个clientId的客户端已经在线，需要断开旧的连接，会话由新的连接接管。发送DISCONNECT可能会阻塞，
+	//所以这里只标记旧的客户端，在释放clientMapMu之后再断开连接
+	var old *Client
+	var takenOver bool
+	if c, ok := r.clientMap.Load(client.Id); ok {
+		old = c.(*Client)
+		takenOver = old.takeover()
+	}
+	//CleanSession（mqtt 5.0中为Clean Start）为false时尝试恢复之前的会话
+	session, sessionPresent, events := r.createSession(client.Id, client.SessionExpiryInterval, !cp.CleanSession)
+	client.session = session
+	client.SessionId = session.Id
+	session.inflight.setMax(inflightWindow(serverConfig.MaxInflightMessages, cp))
+	client.retryInterval = serverConfig.InflightRetryInterval
+	client.writeTimeout = serverConfig.WriteTimeout
 	if client.Keepalive != 0 {
 		client.checKeepalive()
 	}
-	//TODO 旧的客户端应该被T掉
-	clientMap.Store(client.Id, client)
+	//mqtt 5.0不允许在连接存续期间重发消息，只在恢复会话时重发
+	if client.retryInterval > 0 && client.ProtocolVersion != packets.MQTT5 {
+		client.checkInflight()
+	}
+	r.clientMap.Store(client.Id, client)
+	if old != nil {
+		logger.INFO.Printf("client %s has been taken over by a new connection", client.Id)
+		events = append(events, event.NewEvent(&event.ClientTakenOver{ClientId: client.Id, RemoteAddr: client.RemoteAddr(), Listener: listener}))
+	}
+	r.clientMapMu.Unlock()
+	if takenOver {
+		old.closeTakenOver()
+	}
+	r.publishEvents(events)
 	return client, sessionPresent
 }
 
-func CloseClient(client *Client) {
+//飞行窗口的大小，mqtt 5.0的客户端通过Receive Maximum限制同时处理的qos>0的消息数量，飞行窗口不能超过该值
+func inflightWindow(max int, cp *packets.ConnectPacket) int {
+	if cp.ProtocolVersion != packets.MQTT5 || cp.Properties == nil || cp.Properties.ReceiveMaximum == nil || *cp.Properties.ReceiveMaximum == 0 {
+		return max
+	}
+	receiveMaximum := int(*cp.Properties.ReceiveMaximum)
+	if max == 0 || receiveMaximum < max {
+		return receiveMaximum
+	}
+	return max
+}
+
+func (r *Registry) CloseClient(client *Client) {
 	client.close()
-	clientMap.Delete(client.Id)
+	r.clientMapMu.Lock()
+	defer r.clientMapMu.Unlock()
+	//clientId可能已经被新的连接接管，此时不能移除新的客户端
+	if c, ok := r.clientMap.Load(client.Id); ok && c == client {
+		r.clientMap.Delete(client.Id)
+	}
 }
 
 func (client *Client) IsConnected() bool {
@@ -65,8 +183,243 @@ func (client *Client) IsConnected() bool {
 
 func (client *Client) Touch() {
 	if client.Keepalive != 0 {
-		client.pingChan <- struct{}{}
+		select {
+		case client.pingChan <- struct{}{}:
+		case <-client.done:
+		}
+	}
+}
+
+//以指定的原因码断开客户端，mqtt 5.0的客户端会先收到服务端发送的DISCONNECT
+func (client *Client) Disconnect(reasonCode byte) {
+	client.statusMutex.Lock()
+	if client.status == Connected {
+		client.sendDisconnect(reasonCode)
+		client.closeReason = &DisconnectError{ReasonCode: reasonCode}
+	}
+	client.statusMutex.Unlock()
+	client.registry.CloseClient(client)
+}
+
+//客户端连接的远程地址
+func (client *Client) RemoteAddr() string {
+	if client.Conn == nil || client.Conn.RemoteAddr() == nil {
+		return ""
+	}
+	return client.Conn.RemoteAddr().String()
+}
+
+//服务端主动断开连接的原因，返回*DisconnectError；连接仍然在线或者是由客户端断开的则返回nil
+func (client *Client) DisconnectReason() error {
+	client.statusMutex.Lock()
+	defer client.statusMutex.Unlock()
+	return client.closeReason
+}
+
+//飞行窗口中等待客户端确认的消息数量
+func (client *Client) InflightCount() int {
+	return client.session.inflight.len()
+}
+
+//创建一个按照客户端协议版本编码的数据包
+func (client *Client) NewPacket(messageType byte) packets.MqttPacket {
+	return packets.NewMqttPacketWithVersion(messageType, client.ProtocolVersion)
+}
+
+//向客户端连接写入一个数据包
+func (client *Client) WritePacket(packet packets.MqttPacket) error {
+	client.writeMu.Lock()
+	defer client.writeMu.Unlock()
+	return client.write(packet)
+}
+
+//需要在writeMu的保护下调用。写入失败（包括超时）后连接中的数据已经不完整，直接关闭连接，由读取协程完成断开的处理
+func (client *Client) write(packet packets.MqttPacket) error {
+	if client.writeTimeout > 0 {
+		client.Conn.SetWriteDeadline(time.Now().Add(client.writeTimeout))
+	}
+	err := packet.Write(client.Conn)
+	if err != nil {
+		client.Conn.Close()
+	}
+	return err
+}
+
+//发送CONNACK，保证CONNACK是服务端向客户端发送的第一个数据包。之后先重发恢复的会话中未被确认的消息，
+//再按顺序发送在此之前投递给该客户端的消息
+func (client *Client) SendConnack(connack *packets.ConnackPacket) error {
+	if err := client.WritePacket(connack); err != nil {
+		return err
+	}
+	client.ResendInflight()
+	client.session.queueMu.Lock()
+	client.flushing = false
+	if err := client.flush(); err != nil {
+		logger.WARN.Printf("投递CONNACK之前收到的消息时发生错误：clientId [%s],error: %s", client.Id, err)
 	}
+	return nil
+}
+
+//以指定的qos向客户端投递一条消息，qos>0的消息会加入飞行窗口直到收到客户端的确认，
+//飞行窗口已满时消息进入会话的消息队列，窗口中的消息被确认后再按顺序投递。
+//retain表示该消息是否作为保留消息发送
+func (client *Client) Deliver(packet *packets.PublishPacket, qos byte, retain bool) error {
+	session := client.session
+	session.queueMu.Lock()
+	//队列中还有等待投递的消息时，新消息需要排在其后以保证消息的顺序
+	if qos > 0 && len(session.queue.messages) > 0 {
+		defer session.queueMu.Unlock()
+		return session.queue.push(packet, qos, retain)
+	}
+	msg := client.newMessage(packet, qos, retain)
+	if client.tooLarge(msg) {
+		session.queueMu.Unlock()
+		return nil
+	}
+	if qos == 0 {
+		client.outbox = append(client.outbox, msg)
+		return client.flush()
+	}
+	if _, err := session.inflight.add(msg); err != nil {
+		defer session.queueMu.Unlock()
+		return session.queue.push(packet, qos, retain)
+	}
+	client.outbox = append(client.outbox, msg)
+	return client.flush()
+}
+
+//将待发送的消息写入连接，需要在持有queueMu时调用，返回前会释放queueMu。写入时不持有queueMu，
+//同一时刻只有一个协程负责写入以保证消息按照加入的顺序发送，其余协程放入消息后直接返回，不会因为客户端接收缓慢而阻塞
+func (client *Client) flush() error {
+	session := client.session
+	if client.flushing {
+		session.queueMu.Unlock()
+		return nil
+	}
+	client.flushing = true
+	var firstErr error
+	for len(client.outbox) > 0 {
+		pending := client.outbox
+		client.outbox = nil
+		session.queueMu.Unlock()
+		//发送失败的qos>0的消息仍在飞行窗口中，会在下次恢复会话后重发
+		for _, msg := range pending {
+			if err := client.WritePacket(msg); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		session.queueMu.Lock()
+	}
+	client.flushing = false
+	session.queueMu.Unlock()
+	return firstErr
+}
+
+//超过客户端允许的最大报文长度的消息不能发送，按照协议直接丢弃，视为已经投递完成
+func (client *Client) tooLarge(msg *packets.PublishPacket) bool {
+	if client.maxPacketSize == 0 || msg.Size() <= int(client.maxPacketSize) {
+		return false
+	}
+	logger.WARN.Printf("消息超过了客户端允许的最大报文长度，该条消息将被丢弃：clientId [%s],topic: %s", client.Id, msg.TopicName)
+	return true
+}
+
+func (client *Client) newMessage(packet *packets.PublishPacket, qos byte, retain bool) *packets.PublishPacket {
+	msg := packet.Copy()
+	msg.ProtocolVersion = client.ProtocolVersion
+	msg.Qos = qos
+	msg.Retain = retain
+	return msg
+}
+
+//飞行窗口有空余时按顺序投递会话消息队列中的消息
+func (client *Client) deliverPending() {
+	session := client.session
+	session.queueMu.Lock()
+	for len(session.queue.messages) > 0 && !session.inflight.full() {
+		queued := session.queue.pop()
+		msg := client.newMessage(queued.packet, queued.qos, queued.retain)
+		if client.tooLarge(msg) {
+			continue
+		}
+		if _, err := session.inflight.add(msg); err != nil {
+			break
+		}
+		client.outbox = append(client.outbox, msg)
+	}
+	if err := client.flush(); err != nil {
+		logger.WARN.Printf("投递队列中的消息时发生错误：clientId [%s],error: %s", client.Id, err)
+	}
+}
+
+//收到客户端的PUBACK或PUBCOMP后，将对应的消息移出飞行窗口，并继续投递等待中的消息
+func (client *Client) Acknowledge(messageId uint16) {
+	if !client.session.inflight.remove(messageId) {
+		logger.DEBUG.Printf("received an unknown ack,clientId:%s,messageId:%d", client.Id, messageId)
+		return
+	}
+	client.deliverPending()
+}
+
+//收到客户端的PUBREC后回复PUBREL，消息在收到PUBCOMP前仍保留在飞行窗口中
+func (client *Client) Release(messageId uint16) error {
+	if !client.session.inflight.release(messageId) {
+		logger.DEBUG.Printf("received an unknown pubrec,clientId:%s,messageId:%d", client.Id, messageId)
+	}
+	//即使没有找到对应的消息也要回复PUBREL，否则客户端的流程无法结束
+	pubrel := client.NewPacket(packets.Pubrel).(*packets.PubrelPacket)
+	pubrel.MessageID = messageId
+	return client.WritePacket(pubrel)
+}
+
+//记录客户端发来的qos为2的消息，返回false表示该消息是重复的，不应再次转发
+func (client *Client) ReceiveQos2(messageId uint16) bool {
+	return client.session.markQos2Received(messageId)
+}
+
+//客户端发来PUBREL后，该messageId可以被复用
+func (client *Client) CompleteQos2(messageId uint16) {
+	client.session.releaseQos2(messageId)
+}
+
+//重发飞行窗口中在本次连接之前发送的消息，用于客户端恢复会话后
+func (client *Client) ResendInflight() {
+	client.resend(client.session.inflight.expired(client.ConnectedTime))
+}
+
+func (client *Client) resend(messages []inflightMessage) {
+	for _, msg := range messages {
+		var err error
+		if msg.released {
+			pubrel := client.NewPacket(packets.Pubrel).(*packets.PubrelPacket)
+			pubrel.MessageID = msg.packet.MessageID
+			err = client.WritePacket(pubrel)
+		} else {
+			client.writeMu.Lock()
+			//消息可能正在被首次发送，需要在写锁内修改DUP标志
+			msg.packet.Dup = true
+			err = client.write(msg.packet)
+			client.writeMu.Unlock()
+		}
+		if err != nil {
+			logger.WARN.Printf("重发消息时发生错误：clientId [%s],error: %s", client.Id, err)
+			return
+		}
+	}
+}
+
+//取出遗嘱消息，遗嘱最多只会被取出一次，没有遗嘱时返回nil
+func (client *Client) TakeWill() *packets.PublishPacket {
+	client.willMu.Lock()
+	defer client.willMu.Unlock()
+	will := client.will
+	client.will = nil
+	return will
+}
+
+//客户端正常断开连接时需要丢弃遗嘱消息
+func (client *Client) ClearWill() {
+	client.TakeWill()
 }
 
 func (client *Client) CanSub(topic string) bool {
@@ -92,18 +445,24 @@ func (client *Client) CanPub(topic string) bool {
 }
 
 func (client *Client) close() {
-	if !client.IsConnected() {
+	var events []event.Event
+	client.statusMutex.Lock()
+	defer func() {
+		client.statusMutex.Unlock()
+		client.registry.publishEvents(events)
+	}()
+	//已经断开或被新连接接管的客户端不需要再处理
+	if client.status != Connected {
 		return
 	}
-	client.statusMutex.Lock()
-	defer client.statusMutex.Unlock()
 	//处理会话
 	if client.CleanSession {
-		clearSession(client.Id, client.SessionId)
+		events = client.registry.clearSession(client.Id, client.SessionId)
 	} else {
-		sessionInactive(client.Id, client.SessionId)
+		client.registry.sessionInactive(client.Id, client.SessionId)
 	}
 	client.status = Disconnected
+	close(client.done)
 	err := client.Conn.Close()
 	if err != nil {
 		client.status = Unknown
@@ -112,6 +471,45 @@ func (client *Client) close() {
 	}
 }
 
+//将客户端标记为已被新连接接管，会话已经转交给新的连接，所以这里不处理会话。
+//返回true时需要调用closeTakenOver断开旧的连接
+func (client *Client) takeover() bool {
+	client.statusMutex.Lock()
+	defer client.statusMutex.Unlock()
+	if client.status != Connected {
+		return false
+	}
+	client.status = Disconnected
+	close(client.done)
+	client.closeReason = &DisconnectError{ReasonCode: packets.ReasonSessionTakenOver}
+	return true
+}
+
+//向被接管的客户端发送DISCONNECT并关闭连接，不能在持有clientMapMu时调用
+func (client *Client) closeTakenOver() {
+	client.sendDisconnect(packets.ReasonSessionTakenOver)
+	if client.Conn != nil {
+		if err := client.Conn.Close(); err != nil {
+			logger.ERROR.Printf("close client connection err: %v \n", err)
+		}
+	}
+}
+
+//mqtt 5.0中服务端主动断开连接前需要发送带原因码的DISCONNECT
+func (client *Client) sendDisconnect(reasonCode byte) {
+	if client.ProtocolVersion != packets.MQTT5 || client.Conn == nil {
+		return
+	}
+	disconnect := client.NewPacket(packets.Disconnect).(*packets.DisconnectPacket)
+	disconnect.ReasonCode = reasonCode
+	client.writeMu.Lock()
+	defer client.writeMu.Unlock()
+	client.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if err := disconnect.Write(client.Conn); err != nil {
+		logger.DEBUG.Printf("send disconnect packet failed,clientId:%s,err:%v", client.Id, err)
+	}
+}
+
 func (client *Client) checKeepalive() {
 	go func() {
 		defer func() {
@@ -130,22 +528,97 @@ func (client *Client) checKeepalive() {
 				pingDelay := time.Since(client.LastPingTime)
 				if pingDelay >= time.Duration(client.Keepalive)*time.Second*3/2 {
 					logger.INFO.Printf("client：%v 在规定的周期内没有收到客户端的有效消息，准备断开连接", client.Id)
-					CloseClient(client)
+					client.Disconnect(packets.ReasonKeepAliveTimeout)
 					return
 				}
 			case <-client.pingChan:
 				client.LastPingTime = time.Now()
+			case <-client.done:
+				return
 			}
 		}
 	}()
 }
 
-func FindClientsBySessionIds(sessionIds []string) []*Client {
-	sessions := findSessions(sessionIds)
+//定时重发超时未收到确认的消息
+func (client *Client) checkInflight() {
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				logger.ERROR.Printf("在checkInflight时候发生了一个错误：%v", err)
+			}
+		}()
+		ticker := time.NewTicker(client.retryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if !client.IsConnected() {
+					return
+				}
+				client.resend(client.session.inflight.expired(time.Now().Add(-client.retryInterval)))
+			case <-client.done:
+				return
+			}
+		}
+	}()
+}
+
+//向某个会话投递消息，客户端在线时直接投递，持久会话离线时将qos>0的消息加入离线队列，
+//retain表示该消息是否以保留消息的标志发送
+func (r *Registry) DeliverToSession(sessionId string, packet *packets.PublishPacket, qos byte, retain bool) error {
+	sessions := r.findSessions([]string{sessionId})
+	if len(sessions) == 0 {
+		return nil
+	}
+	session := sessions[0]
+	//检查客户端是否在线和入队需要在同一个锁内完成，避免客户端恢复会话时遗漏消息
+	session.queueMu.Lock()
+	c := r.FindClientBySessionId(sessionId)
+	if c == nil {
+		defer session.queueMu.Unlock()
+		if qos == 0 {
+			return nil
+		}
+		return session.queue.push(packet, qos, retain)
+	}
+	session.queueMu.Unlock()
+	return c.Deliver(packet, qos, retain)
+}
+
+//投递会话离线期间缓存的消息，用于客户端恢复会话后
+func (client *Client) DeliverQueued() {
+	client.deliverPending()
+}
+
+//根据clientId查找当前在线的客户端，不在线则返回nil
+func (r *Registry) FindClient(clientId string) *Client {
+	c, ok := r.clientMap.Load(clientId)
+	if !ok {
+		return nil
+	}
+	return c.(*Client)
+}
+
+//根据sessionId查找当前在线的客户端，不在线则返回nil
+func (r *Registry) FindClientBySessionId(sessionId string) *Client {
+	sessions := r.findSessions([]string{sessionId})
+	if len(sessions) == 0 {
+		return nil
+	}
+	c, ok := r.clientMap.Load(sessions[0].ClientId)
+	if !ok || c.(*Client).SessionId != sessionId {
+		return nil
+	}
+	return c.(*Client)
+}
+
+func (r *Registry) FindClientsBySessionIds(sessionIds []string) []*Client {
+	sessions := r.findSessions(sessionIds)
 	if len(sessions) != 0 {
 		clients := make([]*Client, len(sessions))
 		for i, s := range sessions {
-			c, ok := clientMap.Load(s.ClientId)
+			c, ok := r.clientMap.Load(s.ClientId)
 			if ok {
 				clients[i] = c.(*Client)
 			}
@@ -154,3 +627,26 @@ func FindClientsBySessionIds(sessionIds []string) []*Client {
 	}
 	return nil
 }
+
+//当前所有在线的客户端，按clientId排序
+func (r *Registry) Clients() []*Client {
+	clients := make([]*Client, 0)
+	r.clientMap.Range(func(key, value interface{}) bool {
+		clients = append(clients, value.(*Client))
+		return true
+	})
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Id < clients[j].Id
+	})
+	return clients
+}
+
+//当前在线的客户端数量
+func (r *Registry) CountClients() int {
+	count := 0
+	r.clientMap.Range(func(key, value interface{}) bool {
+		count++
+		return true
+	})
+	return count
+}
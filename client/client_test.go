@@ -1,10 +1,13 @@
 package client
 
 import (
+	"net"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/davidfantasy/embedded-mqtt-broker/config"
+	"github.com/davidfantasy/embedded-mqtt-broker/event"
 	"github.com/davidfantasy/embedded-mqtt-broker/packets"
 	"github.com/stretchr/testify/assert"
 )
@@ -14,28 +17,232 @@ func TestNewClient(t *testing.T) {
 	cp.ClientId = "testC1"
 	cp.CleanSession = false
 	cp.Keepalive = 0
-	config := config.NewDefaultConfig()
-	c1, sp := NewClient(cp, nil, nil, config)
+	registry := NewRegistry(config.NewDefaultConfig(), event.NewAsyncEventBus())
+	c1, sp := registry.NewClient(cp, nil, nil, "tcp")
 	assert.False(t, sp)
 	assert.NotNil(t, c1)
-	clients := FindClientsBySessionIds([]string{c1.SessionId})
+	clients := registry.FindClientsBySessionIds([]string{c1.SessionId})
 	assert.Equal(t, 1, len(clients))
 	assert.Equal(t, "testC1", clients[0].Id)
 }
 
 func BenchmarkFindClientsBySessionIds(b *testing.B) {
 	var sessionIds []string
+	registry := NewRegistry(config.NewDefaultConfig(), event.NewAsyncEventBus())
 	for i := 0; i < 100; i++ {
 		cp := packets.NewMqttPacket(packets.Connect).(*packets.ConnectPacket)
 		cp.ClientId = "testC" + strconv.Itoa(i)
 		cp.CleanSession = false
 		cp.Keepalive = 0
-		config := config.NewDefaultConfig()
-		c, _ := NewClient(cp, nil, nil, config)
+		c, _ := registry.NewClient(cp, nil, nil, "tcp")
 		sessionIds = append(sessionIds, c.SessionId)
 	}
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		FindClientsBySessionIds(sessionIds)
+		registry.FindClientsBySessionIds(sessionIds)
 	}
 }
+
+func TestMessageQueueOverflow(t *testing.T) {
+	newPacket := func(payload string) *packets.PublishPacket {
+		p := packets.NewMqttPacket(packets.Publish).(*packets.PublishPacket)
+		p.TopicName = "t"
+		p.Payload = []byte(payload)
+		return p
+	}
+	conf := config.NewDefaultConfig()
+	conf.MaxQueuedMessages = 2
+	conf.QueueOverflowPolicy = config.DropOldest
+	q := newMessageQueue(conf)
+	assert.NoError(t, q.push(newPacket("1"), 1, false))
+	assert.NoError(t, q.push(newPacket("2"), 1, false))
+	assert.NoError(t, q.push(newPacket("3"), 1, false))
+	messages := q.drain()
+	assert.Equal(t, 2, len(messages))
+	assert.Equal(t, []byte("2"), messages[0].packet.Payload)
+
+	conf.QueueOverflowPolicy = config.DropNewest
+	q = newMessageQueue(conf)
+	q.push(newPacket("1"), 1, false)
+	q.push(newPacket("2"), 1, false)
+	assert.NoError(t, q.push(newPacket("3"), 1, false))
+	messages = q.drain()
+	assert.Equal(t, []byte("2"), messages[1].packet.Payload)
+
+	conf.MaxQueuedMessages = 0
+	conf.MaxQueuedBytes = 4
+	conf.QueueOverflowPolicy = config.RejectNew
+	q = newMessageQueue(conf)
+	assert.NoError(t, q.push(newPacket("12"), 1, false))
+	assert.Equal(t, ErrQueueFull, q.push(newPacket("34"), 1, false))
+	assert.Equal(t, 1, len(q.drain()))
+}
+
+func TestInflightWindow(t *testing.T) {
+	in := newInflight(2)
+	for i := 0; i < 2; i++ {
+		_, err := in.add(packets.NewMqttPacket(packets.Publish).(*packets.PublishPacket))
+		assert.NoError(t, err)
+	}
+	_, err := in.add(packets.NewMqttPacket(packets.Publish).(*packets.PublishPacket))
+	assert.Equal(t, ErrInflightFull, err)
+
+	//不限制窗口大小时，所有messageId都被占用后也不能继续添加
+	in = newInflight(0)
+	for i := 0; i < maxInflightIds; i++ {
+		in.add(packets.NewMqttPacket(packets.Publish).(*packets.PublishPacket))
+	}
+	_, err = in.add(packets.NewMqttPacket(packets.Publish).(*packets.PublishPacket))
+	assert.Equal(t, ErrInflightFull, err)
+	assert.True(t, in.remove(1))
+	id, err := in.add(packets.NewMqttPacket(packets.Publish).(*packets.PublishPacket))
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(1), id)
+}
+
+//发送CONNACK并在客户端一侧读取，之后投递的消息才会写入连接。SendConnack会继续发送CONNACK之前投递的消息，
+//返回的chan在SendConnack返回后可读
+func sendTestConnack(t *testing.T, c *Client, conn net.Conn) <-chan error {
+	sent := make(chan error, 1)
+	go func() {
+		sent <- c.SendConnack(packets.NewMqttPacket(packets.Connack).(*packets.ConnackPacket))
+	}()
+	p, err := packets.ReadPacket(conn)
+	assert.NoError(t, err)
+	assert.IsType(t, &packets.ConnackPacket{}, p)
+	return sent
+}
+
+func TestDeliverBeforeConnack(t *testing.T) {
+	registry := NewRegistry(config.NewDefaultConfig(), event.NewAsyncEventBus())
+	cp := packets.NewMqttPacket(packets.Connect).(*packets.ConnectPacket)
+	cp.ClientId = "before-connack"
+	server, conn := net.Pipe()
+	defer conn.Close()
+	c, _ := registry.NewClient(cp, server, nil, "tcp")
+	//客户端注册后、CONNACK发送前投递的消息不会写入连接，所以这里不会阻塞
+	for _, qos := range []byte{0, 1} {
+		p := packets.NewMqttPacket(packets.Publish).(*packets.PublishPacket)
+		p.TopicName = "t"
+		p.Qos = qos
+		assert.NoError(t, registry.DeliverToSession(c.SessionId, p, qos, false))
+	}
+	sent := sendTestConnack(t, c, conn)
+	for _, qos := range []byte{0, 1} {
+		p, err := packets.ReadPacket(conn)
+		assert.NoError(t, err)
+		assert.Equal(t, qos, p.(*packets.PublishPacket).Qos)
+	}
+	assert.NoError(t, <-sent)
+}
+
+func TestDeliverBeyondInflightWindow(t *testing.T) {
+	conf := config.NewDefaultConfig()
+	conf.MaxInflightMessages = 2
+	conf.InflightRetryInterval = 0
+	registry := NewRegistry(conf, event.NewAsyncEventBus())
+	cp := packets.NewMqttPacket(packets.Connect).(*packets.ConnectPacket)
+	cp.ClientId = "window"
+	server, conn := net.Pipe()
+	defer conn.Close()
+	c, _ := registry.NewClient(cp, server, nil, "tcp")
+	assert.NoError(t, <-sendTestConnack(t, c, conn))
+	received := make(chan *packets.PublishPacket, 10)
+	go func() {
+		for {
+			p, err := packets.ReadPacket(conn)
+			if err != nil {
+				return
+			}
+			received <- p.(*packets.PublishPacket)
+		}
+	}()
+	for i := 1; i <= 3; i++ {
+		p := packets.NewMqttPacket(packets.Publish).(*packets.PublishPacket)
+		p.TopicName = "t"
+		p.Payload = []byte(strconv.Itoa(i))
+		assert.NoError(t, c.Deliver(p, 1, false))
+	}
+	first := <-received
+	<-received
+	assert.Equal(t, 2, c.InflightCount())
+	select {
+	case <-received:
+		t.Fatal("message beyond the inflight window should be queued")
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.Acknowledge(first.MessageID)
+	third := <-received
+	assert.Equal(t, []byte("3"), third.Payload)
+	assert.Equal(t, 2, c.InflightCount())
+}
+
+func TestSessionsWithBusyQueue(t *testing.T) {
+	registry := NewRegistry(config.NewDefaultConfig(), event.NewAsyncEventBus())
+	cp := packets.NewMqttPacket(packets.Connect).(*packets.ConnectPacket)
+	cp.ClientId = "busy"
+	c, _ := registry.NewClient(cp, nil, nil, "tcp")
+	//模拟正在向该会话投递消息，此时查询会话快照不能阻塞其他需要会话锁的操作
+	c.session.queueMu.Lock()
+	done := make(chan []SessionInfo)
+	go func() {
+		done <- registry.Sessions()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	counted := make(chan int)
+	go func() {
+		counted <- registry.CountSessions()
+	}()
+	select {
+	case n := <-counted:
+		assert.Equal(t, 1, n)
+	case <-time.After(time.Second):
+		t.Fatal("CountSessions blocked by a session snapshot")
+	}
+	c.session.queueMu.Unlock()
+	sessions := <-done
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, "busy", sessions[0].ClientId)
+}
+
+func TestDeliverToStalledClient(t *testing.T) {
+	conf := config.NewDefaultConfig()
+	conf.InflightRetryInterval = 0
+	conf.WriteTimeout = 200 * time.Millisecond
+	registry := NewRegistry(conf, event.NewAsyncEventBus())
+	cp := packets.NewMqttPacket(packets.Connect).(*packets.ConnectPacket)
+	cp.ClientId = "stalled"
+	server, conn := net.Pipe()
+	defer conn.Close()
+	c, _ := registry.NewClient(cp, server, nil, "tcp")
+	assert.NoError(t, <-sendTestConnack(t, c, conn))
+	newPacket := func() *packets.PublishPacket {
+		p := packets.NewMqttPacket(packets.Publish).(*packets.PublishPacket)
+		p.TopicName = "t"
+		return p
+	}
+	//客户端不读取数据，第一次投递会阻塞在写入上直到超时
+	first := make(chan error, 1)
+	go func() {
+		first <- c.Deliver(newPacket(), 1, false)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	//其余的投递和会话查询不会被阻塞
+	delivered := make(chan error, 1)
+	go func() {
+		delivered <- c.Deliver(newPacket(), 1, false)
+	}()
+	select {
+	case err := <-delivered:
+		assert.NoError(t, err)
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("deliver blocked by a stalled client")
+	}
+	sessions := registry.Sessions()
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, 2, sessions[0].Inflight)
+	//写入超时后连接被关闭
+	assert.Error(t, <-first)
+	_, err := packets.ReadPacket(conn)
+	assert.Error(t, err)
+}
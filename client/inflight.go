@@ -0,0 +1,130 @@
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/packets"
+)
+
+//messageId的取值范围为1~65535，飞行窗口中的消息数量不能超过该值
+const maxInflightIds = 65535
+
+//飞行窗口已满时返回该错误，消息需要等待窗口中的消息被确认后才能发送
+var ErrInflightFull = errors.New("inflight window is full")
+
+//已发送给客户端但尚未收到确认的消息
+type inflightMessage struct {
+	packet *packets.PublishPacket
+	sentAt time.Time
+	//qos为2的消息已收到PUBREC并发送了PUBREL，等待PUBCOMP
+	released bool
+}
+
+//会话的飞行窗口，以messageId为key保存所有等待确认的消息
+type inflight struct {
+	mu       sync.Mutex
+	messages map[uint16]*inflightMessage
+	//按发送顺序保存的messageId，重发时需要保证消息的顺序
+	order  []uint16
+	nextId uint16
+	//飞行窗口的最大消息数量，0表示只受messageId取值范围的限制
+	max int
+}
+
+func newInflight(max int) *inflight {
+	return &inflight{messages: make(map[uint16]*inflightMessage), max: max}
+}
+
+//为消息分配一个未被占用的messageId并加入飞行窗口，窗口已满时返回ErrInflightFull
+func (in *inflight) add(packet *packets.PublishPacket) (uint16, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.isFull() {
+		return 0, ErrInflightFull
+	}
+	//窗口未满时一定存在未被占用的messageId
+	for {
+		in.nextId++
+		if in.nextId == 0 {
+			in.nextId = 1
+		}
+		if _, used := in.messages[in.nextId]; !used {
+			break
+		}
+	}
+	packet.MessageID = in.nextId
+	in.messages[in.nextId] = &inflightMessage{packet: packet, sentAt: time.Now()}
+	in.order = append(in.order, in.nextId)
+	return in.nextId, nil
+}
+
+//修改飞行窗口的最大消息数量，已经在窗口中的消息不受影响
+func (in *inflight) setMax(max int) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.max = max
+}
+
+func (in *inflight) isFull() bool {
+	return len(in.messages) >= maxInflightIds || (in.max > 0 && len(in.messages) >= in.max)
+}
+
+func (in *inflight) full() bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.isFull()
+}
+
+//收到确认后将消息移出飞行窗口
+func (in *inflight) remove(messageId uint16) bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if _, ok := in.messages[messageId]; !ok {
+		return false
+	}
+	delete(in.messages, messageId)
+	for i, id := range in.order {
+		if id == messageId {
+			in.order = append(in.order[:i], in.order[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+//收到PUBREC后将qos为2的消息标记为已释放，之后只需等待PUBCOMP
+func (in *inflight) release(messageId uint16) bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	msg, ok := in.messages[messageId]
+	if !ok || msg.packet.Qos != 2 {
+		return false
+	}
+	msg.released = true
+	msg.sentAt = time.Now()
+	return true
+}
+
+//找出所有发送时间早于deadline的消息，并刷新其发送时间，返回的是消息当前状态的副本
+func (in *inflight) expired(deadline time.Time) []inflightMessage {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	var expired []inflightMessage
+	now := time.Now()
+	for _, id := range in.order {
+		msg := in.messages[id]
+		if msg.sentAt.Before(deadline) {
+			msg.sentAt = now
+			expired = append(expired, *msg)
+		}
+	}
+	return expired
+}
+
+func (in *inflight) len() int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return len(in.messages)
+}
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"errors"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/config"
+	"github.com/davidfantasy/embedded-mqtt-broker/logger"
+	"github.com/davidfantasy/embedded-mqtt-broker/packets"
+)
+
+//离线消息队列已满且溢出策略为拒绝时返回该错误
+var ErrQueueFull = errors.New("offline message queue is full")
+
+//会话离线期间待投递的消息
+type queuedMessage struct {
+	packet *packets.PublishPacket
+	qos    byte
+	retain bool
+}
+
+func (msg *queuedMessage) size() int {
+	return len(msg.packet.TopicName) + len(msg.packet.Payload)
+}
+
+//会话的消息队列，保存持久会话离线期间的消息以及超出飞行窗口的消息，需要在session.queueMu的保护下使用
+type messageQueue struct {
+	messages []*queuedMessage
+	bytes    int
+	//队列的最大消息数量，0表示不限制
+	maxLen int
+	//队列中消息的最大总字节数，0表示不限制
+	maxBytes int
+	policy   config.OverflowPolicy
+}
+
+func newMessageQueue(serverConfig *config.ServerConfig) *messageQueue {
+	return &messageQueue{maxLen: serverConfig.MaxQueuedMessages, maxBytes: serverConfig.MaxQueuedBytes, policy: serverConfig.QueueOverflowPolicy}
+}
+
+func (q *messageQueue) isFull(incoming int) bool {
+	if q.maxLen > 0 && len(q.messages)+1 > q.maxLen {
+		return true
+	}
+	return q.maxBytes > 0 && q.bytes+incoming > q.maxBytes
+}
+
+//将消息加入队列，队列已满时按照溢出策略处理
+func (q *messageQueue) push(packet *packets.PublishPacket, qos byte, retain bool) error {
+	msg := &queuedMessage{packet: packet, qos: qos, retain: retain}
+	size := msg.size()
+	if q.maxBytes > 0 && size > q.maxBytes {
+		//单条消息就超过了队列的容量限制，任何策略下都无法入队
+		if q.policy == config.RejectNew {
+			return ErrQueueFull
+		}
+		logger.WARN.Printf("消息大小超过了离线队列的容量，该条消息将被丢弃：%s", packet.TopicName)
+		return nil
+	}
+	for q.isFull(size) {
+		switch q.policy {
+		case config.DropOldest:
+			dropped := q.messages[0]
+			q.messages = q.messages[1:]
+			q.bytes -= dropped.size()
+			logger.WARN.Printf("离线消息队列已满，最早的消息将被丢弃：%s", dropped.packet.TopicName)
+		case config.DropNewest:
+			logger.WARN.Printf("离线消息队列已满，该条消息将被丢弃：%s", packet.TopicName)
+			return nil
+		default:
+			return ErrQueueFull
+		}
+	}
+	q.messages = append(q.messages, msg)
+	q.bytes += size
+	return nil
+}
+
+//取出队列中最早的消息，队列为空时返回nil
+func (q *messageQueue) pop() *queuedMessage {
+	if len(q.messages) == 0 {
+		return nil
+	}
+	msg := q.messages[0]
+	q.messages = q.messages[1:]
+	q.bytes -= msg.size()
+	return msg
+}
+
+//取出队列中的所有消息
+func (q *messageQueue) drain() []*queuedMessage {
+	messages := q.messages
+	q.messages = nil
+	q.bytes = 0
+	return messages
+}
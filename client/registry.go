@@ -0,0 +1,64 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/config"
+	"github.com/davidfantasy/embedded-mqtt-broker/event"
+)
+
+//保存一个服务端实例的所有在线客户端和会话，不同的服务端实例之间互不影响
+type Registry struct {
+	config    *config.ServerConfig
+	eventBus  event.EventBus
+	clientMap sync.Map
+	//保证同一个clientId的注册和注销操作不会交错执行
+	clientMapMu      sync.Mutex
+	clientSessionMap map[string]*Session
+	sessionMap       map[string]*Session
+	sessionMu        sync.Mutex
+	//关闭后停止过期会话的定时清理
+	sweeperStop chan struct{}
+	sweeperOnce sync.Once
+}
+
+func NewRegistry(serverConfig *config.ServerConfig, eventBus event.EventBus) *Registry {
+	return &Registry{
+		config:           serverConfig,
+		eventBus:         eventBus,
+		clientSessionMap: make(map[string]*Session),
+		sessionMap:       make(map[string]*Session),
+		sweeperStop:      make(chan struct{}),
+	}
+}
+
+//启动过期会话的定时清理，调用StopSessionSweeper后退出
+func (r *Registry) StartSessionSweeper() {
+	go func() {
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.clearSessions()
+			case <-r.sweeperStop:
+				return
+			}
+		}
+	}()
+}
+
+//发布在持有锁期间收集的事件。同步模式或阻塞的溢出策略下，事件处理器会在发布方的协程中执行，
+//并可能访问注册表或订阅关系，因此不能在持有sessionMu、clientMapMu等锁时发布事件
+func (r *Registry) publishEvents(events []event.Event) {
+	for _, e := range events {
+		r.eventBus.Publish(e)
+	}
+}
+
+func (r *Registry) StopSessionSweeper() {
+	r.sweeperOnce.Do(func() {
+		close(r.sweeperStop)
+	})
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"sort"
 	"sync"
 	"time"
 
@@ -14,58 +15,56 @@ type Session struct {
 	ClientId string
 	ttl      time.Duration
 	expireAt int64
+	//等待客户端确认的qos>0的消息
+	inflight *inflight
+	//已收到但还未被PUBREL释放的qos为2的消息id，用于对重复的消息去重
+	receivedQos2   map[uint16]struct{}
+	receivedQos2Mu sync.Mutex
+	//持久会话离线期间缓存的消息
+	queue   *messageQueue
+	queueMu sync.Mutex
 }
 
-var clientSessionMap map[string]*Session = make(map[string]*Session)
-
-var sessionMap map[string]*Session = make(map[string]*Session)
-
 var snowflakeNode *snowflake.Node
 
-var sessionMu sync.Mutex
-
 func init() {
 	var err error
 	snowflakeNode, err = snowflake.NewNode(1)
 	if err != nil {
 		panic(err)
 	}
-	go doSessionClearInterval()
 }
 
-func doSessionClearInterval() {
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
-	for range ticker.C {
-		clearSessions()
-	}
-}
-
-func createSession(clientId string, ttl time.Duration, resumeSession bool) (string, bool) {
-	sessionMu.Lock()
-	defer sessionMu.Unlock()
-	session, ok := clientSessionMap[clientId]
+//创建或恢复会话，同时返回需要在释放锁之后发布的事件
+func (r *Registry) createSession(clientId string, ttl time.Duration, resumeSession bool) (*Session, bool, []event.Event) {
+	r.sessionMu.Lock()
+	defer r.sessionMu.Unlock()
+	var events []event.Event
+	session, ok := r.clientSessionMap[clientId]
 	if ok {
 		if !resumeSession {
-			doClearSession(session)
+			events = append(events, r.doClearSession(session))
 		} else {
 			//复用session
 			session.ttl = ttl
 			session.expireAt = -1
-			return session.Id, true
+			events = append(events, event.NewEvent(&event.SessionResumed{ClientId: clientId, SessionId: session.Id}))
+			return session, true, events
 		}
 	}
-	session = &Session{Id: snowflakeNode.Generate().String(), ClientId: clientId, ttl: ttl, expireAt: -1}
-	clientSessionMap[clientId] = session
-	sessionMap[session.Id] = session
-	return session.Id, false
+	session = &Session{Id: snowflakeNode.Generate().String(), ClientId: clientId, ttl: ttl, expireAt: -1, inflight: newInflight(r.config.MaxInflightMessages), receivedQos2: make(map[uint16]struct{})}
+	session.queue = newMessageQueue(r.config)
+	r.clientSessionMap[clientId] = session
+	r.sessionMap[session.Id] = session
+	events = append(events, event.NewEvent(&event.SessionCreated{ClientId: clientId, SessionId: session.Id}))
+	return session, false, events
 }
 
 //session对应的连接已断开，开始计算超时时间
-func sessionInactive(clientId string, sessionId string) {
-	sessionMu.Lock()
-	defer sessionMu.Unlock()
-	session, ok := clientSessionMap[clientId]
+func (r *Registry) sessionInactive(clientId string, sessionId string) {
+	r.sessionMu.Lock()
+	defer r.sessionMu.Unlock()
+	session, ok := r.clientSessionMap[clientId]
 	if ok {
 		if session.Id == sessionId {
 			session.expireAt = time.Now().Add(session.ttl).UnixMilli()
@@ -77,54 +76,174 @@ func sessionInactive(clientId string, sessionId string) {
 	}
 }
 
-func clearSession(clientId string, sessionId string) {
-	sessionMu.Lock()
-	defer sessionMu.Unlock()
-	session, ok := clientSessionMap[clientId]
+//清除会话，返回需要在释放锁之后发布的事件
+func (r *Registry) clearSession(clientId string, sessionId string) []event.Event {
+	r.sessionMu.Lock()
+	defer r.sessionMu.Unlock()
+	session, ok := r.clientSessionMap[clientId]
 	if ok {
 		if session.Id == sessionId {
-			doClearSession(session)
-		} else {
-			logger.WARN.Printf("sessionId与clientId不匹配：%v,%v", clientId, sessionId)
+			return []event.Event{r.doClearSession(session)}
 		}
+		logger.WARN.Printf("sessionId与clientId不匹配：%v,%v", clientId, sessionId)
 	} else {
 		logger.WARN.Printf("没有找到client对应的session：%v", clientId)
 	}
+	return nil
 }
 
-func doClearSession(session *Session) {
-	delete(clientSessionMap, session.ClientId)
-	event.DefaultEventBus.Publish(event.NewEvent(event.SESSION_EXPIRIED, session))
+//需要在sessionMu的保护下调用，返回的会话过期事件需要在释放锁之后发布
+func (r *Registry) doClearSession(session *Session) event.Event {
+	delete(r.clientSessionMap, session.ClientId)
+	delete(r.sessionMap, session.Id)
 	logger.DEBUG.Printf("session已过期清除：%v,%v", session.ClientId, session.Id)
+	return event.NewEvent(&event.SessionExpired{ClientId: session.ClientId, SessionId: session.Id})
 }
 
-func clearSessions() {
-	sessionMu.Lock()
-	defer sessionMu.Unlock()
-	for _, session := range clientSessionMap {
+func (r *Registry) clearSessions() {
+	var events []event.Event
+	r.sessionMu.Lock()
+	for _, session := range r.clientSessionMap {
 		if session.expireAt == -1 {
 			continue
 		}
 		if time.Now().UnixMilli() > session.expireAt {
-			delete(clientSessionMap, session.ClientId)
-			event.DefaultEventBus.Publish(event.NewEvent(event.SESSION_EXPIRIED, session))
-			logger.DEBUG.Printf("session已过期清除：%v,%v", session.ClientId, session.Id)
+			events = append(events, r.doClearSession(session))
 		}
 	}
+	r.sessionMu.Unlock()
+	r.publishEvents(events)
+}
+
+//记录收到的qos为2的消息id，如果该id已经存在（即重复的消息）则返回false
+func (session *Session) markQos2Received(messageId uint16) bool {
+	session.receivedQos2Mu.Lock()
+	defer session.receivedQos2Mu.Unlock()
+	if _, ok := session.receivedQos2[messageId]; ok {
+		return false
+	}
+	session.receivedQos2[messageId] = struct{}{}
+	return true
 }
 
-func findSessions(sessionIds []string) []*Session {
-	sessionMu.Lock()
-	defer sessionMu.Unlock()
+func (session *Session) releaseQos2(messageId uint16) {
+	session.receivedQos2Mu.Lock()
+	defer session.receivedQos2Mu.Unlock()
+	delete(session.receivedQos2, messageId)
+}
+
+func (r *Registry) findSessions(sessionIds []string) []*Session {
+	r.sessionMu.Lock()
+	defer r.sessionMu.Unlock()
 	if len(sessionIds) == 0 {
 		return nil
 	}
 	sessions := make([]*Session, 0)
 	for _, id := range sessionIds {
-		session, ok := sessionMap[id]
+		session, ok := r.sessionMap[id]
 		if ok {
 			sessions = append(sessions, session)
 		}
 	}
 	return sessions
 }
+
+//当前的会话数量，包含离线但尚未过期的持久会话
+func (r *Registry) CountSessions() int {
+	r.sessionMu.Lock()
+	defer r.sessionMu.Unlock()
+	return len(r.sessionMap)
+}
+
+//会话状态的快照，用于管理接口查询
+type SessionInfo struct {
+	Id       string `json:"id"`
+	ClientId string `json:"clientId"`
+	//客户端是否在线
+	Online bool `json:"online"`
+	//离线会话的过期时间，在线时为零值
+	ExpireAt time.Time `json:"expireAt"`
+	//等待客户端确认的消息数量
+	Inflight int `json:"inflight"`
+	//离线期间缓存的消息数量
+	Queued int `json:"queued"`
+}
+
+//需要在sessionMu的保护下调用，Queued需要在释放sessionMu之后通过queued获取
+func (session *Session) info() SessionInfo {
+	info := SessionInfo{Id: session.Id, ClientId: session.ClientId, Online: session.expireAt == -1, Inflight: session.inflight.len()}
+	if !info.Online {
+		info.ExpireAt = time.UnixMilli(session.expireAt)
+	}
+	return info
+}
+
+//消息队列中的消息数量。投递消息时会在持有queueMu的情况下查找会话，所以不能在持有sessionMu时调用
+func (session *Session) queued() int {
+	session.queueMu.Lock()
+	defer session.queueMu.Unlock()
+	return len(session.queue.messages)
+}
+
+//所有会话的快照，包含离线但尚未过期的持久会话，按clientId排序
+func (r *Registry) Sessions() []SessionInfo {
+	r.sessionMu.Lock()
+	sessions := make([]SessionInfo, 0, len(r.clientSessionMap))
+	found := make([]*Session, 0, len(r.clientSessionMap))
+	for _, session := range r.clientSessionMap {
+		sessions = append(sessions, session.info())
+		found = append(found, session)
+	}
+	r.sessionMu.Unlock()
+	for i, session := range found {
+		sessions[i].Queued = session.queued()
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ClientId < sessions[j].ClientId
+	})
+	return sessions
+}
+
+//根据clientId查找会话
+func (r *Registry) FindSession(clientId string) (SessionInfo, bool) {
+	r.sessionMu.Lock()
+	session, ok := r.clientSessionMap[clientId]
+	if !ok {
+		r.sessionMu.Unlock()
+		return SessionInfo{}, false
+	}
+	info := session.info()
+	r.sessionMu.Unlock()
+	info.Queued = session.queued()
+	return info, true
+}
+
+//立即清除clientId对应的会话，客户端在线时会先以指定的原因码断开连接，会话不存在时返回false
+func (r *Registry) ExpireSession(clientId string, reasonCode byte) bool {
+	r.sessionMu.Lock()
+	session, ok := r.clientSessionMap[clientId]
+	r.sessionMu.Unlock()
+	if !ok {
+		return false
+	}
+	if c := r.FindClient(clientId); c != nil {
+		c.Disconnect(reasonCode)
+	}
+	r.sessionMu.Lock()
+	current, ok := r.clientSessionMap[clientId]
+	//clean session的客户端断开时已经清除了会话
+	if !ok || current != session {
+		r.sessionMu.Unlock()
+		return true
+	}
+	//断开后同一个clientId又重新连接并恢复了会话，此时不能清除正在使用的会话
+	if session.expireAt == -1 {
+		r.sessionMu.Unlock()
+		logger.WARN.Printf("会话正在被使用，无法清除：%v,%v", clientId, session.Id)
+		return false
+	}
+	e := r.doClearSession(session)
+	r.sessionMu.Unlock()
+	r.publishEvents([]event.Event{e})
+	return true
+}
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	mqtt "github.com/davidfantasy/embedded-mqtt-broker"
 	"github.com/davidfantasy/embedded-mqtt-broker/config"
+	"github.com/davidfantasy/embedded-mqtt-broker/logger"
 	"github.com/davidfantasy/embedded-mqtt-broker/security"
 )
 
@@ -12,12 +20,49 @@ type CustomAuthManager struct {
 }
 
 func main() {
+	adminAddr := flag.String("admin", "", "管理接口的监听地址，例如:8080，为空时不启动管理接口")
+	adminToken := flag.String("admin-token", os.Getenv("MQTT_ADMIN_TOKEN"), "访问管理接口需要的token，默认读取环境变量MQTT_ADMIN_TOKEN")
+	flag.Parse()
 	config := config.NewDefaultConfig()
 	config.SessionExpiryInterval = time.Second * 10
 	broker := mqtt.NewMqttServer(config)
 	//添加权限管理器
 	broker.SetAuthProvider(&CustomAuthManager{})
-	broker.Startup()
+	//启动管理接口
+	var adminServer *http.Server
+	if len(*adminAddr) > 0 {
+		if len(*adminToken) == 0 {
+			logger.WARN.Println("管理接口没有设置token，只应在可信的网络中开放")
+		}
+		adminServer = &http.Server{Addr: *adminAddr, Handler: broker.AdminHandler(*adminToken)}
+		go func() {
+			if err := adminServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.ERROR.Println("admin server stopped:", err)
+			}
+		}()
+	}
+	//收到退出信号后优雅地关闭服务
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if adminServer != nil {
+			adminServer.Shutdown(ctx)
+		}
+		if err := broker.Shutdown(ctx); err != nil {
+			logger.WARN.Println("mqtt server shutdown:", err)
+		}
+	}()
+	if err := broker.ListenAndServe(); err != nil && !errors.Is(err, mqtt.ErrServerClosed) {
+		logger.ERROR.Println("mqtt server stopped:", err)
+		os.Exit(1)
+	}
+	//监听关闭后还需要等待在途的消息处理完成
+	<-shutdownDone
 }
 
 func (manager *CustomAuthManager) Authenticate(username, password string) *security.Authentication {
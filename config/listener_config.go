@@ -0,0 +1,77 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/security"
+)
+
+//监听的类型
+type ListenerType string
+
+const (
+	ListenerTCP       ListenerType = "tcp"
+	ListenerTLS       ListenerType = "tls"
+	ListenerWebSocket ListenerType = "ws"
+	ListenerUnix      ListenerType = "unix"
+)
+
+//单个监听的配置
+type ListenerConfig struct {
+	//监听的名称，会记录在通过该监听接入的客户端上
+	Name string
+	Type ListenerType
+	//监听地址，tcp、tls和ws为host:port的格式，unix为socket文件的路径
+	Address string
+	//websocket服务的请求路径，仅对ws类型的监听有效
+	Path string
+	//tls类型监听的证书配置，ws类型的监听设置后使用wss，其中的Address和Port不会生效
+	TLS *TLSConfig
+	//该监听使用的权限认证器，为nil时使用MqttServer.SetAuthProvider设置的认证器
+	AuthProvider security.AuthenticationProvider
+	//允许客户端不经认证接入，接入后拥有所有topic的订阅和发布权限
+	Anonymous bool
+	//该监听同时接入的最大连接数，0表示不限制
+	MaxConnections int
+	//允许接入的mqtt协议版本（3、4、5），为空表示不限制
+	ProtocolVersions []byte
+}
+
+//获取所有需要启动的监听，没有配置Listeners时根据Port、TLS和WebSocket生成
+func (c *ServerConfig) ListenerConfigs() []*ListenerConfig {
+	if len(c.Listeners) != 0 {
+		return c.Listeners
+	}
+	var listeners []*ListenerConfig
+	if c.Port > 0 {
+		listeners = append(listeners, &ListenerConfig{Name: "tcp", Type: ListenerTCP, Address: fmt.Sprintf("%s:%v", c.Address, c.Port)})
+	}
+	if c.TLS != nil {
+		address := c.TLS.Address
+		if len(address) == 0 {
+			address = c.Address
+		}
+		listeners = append(listeners, &ListenerConfig{Name: "tls", Type: ListenerTLS, Address: fmt.Sprintf("%s:%v", address, c.TLS.Port), TLS: c.TLS})
+	}
+	if c.WebSocket != nil {
+		address := c.WebSocket.Address
+		if len(address) == 0 {
+			address = c.Address
+		}
+		listeners = append(listeners, &ListenerConfig{Name: "ws", Type: ListenerWebSocket, Address: fmt.Sprintf("%s:%v", address, c.WebSocket.Port), Path: c.WebSocket.Path, TLS: c.WebSocket.TLS})
+	}
+	return listeners
+}
+
+//判断该监听是否允许某个协议版本的客户端接入
+func (c *ListenerConfig) AllowProtocolVersion(version byte) bool {
+	if len(c.ProtocolVersions) == 0 {
+		return true
+	}
+	for _, v := range c.ProtocolVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
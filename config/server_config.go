@@ -1,20 +1,97 @@
 package config
 
-import "time"
+import (
+	"time"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/event"
+)
+
+//离线消息队列满了之后的处理策略
+type OverflowPolicy int
+
+const (
+	//丢弃队列中最早的消息
+	DropOldest OverflowPolicy = iota
+	//丢弃新到达的消息
+	DropNewest
+	//拒绝新到达的消息并向发布方返回错误
+	RejectNew
+)
+
+//共享订阅的负载均衡策略
+type SharedSubscriptionStrategy int
+
+const (
+	//轮询组内的成员
+	SharedRoundRobin SharedSubscriptionStrategy = iota
+	//随机选择组内的成员
+	SharedRandom
+	//同一个发布者的消息总是投递给同一个成员
+	SharedSticky
+	//按照topic的哈希值选择成员，同一个topic的消息总是投递给同一个成员
+	SharedTopicHash
+)
 
 type ServerConfig struct {
 	Address               string
 	Port                  int
 	SessionExpiryInterval time.Duration
+	InflightRetryInterval time.Duration
+	MaxInflightMessages   int
+	WriteTimeout          time.Duration
+	MaxQueuedMessages     int
+	MaxQueuedBytes        int
+	QueueOverflowPolicy   OverflowPolicy
+	//共享订阅的负载均衡策略
+	SharedSubscriptionStrategy SharedSubscriptionStrategy
+	//发布$SYS统计信息的时间间隔，0表示不发布
+	SysInterval time.Duration
+	//TLS监听的配置，为nil时不启动TLS监听
+	TLS *TLSConfig
+	//mqtt over websocket监听的配置，为nil时不启动websocket监听
+	WebSocket *WebSocketConfig
+	//所有监听的配置，不为空时Address、Port、TLS和WebSocket不再生效
+	Listeners []*ListenerConfig
+	//服务关闭时是否向mqtt 5.0的客户端发送原因码为0x8B的DISCONNECT
+	DisconnectOnShutdown bool
+	//服务端事件总线的配置
+	EventBus event.Options
 }
 
 func NewDefaultConfig() *ServerConfig {
 	return &ServerConfig{
 		//服务监听地址
 		Address: "0.0.0.0",
-		//服务监听端口
+		//服务监听端口，0表示不启动明文的mqtt监听
 		Port: 1883,
 		//默认的会话超时时间，客户端断联超过该时间后，其订阅信息及其它与会话绑定的消息都将被清除
 		SessionExpiryInterval: time.Hour * 2,
+		//qos>0的消息在该时间内没有收到客户端确认，将设置DUP标志后重发；mqtt 5.0的客户端只在恢复会话时重发
+		InflightRetryInterval: time.Second * 20,
+		//每个会话最多同时等待客户端确认的qos>0的消息数量，超出的消息进入会话的消息队列（受MaxQueuedMessages等配置的限制），
+		//收到确认后再按顺序投递；0表示只受messageId取值范围（65535）的限制。mqtt 5.0的客户端指定的Receive Maximum更小时以其为准
+		MaxInflightMessages: 1000,
+		//向客户端写入数据的超时时间，超时说明客户端接收过慢或者网络已经中断，连接会被断开；0表示不限制
+		WriteTimeout: time.Second * 10,
+		//持久会话离线期间，每个会话最多缓存的qos>0的消息数量，0表示不限制
+		MaxQueuedMessages: 1000,
+		//持久会话离线期间，每个会话缓存的消息的最大总字节数，0表示不限制
+		MaxQueuedBytes: 0,
+		//离线消息队列满了之后的处理策略
+		QueueOverflowPolicy: DropOldest,
+		//共享订阅的负载均衡策略
+		SharedSubscriptionStrategy: SharedRoundRobin,
+		//发布$SYS统计信息的时间间隔，0表示不发布
+		SysInterval: time.Second * 10,
+		//TLS监听的配置，为nil时不启动TLS监听，可以使用NewDefaultTLSConfig创建
+		TLS: nil,
+		//mqtt over websocket监听的配置，为nil时不启动websocket监听，可以使用NewDefaultWebSocketConfig创建
+		WebSocket: nil,
+		//所有监听的配置，不为空时Address、Port、TLS和WebSocket不再生效
+		Listeners: nil,
+		//服务关闭时是否向mqtt 5.0的客户端发送原因码为0x8B（Server shutting down）的DISCONNECT
+		DisconnectOnShutdown: true,
+		//服务端事件总线的配置，默认每个事件处理器缓冲100个事件，缓冲区满了之后丢弃事件并记录日志
+		EventBus: event.Options{BufferSize: event.DefaultBufferSize, Overflow: event.OverflowDrop},
 	}
 }
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+//从客户端证书中获取身份信息的方式
+type CertIdentitySource int
+
+const (
+	//不使用客户端证书中的身份信息
+	CertIdentityNone CertIdentitySource = iota
+	//使用证书Subject中的CommonName
+	CertIdentityCN
+	//使用证书的SubjectAltName，依次取第一个DNS名称、URI和邮箱地址
+	CertIdentitySAN
+	//使用证书Subject中的第一个OrganizationalUnit
+	CertIdentityOU
+)
+
+//TLS监听的配置，证书可以通过文件路径指定，也可以直接提供内存中的tls.Config
+type TLSConfig struct {
+	//TLS服务监听地址，为空时使用ServerConfig.Address
+	Address string
+	//TLS服务监听端口
+	Port int
+	//服务端证书和私钥的文件路径，文件更新后会自动重新加载，无需重启服务
+	CertFile string
+	KeyFile  string
+	//检查证书文件是否更新的最小时间间隔
+	CertReloadInterval time.Duration
+	//内存中的TLS配置，不为空时作为基础配置，其它字段的值会覆盖其中对应的配置
+	Config *tls.Config
+	//允许的最低TLS版本，如tls.VersionTLS12
+	MinVersion uint16
+	//允许使用的加密套件，为空时使用go的默认配置
+	CipherSuites []uint16
+	//用于校验客户端证书的CA证书文件路径（PEM格式，可以包含多个证书）
+	ClientCAFile string
+	//对客户端证书的要求，配置了ClientCAFile且该值为tls.NoClientCert时使用tls.RequireAndVerifyClientCert
+	ClientAuth tls.ClientAuthType
+	//不为CertIdentityNone时，使用已校验的客户端证书中的身份信息作为客户端的用户名和clientId，没有提供证书的客户端将被拒绝连接
+	CertIdentity CertIdentitySource
+}
+
+func NewDefaultTLSConfig() *TLSConfig {
+	return &TLSConfig{
+		//TLS服务监听端口
+		Port: 8883,
+		//检查证书文件是否更新的最小时间间隔
+		CertReloadInterval: time.Second * 10,
+		//允许的最低TLS版本
+		MinVersion: tls.VersionTLS12,
+	}
+}
@@ -0,0 +1,22 @@
+package config
+
+//mqtt over websocket监听的配置
+type WebSocketConfig struct {
+	//websocket服务监听地址，为空时使用ServerConfig.Address
+	Address string
+	//websocket服务监听端口
+	Port int
+	//websocket服务的请求路径
+	Path string
+	//不为nil时使用wss，证书的配置方式与TLS监听相同，其中的Address和Port不会生效
+	TLS *TLSConfig
+}
+
+func NewDefaultWebSocketConfig() *WebSocketConfig {
+	return &WebSocketConfig{
+		//websocket服务监听端口
+		Port: 8083,
+		//websocket服务的请求路径
+		Path: "/mqtt",
+	}
+}
@@ -1,3 +1,15 @@
 package consts
 
 const TOPIC_PART_SPLITTER = "/"
+
+//共享订阅的topic前缀，格式为$share/{group}/{filter}
+const SHARED_SUBSCRIPTION_PREFIX = "$share"
+
+//服务端的版本号，会发布在$SYS/broker/version中
+const BROKER_VERSION = "embedded-mqtt-broker 1.0.0"
+
+//服务端内部使用的topic，客户端不能向其发布消息
+const SYS_TOPIC_ROOT = "$SYS"
+
+//服务端统计信息的topic前缀
+const SYS_TOPIC_PREFIX = SYS_TOPIC_ROOT + "/broker/"
@@ -1,48 +1,110 @@
 package event
 
 import (
-	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/davidfantasy/embedded-mqtt-broker/logger"
 )
 
-var DefaultEventBus = AsyncEventBus{
-	handlerMap: make(map[EventType][]eventHandlerWapper),
-}
-
 type Event struct {
 	EventType EventType
 	Ts        int64
-	Data      interface{}
+	Data      Payload
 }
 
 type EventType int
 type EventHandler func(event Event)
 
+//事件携带的数据，每种事件类型对应event_types.go中的一个结构体
+type Payload interface {
+	EventType() EventType
+}
+
 type EventBus interface {
 	Publish(event Event)
-	Subscribe(eventType EventType, handler EventHandler)
+	//订阅指定类型的事件，通过返回的Subscription取消订阅
+	Subscribe(eventType EventType, handler EventHandler) *Subscription
+}
+
+func NewEvent(data Payload) Event {
+	return Event{EventType: data.EventType(), Data: data, Ts: time.Now().UnixMilli()}
 }
 
-func NewEvent(eventType EventType, data any) Event {
-	return Event{EventType: eventType, Data: data, Ts: time.Now().UnixMilli()}
+//订阅T对应类型的事件，handler直接收到类型化的事件数据，例如：
+//
+//	event.On(bus, func(e *event.ClientConnected) {})
+func On[T Payload](bus EventBus, handler func(T)) *Subscription {
+	var zero T
+	return bus.Subscribe(zero.EventType(), func(e Event) {
+		if data, ok := e.Data.(T); ok {
+			handler(data)
+		}
+	})
 }
 
-type eventHandlerWapper struct {
+//事件处理器的缓冲区满了之后的处理策略
+type OverflowPolicy int
+
+const (
+	//丢弃事件、计数并记录警告日志
+	OverflowDrop OverflowPolicy = iota
+	//丢弃事件并计数，不记录日志
+	OverflowDropAndCount
+	//阻塞发布方直到缓冲区有空位，事件不会丢失，但处理缓慢的处理器会拖慢broker
+	OverflowBlock
+)
+
+//默认的事件处理器缓冲区大小
+const DefaultBufferSize = 100
+
+type Options struct {
+	//每个事件处理器的缓冲区大小，小于等于0时使用DefaultBufferSize
+	BufferSize int
+	//缓冲区满了之后的处理策略
+	Overflow OverflowPolicy
+	//同步模式下事件在发布方的协程中直接调用处理函数，不使用缓冲区，主要用于测试
+	Sync bool
+}
+
+//事件订阅的句柄
+type Subscription struct {
+	once        sync.Once
+	unsubscribe func()
+}
+
+//取消订阅，可以重复调用；异步模式下已经进入缓冲区的事件仍然会被处理
+func (sub *Subscription) Unsubscribe() {
+	if sub.unsubscribe != nil {
+		sub.once.Do(sub.unsubscribe)
+	}
+}
+
+type subscriber struct {
 	handler EventHandler
 	ch      chan Event
+	//关闭后处理协程在处理完缓冲区中的事件后退出
+	done chan struct{}
 }
 
-func wrapHandler(handler EventHandler) eventHandlerWapper {
-	wrapped := eventHandlerWapper{handler: handler, ch: make(chan Event, 100)}
-	go func() {
-		for event := range wrapped.ch {
-			callHandler(event, wrapped.handler)
+func (s *subscriber) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		select {
+		case event := <-s.ch:
+			callHandler(event, s.handler)
+		case <-s.done:
+			for {
+				select {
+				case event := <-s.ch:
+					callHandler(event, s.handler)
+				default:
+					return
+				}
+			}
 		}
-	}()
-	return wrapped
+	}
 }
 
 func callHandler(event Event, handler EventHandler) {
@@ -55,46 +117,124 @@ func callHandler(event Event, handler EventHandler) {
 }
 
 type AsyncEventBus struct {
-	handlerMap map[EventType][]eventHandlerWapper
+	opts Options
+	//每次订阅或取消订阅都会替换整个切片，发布事件时可以在锁外遍历
+	handlerMap map[EventType][]*subscriber
+	handlerMu  sync.RWMutex
+	closed     bool
+	dropped    uint64
+	wg         sync.WaitGroup
 }
 
-var handlerMu sync.Mutex
+//使用默认配置创建一个独立的事件总线，每个服务端实例持有各自的事件总线
+func NewAsyncEventBus() *AsyncEventBus {
+	return NewEventBus(Options{})
+}
+
+//按照指定的配置创建一个独立的事件总线
+func NewEventBus(opts Options) *AsyncEventBus {
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = DefaultBufferSize
+	}
+	return &AsyncEventBus{opts: opts, handlerMap: make(map[EventType][]*subscriber)}
+}
 
 func (bus *AsyncEventBus) Publish(event Event) {
-	handlerMu.Lock()
+	bus.handlerMu.RLock()
+	if bus.closed {
+		bus.handlerMu.RUnlock()
+		return
+	}
 	handlers := bus.handlerMap[event.EventType]
-	handlerMu.Unlock()
+	bus.handlerMu.RUnlock()
 	for _, handler := range handlers {
+		if bus.opts.Sync {
+			callHandler(event, handler.handler)
+			continue
+		}
+		bus.deliver(handler, event)
+	}
+}
+
+func (bus *AsyncEventBus) deliver(handler *subscriber, event Event) {
+	if bus.opts.Overflow == OverflowBlock {
 		select {
 		case handler.ch <- event:
-		default:
+		case <-handler.done:
+		}
+		return
+	}
+	select {
+	case handler.ch <- event:
+	case <-handler.done:
+	default:
+		atomic.AddUint64(&bus.dropped, 1)
+		if bus.opts.Overflow != OverflowDropAndCount {
 			logger.WARN.Printf("事件处理器被阻塞了：%v\n", event.EventType)
 		}
 	}
 }
 
-func (bus *AsyncEventBus) Subscribe(eventType EventType, handler EventHandler) {
+//同一个处理函数订阅多次时会被调用多次，每次订阅都需要单独取消
+func (bus *AsyncEventBus) Subscribe(eventType EventType, handler EventHandler) *Subscription {
 	if handler == nil {
 		logger.WARN.Println("事件处理函数为nil")
-		return
+		return &Subscription{}
+	}
+	bus.handlerMu.Lock()
+	defer bus.handlerMu.Unlock()
+	if bus.closed {
+		logger.WARN.Println("事件总线已关闭，订阅将被忽略")
+		return &Subscription{}
 	}
-	handlerMu.Lock()
-	defer handlerMu.Unlock()
-	wrappers := bus.handlerMap[eventType]
-	if wrappers == nil {
-		wrappers = make([]eventHandlerWapper, 0)
+	s := &subscriber{handler: handler, done: make(chan struct{})}
+	if !bus.opts.Sync {
+		s.ch = make(chan Event, bus.opts.BufferSize)
+		bus.wg.Add(1)
+		go s.run(&bus.wg)
 	}
-	hp := reflect.ValueOf(handler).Pointer()
-	existed := false
-	for _, w := range wrappers {
-		if reflect.ValueOf(w.handler).Pointer() == hp {
-			existed = true
-			break
+	handlers := bus.handlerMap[eventType]
+	newHandlers := make([]*subscriber, len(handlers), len(handlers)+1)
+	copy(newHandlers, handlers)
+	bus.handlerMap[eventType] = append(newHandlers, s)
+	return &Subscription{unsubscribe: func() { bus.unsubscribe(eventType, s) }}
+}
+
+func (bus *AsyncEventBus) unsubscribe(eventType EventType, s *subscriber) {
+	bus.handlerMu.Lock()
+	defer bus.handlerMu.Unlock()
+	handlers := bus.handlerMap[eventType]
+	for i, h := range handlers {
+		if h == s {
+			newHandlers := make([]*subscriber, 0, len(handlers)-1)
+			newHandlers = append(newHandlers, handlers[:i]...)
+			bus.handlerMap[eventType] = append(newHandlers, handlers[i+1:]...)
+			close(s.done)
+			return
 		}
 	}
-	if !existed {
-		wrapped := wrapHandler(handler)
-		wrappers = append(wrappers, wrapped)
-		bus.handlerMap[eventType] = wrappers
+}
+
+//因为缓冲区已满而丢弃的事件数量，OverflowBlock策略不会丢弃事件
+func (bus *AsyncEventBus) Dropped() uint64 {
+	return atomic.LoadUint64(&bus.dropped)
+}
+
+//关闭事件总线，之后发布的事件都会被忽略；会等待所有处理协程处理完缓冲区中的事件后返回，
+//因此不能在事件处理函数中调用
+func (bus *AsyncEventBus) Close() {
+	bus.handlerMu.Lock()
+	if bus.closed {
+		bus.handlerMu.Unlock()
+		return
+	}
+	bus.closed = true
+	for _, handlers := range bus.handlerMap {
+		for _, s := range handlers {
+			close(s.done)
+		}
 	}
+	bus.handlerMap = make(map[EventType][]*subscriber)
+	bus.handlerMu.Unlock()
+	bus.wg.Wait()
 }
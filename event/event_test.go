@@ -3,12 +3,20 @@ package event
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
+//测试用的事件数据，事件类型由字段指定
+type testPayload struct {
+	eventType EventType
+}
+
+func (p *testPayload) EventType() EventType { return p.eventType }
+
 func TestEventBusBase(t *testing.T) {
 	const test_event = -1
 	val := 0
@@ -18,13 +26,18 @@ func TestEventBusBase(t *testing.T) {
 	handler2 := func(event Event) {
 		val += 100
 	}
-	DefaultEventBus.Subscribe(test_event, handler1)
-	DefaultEventBus.Subscribe(test_event, handler2)
-	DefaultEventBus.Subscribe(test_event, handler1)
-	event := NewEvent(test_event, 50)
-	DefaultEventBus.Publish(event)
-	time.Sleep(time.Millisecond * 100)
-	assert.Equal(t, 150, val)
+	bus := NewEventBus(Options{Sync: true})
+	bus.Subscribe(test_event, handler1)
+	bus.Subscribe(test_event, handler2)
+	//同一个处理函数订阅多次时会被调用多次
+	sub := bus.Subscribe(test_event, handler1)
+	event := NewEvent(&testPayload{eventType: test_event})
+	bus.Publish(event)
+	assert.Equal(t, 200, val)
+	sub.Unsubscribe()
+	sub.Unsubscribe()
+	bus.Publish(event)
+	assert.Equal(t, 350, val)
 }
 
 func TestEventBus2(t *testing.T) {
@@ -38,10 +51,131 @@ func TestEventBus2(t *testing.T) {
 	handler2 := func(event Event) {
 		wg.Done()
 	}
-	DefaultEventBus.Subscribe(testEvent1, handler1)
-	DefaultEventBus.Subscribe(testEvent2, handler2)
-	DefaultEventBus.Publish(NewEvent(testEvent1, ""))
-	DefaultEventBus.Publish(NewEvent(testEvent2, ""))
+	bus := NewAsyncEventBus()
+	bus.Subscribe(testEvent1, handler1)
+	bus.Subscribe(testEvent2, handler2)
+	bus.Publish(NewEvent(&testPayload{eventType: testEvent1}))
+	bus.Publish(NewEvent(&testPayload{eventType: testEvent2}))
 	wg.Wait()
 	fmt.Println("test is passed!")
 }
+
+func TestTypedEvent(t *testing.T) {
+	bus := NewAsyncEventBus()
+	received := make(chan *ClientConnected, 1)
+	On(bus, func(e *ClientConnected) {
+		received <- e
+	})
+	bus.Publish(NewEvent(&ClientConnected{ClientId: "c1", Listener: "tcp"}))
+	//其它类型的事件不会触发处理函数
+	bus.Publish(NewEvent(&ClientDisconnected{ClientId: "c1"}))
+	select {
+	case e := <-received:
+		assert.Equal(t, "c1", e.ClientId)
+		assert.Equal(t, "tcp", e.Listener)
+	case <-time.After(time.Second):
+		t.Fatal("typed handler was not called")
+	}
+	assert.Len(t, received, 0)
+}
+
+func TestEventBusUnsubscribe(t *testing.T) {
+	bus := NewAsyncEventBus()
+	defer bus.Close()
+	received := make(chan *ClientConnected, 10)
+	sub := On(bus, func(e *ClientConnected) {
+		received <- e
+	})
+	//闭包不会因为函数指针相同而被去重
+	for _, id := range []string{"c1", "c2"} {
+		id := id
+		On(bus, func(e *ClientConnected) {
+			received <- &ClientConnected{ClientId: id + e.ClientId}
+		})
+	}
+	bus.Publish(NewEvent(&ClientConnected{ClientId: "x"}))
+	ids := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		select {
+		case e := <-received:
+			ids[e.ClientId] = true
+		case <-time.After(time.Second):
+			t.Fatal("handler was not called")
+		}
+	}
+	assert.Equal(t, map[string]bool{"x": true, "c1x": true, "c2x": true}, ids)
+	sub.Unsubscribe()
+	bus.Publish(NewEvent(&ClientConnected{ClientId: "y"}))
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-received:
+			assert.NotEqual(t, "y", e.ClientId)
+		case <-time.After(time.Second):
+			t.Fatal("handler was not called")
+		}
+	}
+	time.Sleep(time.Millisecond * 50)
+	assert.Len(t, received, 0)
+}
+
+func TestEventBusOverflow(t *testing.T) {
+	const testEvent = 1
+	for _, policy := range []OverflowPolicy{OverflowDrop, OverflowDropAndCount, OverflowBlock} {
+		bus := NewEventBus(Options{BufferSize: 1, Overflow: policy})
+		release := make(chan struct{})
+		var handled int32
+		bus.Subscribe(testEvent, func(event Event) {
+			<-release
+			atomic.AddInt32(&handled, 1)
+		})
+		published := make(chan struct{})
+		go func() {
+			//第一个事件被处理协程取走后阻塞，第二个事件进入缓冲区，第三个事件溢出
+			for i := 0; i < 3; i++ {
+				bus.Publish(NewEvent(&testPayload{eventType: testEvent}))
+				time.Sleep(time.Millisecond * 20)
+			}
+			close(published)
+		}()
+		if policy == OverflowBlock {
+			select {
+			case <-published:
+				t.Fatal("publish should block when the buffer is full")
+			case <-time.After(time.Millisecond * 200):
+			}
+		} else {
+			<-published
+		}
+		close(release)
+		<-published
+		bus.Close()
+		switch policy {
+		case OverflowDrop, OverflowDropAndCount:
+			assert.Equal(t, int32(2), atomic.LoadInt32(&handled))
+			assert.Equal(t, uint64(1), bus.Dropped())
+		case OverflowBlock:
+			assert.Equal(t, int32(3), atomic.LoadInt32(&handled))
+			assert.Equal(t, uint64(0), bus.Dropped())
+		}
+	}
+}
+
+func TestEventBusClose(t *testing.T) {
+	const testEvent = 1
+	bus := NewEventBus(Options{BufferSize: 10})
+	var handled int32
+	bus.Subscribe(testEvent, func(event Event) {
+		time.Sleep(time.Millisecond * 10)
+		atomic.AddInt32(&handled, 1)
+	})
+	for i := 0; i < 5; i++ {
+		bus.Publish(NewEvent(&testPayload{eventType: testEvent}))
+	}
+	//Close会等待缓冲区中的事件处理完成
+	bus.Close()
+	assert.Equal(t, int32(5), atomic.LoadInt32(&handled))
+	bus.Publish(NewEvent(&testPayload{eventType: testEvent}))
+	bus.Subscribe(testEvent, func(event Event) {})
+	bus.Close()
+	assert.Equal(t, int32(5), atomic.LoadInt32(&handled))
+}
@@ -2,4 +2,124 @@ package event
 
 const (
 	SESSION_EXPIRIED = iota + 1
+	//同一个clientId的新连接接管了旧连接
+	CLIENT_TAKEN_OVER
+	//客户端完成连接
+	CLIENT_CONNECTED
+	//客户端连接断开
+	CLIENT_DISCONNECTED
+	//为客户端创建了新的会话
+	SESSION_CREATED
+	//客户端恢复了之前的持久会话
+	SESSION_RESUMED
+	//客户端订阅了topic
+	SUBSCRIBED
+	//客户端取消了订阅
+	UNSUBSCRIBED
+	//客户端或进程内发布了一条消息
+	MESSAGE_PUBLISHED
+	//消息因为发送频率过高或订阅者的通道已满被丢弃
+	MESSAGE_DROPPED
+	//客户端连接时认证失败
+	AUTH_FAILED
 )
+
+//会话过期或被清除
+type SessionExpired struct {
+	ClientId  string
+	SessionId string
+}
+
+func (*SessionExpired) EventType() EventType { return SESSION_EXPIRIED }
+
+type ClientTakenOver struct {
+	ClientId string
+	//新连接的远程地址
+	RemoteAddr string
+	Listener   string
+}
+
+func (*ClientTakenOver) EventType() EventType { return CLIENT_TAKEN_OVER }
+
+type ClientConnected struct {
+	ClientId        string
+	Username        string
+	RemoteAddr      string
+	Listener        string
+	ProtocolVersion byte
+	CleanSession    bool
+	Keepalive       uint16
+}
+
+func (*ClientConnected) EventType() EventType { return CLIENT_CONNECTED }
+
+type ClientDisconnected struct {
+	ClientId   string
+	RemoteAddr string
+	Listener   string
+	//客户端发送DISCONNECT正常断开时为nil，服务端主动断开时为*client.DisconnectError，其余为连接上发生的错误
+	Reason error
+}
+
+func (*ClientDisconnected) EventType() EventType { return CLIENT_DISCONNECTED }
+
+type SessionCreated struct {
+	ClientId  string
+	SessionId string
+}
+
+func (*SessionCreated) EventType() EventType { return SESSION_CREATED }
+
+type SessionResumed struct {
+	ClientId  string
+	SessionId string
+}
+
+func (*SessionResumed) EventType() EventType { return SESSION_RESUMED }
+
+type Subscribed struct {
+	ClientId string
+	Filter   string
+	//授予的qos
+	Qos byte
+}
+
+func (*Subscribed) EventType() EventType { return SUBSCRIBED }
+
+type Unsubscribed struct {
+	ClientId string
+	Filter   string
+}
+
+func (*Unsubscribed) EventType() EventType { return UNSUBSCRIBED }
+
+type MessagePublished struct {
+	//发布者的clientId，进程内发布时为空
+	ClientId string
+	Topic    string
+	Payload  []byte
+	Qos      byte
+	Retain   bool
+}
+
+func (*MessagePublished) EventType() EventType { return MESSAGE_PUBLISHED }
+
+type MessageDropped struct {
+	//发布者的clientId，进程内发布或无法确定发布者时为空
+	ClientId string
+	Topic    string
+	Reason   string
+}
+
+func (*MessageDropped) EventType() EventType { return MESSAGE_DROPPED }
+
+type AuthFailed struct {
+	ClientId   string
+	Username   string
+	RemoteAddr string
+	Listener   string
+	//返回给客户端的CONNACK返回码
+	ReturnCode byte
+}
+
+func (*AuthFailed) EventType() EventType { return AUTH_FAILED }
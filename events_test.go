@@ -0,0 +1,172 @@
+package mqtt
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/config"
+	"github.com/davidfantasy/embedded-mqtt-broker/event"
+	"github.com/davidfantasy/embedded-mqtt-broker/packets"
+	"github.com/davidfantasy/embedded-mqtt-broker/security"
+	"github.com/stretchr/testify/assert"
+)
+
+//等待并返回下一个事件，超时后测试失败
+func waitEvent[T any](t *testing.T, ch chan T) T {
+	select {
+	case e := <-ch:
+		return e
+	case <-time.After(time.Second):
+		t.Fatalf("event %T was not published", *new(T))
+	}
+	return *new(T)
+}
+
+func TestServerEvents(t *testing.T) {
+	server := newTestServer()
+	server.SetAuthProvider(security.NewStaticUserListAuthProvider([]security.User{{UserName: "admin", Password: "psw"}}))
+	connected := make(chan *event.ClientConnected, 10)
+	disconnected := make(chan *event.ClientDisconnected, 10)
+	created := make(chan *event.SessionCreated, 10)
+	subscribed := make(chan *event.Subscribed, 10)
+	unsubscribed := make(chan *event.Unsubscribed, 10)
+	published := make(chan *event.MessagePublished, 10)
+	dropped := make(chan *event.MessageDropped, 10)
+	authFailed := make(chan *event.AuthFailed, 10)
+	bus := server.EventBus()
+	event.On(bus, func(e *event.ClientConnected) { connected <- e })
+	event.On(bus, func(e *event.ClientDisconnected) { disconnected <- e })
+	event.On(bus, func(e *event.SessionCreated) { created <- e })
+	event.On(bus, func(e *event.Subscribed) { subscribed <- e })
+	event.On(bus, func(e *event.Unsubscribed) { unsubscribed <- e })
+	event.On(bus, func(e *event.MessagePublished) { published <- e })
+	event.On(bus, func(e *event.MessageDropped) { dropped <- e })
+	event.On(bus, func(e *event.AuthFailed) { authFailed <- e })
+
+	conn, connack := connectTestListener(t, server, testListener, newTestConnectPacket("event-anonymous", true))
+	conn.Close()
+	assert.Equal(t, byte(packets.ErrRefusedBadUsernameOrPassword), connack.ReturnCode)
+	failed := waitEvent(t, authFailed)
+	assert.Equal(t, "event-anonymous", failed.ClientId)
+	assert.Equal(t, "test", failed.Listener)
+
+	cp := newTestConnectPacket("event-client", true)
+	cp.UsernameFlag = true
+	cp.Username = "admin"
+	cp.PasswordFlag = true
+	cp.Password = []byte("psw")
+	c := connectTestClientWith(t, server, cp)
+	e := waitEvent(t, connected)
+	assert.Equal(t, "event-client", e.ClientId)
+	assert.Equal(t, "admin", e.Username)
+	assert.Equal(t, "event-client", waitEvent(t, created).ClientId)
+
+	subscribeTestTopic(t, c, "event/+", 0)
+	assert.Equal(t, "event/+", waitEvent(t, subscribed).Filter)
+	go server.Publish("event/a", []byte("x"), 0, false)
+	_, ok := readTestPacket(t, c).(*packets.PublishPacket)
+	assert.True(t, ok)
+	msg := waitEvent(t, published)
+	assert.Equal(t, "event/a", msg.Topic)
+	assert.Equal(t, "", msg.ClientId)
+
+	up := packets.NewMqttPacket(packets.Unsubscribe).(*packets.UnsubscribePacket)
+	up.MessageID = 2
+	up.Topics = []string{"event/+"}
+	assert.NoError(t, up.Write(c))
+	_, ok = readTestPacket(t, c).(*packets.UnsubackPacket)
+	assert.True(t, ok)
+	assert.Equal(t, "event/+", waitEvent(t, unsubscribed).Filter)
+
+	sub, err := server.SubscribeChan("event/#", 1)
+	assert.NoError(t, err)
+	defer sub.Unsubscribe()
+	server.Publish("event/1", nil, 0, false)
+	server.Publish("event/2", nil, 0, false)
+	assert.Equal(t, "event/2", waitEvent(t, dropped).Topic)
+
+	assert.NoError(t, packets.NewMqttPacket(packets.Disconnect).Write(c))
+	gone := waitEvent(t, disconnected)
+	assert.Equal(t, "event-client", gone.ClientId)
+	assert.NoError(t, gone.Reason)
+
+	//发布遗嘱消息时同样会发布MessagePublished事件
+	cp.ClientId = "event-will"
+	cp.WillFlag = true
+	cp.WillTopic = "event/will"
+	cp.WillMessage = []byte("bye")
+	connectTestClientWith(t, server, cp).Close()
+	for msg = waitEvent(t, published); msg.Topic != "event/will"; msg = waitEvent(t, published) {
+	}
+	assert.Equal(t, "event-will", msg.ClientId)
+	assert.Equal(t, []byte("bye"), msg.Payload)
+}
+
+//同步模式下事件处理器在发布方的协程中执行，会话过期事件的处理和消息投递并发时不能出现死锁
+func TestSyncEventBusNoDeadlock(t *testing.T) {
+	conf := config.NewDefaultConfig()
+	conf.EventBus = event.Options{Sync: true}
+	server := NewMqttServer(conf)
+	worker := connectTestClient(t, server, "sync-worker", true)
+	defer worker.Close()
+	//订阅多个共享组，让每次投递在选择组成员时都需要多次查询客户端是否在线
+	for i := 0; i < 50; i++ {
+		subscribeTestTopic(t, worker, fmt.Sprintf("$share/g%d/sync/#", i), 0)
+	}
+	go func() {
+		for {
+			if _, err := packets.ReadPacket(worker); err != nil {
+				return
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		stop := make(chan struct{})
+		var publishers sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			publishers.Add(1)
+			go func() {
+				defer publishers.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+						server.Publish("sync/a", []byte("ping"), 0, false)
+					}
+				}
+			}()
+		}
+		//clean session客户端断开时会清除会话并发布SessionExpired事件
+		var flappers sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			flappers.Add(1)
+			go func(clientId string) {
+				defer flappers.Done()
+				for j := 0; j < 50; j++ {
+					serverConn, c := net.Pipe()
+					go processNewConn(serverConn, server, testListener)
+					newTestConnectPacket(clientId, true).Write(c)
+					//出现死锁时CONNACK无法返回，由外层的超时判断
+					c.SetReadDeadline(time.Now().Add(5 * time.Second))
+					packets.ReadPacket(c)
+					c.Close()
+				}
+			}(fmt.Sprintf("sync-flapper-%d", i))
+		}
+		flappers.Wait()
+		close(stop)
+		publishers.Wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("deadlock between session events and message delivery")
+	}
+}
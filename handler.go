@@ -3,26 +3,37 @@ package mqtt
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 
 	"github.com/davidfantasy/embedded-mqtt-broker/client"
+	"github.com/davidfantasy/embedded-mqtt-broker/event"
 	"github.com/davidfantasy/embedded-mqtt-broker/logger"
 	"github.com/davidfantasy/embedded-mqtt-broker/packets"
+	"github.com/davidfantasy/embedded-mqtt-broker/trie"
 )
 
 type MessageHandler struct {
 	client *client.Client
+	server *MqttServer
 	once   sync.Once
 	//用于临时存储该客户端发送的消息
 	publishMsgChan chan *packets.PublishPacket
+	//已放入publishMsgChan但还未转发完成的消息数量
+	pending int64
 }
 
-func NewMessageHandler(client *client.Client) *MessageHandler {
-	handler := &MessageHandler{client: client}
+func NewMessageHandler(client *client.Client, server *MqttServer) *MessageHandler {
+	handler := &MessageHandler{client: client, server: server}
 	handler.publishMsgChan = make(chan *packets.PublishPacket, 1000)
 	handler.doForward()
 	return handler
 }
 
+//客户端发送的消息是否都已转发，并且发给该客户端的消息都已收到确认
+func (handler *MessageHandler) drained() bool {
+	return atomic.LoadInt64(&handler.pending) == 0 && handler.client.InflightCount() == 0
+}
+
 func (handler *MessageHandler) close() {
 	handler.once.Do(func() {
 		close(handler.publishMsgChan)
@@ -33,42 +44,181 @@ func (handler *MessageHandler) close() {
 func (handler *MessageHandler) doForward() {
 	go func() {
 		for packet := range handler.publishMsgChan {
-			//TODO 性能优化
-			subscribers := GetSubscriber(packet.TopicName)
-			clients := client.FindClientsBySessionIds(subscribers)
-			for _, client := range clients {
-				if client != nil {
-					err := packet.Write(client.Conn)
-					if err != nil {
-						logger.WARN.Printf("投递消息时发生错误：clientId [%s],error: %s", client.Id, err)
-					}
-				}
-			}
+			handler.server.forwardMessage(packet, handler.client.Id, handler.client.SessionId)
+			atomic.AddInt64(&handler.pending, -1)
 		}
+		//连接断开后该客户端的消息已全部转发
+		handler.server.subscriptions.forgetPublisher(handler.client.Id)
 	}()
 }
 
+//将消息投递给所有匹配的订阅者，投递的qos取发布qos与订阅qos中较小的一个，publisher和publisherSession为发布者的
+//clientId和sessionId，进程内发布的消息为空。部分订阅者投递失败时返回第一个错误，其余订阅者仍会正常投递
+func (s *MqttServer) forwardMessage(packet *packets.PublishPacket, publisher string, publisherSession string) error {
+	if packet.Retain {
+		s.retained.RetainMessage(packet)
+	}
+	//TODO 性能优化
+	subscriptions := s.subscriptions.matchSubscriptions(packet.TopicName, publisher, s.config.SharedSubscriptionStrategy)
+	s.stats.fanout.observe(len(subscriptions))
+	var failed int
+	var firstErr error
+	for _, sub := range subscriptions {
+		//mqtt 5.0的NoLocal选项，消息不会转发给发布者自己的订阅
+		if sub.NoLocal && len(publisherSession) > 0 && sub.SessionId == publisherSession {
+			continue
+		}
+		qos := packet.Qos
+		if sub.Qos < qos {
+			qos = sub.Qos
+		}
+		//转发给已有订阅者的消息不设置retain标志，除非订阅时指定了RetainAsPublished
+		retain := sub.RetainAsPublished && packet.Retain
+		if !s.onDeliver(sub.SessionId, packet, qos, retain) {
+			continue
+		}
+		var err error
+		if ls := s.subscriptions.findLocal(sub.SessionId); ls != nil {
+			err = ls.deliver(packet, qos, retain)
+		} else {
+			err = s.clients.DeliverToSession(sub.SessionId, packet, qos, retain)
+		}
+		if err != nil {
+			logger.WARN.Printf("投递消息时发生错误：sessionId [%s],error: %s", sub.SessionId, err)
+			if failed == 0 {
+				firstErr = err
+			}
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("deliver to %d of %d subscribers failed:%w", failed, len(subscriptions), firstErr)
+	}
+	return nil
+}
+
+//连接非正常断开时，按照客户端的发布权限发布其遗嘱消息
+func (s *MqttServer) publishWill(c *client.Client) {
+	will := c.TakeWill()
+	if will == nil {
+		return
+	}
+	if isSysTopic(will.TopicName) || !c.CanPub(will.TopicName) {
+		logger.WARN.Printf("client has no permission to publish will message,clientId:%s,topic:%s", c.Id, will.TopicName)
+		return
+	}
+	//遗嘱消息同样经过钩子，钩子可以修改或丢弃遗嘱
+	will, err := s.onPublish(c, will)
+	if err != nil {
+		logger.WARN.Printf("will message modified by hook is invalid,the message will be dropped:%v", err)
+		return
+	}
+	if will == nil {
+		return
+	}
+	logger.DEBUG.Printf("publish will message of client:%s,topic:%s", c.Id, will.TopicName)
+	s.publishEvent(newMessagePublished(c.Id, will))
+	s.forwardMessage(will, c.Id, c.SessionId)
+}
+
 func (handler *MessageHandler) handlePublish(packet *packets.PublishPacket) error {
-	if !handler.client.CanPub(packet.TopicName) {
-		return nil
+	if packet.Qos > 2 {
+		return fmt.Errorf("invalid publish qos:%d", packet.Qos)
+	}
+	if packet.Properties != nil && packet.Properties.TopicAlias != nil {
+		//服务端没有在CONNACK中声明TopicAliasMaximum，客户端不应使用主题别名
+		return fmt.Errorf("topic alias is not supported")
+	}
+	if err := trie.ValidateTopicName(packet.TopicName); err != nil {
+		//非法的topic名称属于协议错误，需要断开连接
+		return fmt.Errorf("invalid publish topic %q:%v", packet.TopicName, err)
+	}
+	atomic.AddInt64(&handler.server.stats.messagesReceived, 1)
+	//qos为2的消息如果是重复发送的，只需再次回复PUBREC，不能再次转发
+	duplicated := packet.Qos == 2 && !handler.client.ReceiveQos2(packet.MessageID)
+	canPub := !isSysTopic(packet.TopicName) && handler.client.CanPub(packet.TopicName)
+	var forward *packets.PublishPacket
+	if !duplicated && canPub {
+		//钩子可以修改或丢弃消息，被丢弃的消息同样需要确认
+		var err error
+		if forward, err = handler.server.onPublish(handler.client, packet); err != nil {
+			logger.WARN.Printf("message modified by hook is invalid,the message will be dropped:%v", err)
+		}
+	}
+	if forward != nil {
+		atomic.AddInt64(&handler.pending, 1)
+		if forward.Qos == 0 {
+			select {
+			case handler.publishMsgChan <- forward:
+				handler.server.publishEvent(newMessagePublished(handler.client.Id, forward))
+			default:
+				atomic.AddInt64(&handler.pending, -1)
+				atomic.AddInt64(&handler.server.stats.messagesDropped, 1)
+				logger.WARN.Printf("数据发送频率过高，该条数据将被丢弃：%s\n", packet.String())
+				handler.server.publishEvent(&event.MessageDropped{ClientId: handler.client.Id, Topic: forward.TopicName, Reason: "publish rate too high"})
+			}
+		} else {
+			//qos>0的消息不能丢弃，队列满时阻塞读取以限制客户端的发送速度
+			handler.publishMsgChan <- forward
+			handler.server.publishEvent(newMessagePublished(handler.client.Id, forward))
+		}
+	}
+	//无发布权限的消息同样需要确认，否则客户端会不断重发
+	var reasonCode byte = packets.ReasonSuccess
+	if !canPub {
+		reasonCode = packets.ReasonNotAuthorized
 	}
-	select {
-	case handler.publishMsgChan <- packet:
-	default:
-		logger.WARN.Printf("数据发送频率过高，该条数据将被丢弃：%s\n", packet.String())
+	switch packet.Qos {
+	case 1:
+		puback := handler.client.NewPacket(packets.Puback).(*packets.PubackPacket)
+		puback.MessageID = packet.MessageID
+		puback.ReasonCode = reasonCode
+		return handler.client.WritePacket(puback)
+	case 2:
+		pubrec := handler.client.NewPacket(packets.Pubrec).(*packets.PubrecPacket)
+		pubrec.MessageID = packet.MessageID
+		pubrec.ReasonCode = reasonCode
+		return handler.client.WritePacket(pubrec)
 	}
 	return nil
 }
 
+func (handler *MessageHandler) handlePuback(packet *packets.PubackPacket) error {
+	handler.client.Acknowledge(packet.MessageID)
+	return nil
+}
+
+func (handler *MessageHandler) handlePubrec(packet *packets.PubrecPacket) error {
+	//mqtt 5.0中原因码大于等于0x80表示客户端拒绝了该消息，消息流程到此结束，不再回复PUBREL
+	if packet.ReasonCode >= packets.ReasonUnspecifiedError {
+		handler.client.Acknowledge(packet.MessageID)
+		return nil
+	}
+	return handler.client.Release(packet.MessageID)
+}
+
+func (handler *MessageHandler) handlePubrel(packet *packets.PubrelPacket) error {
+	handler.client.CompleteQos2(packet.MessageID)
+	pubcomp := handler.client.NewPacket(packets.Pubcomp).(*packets.PubcompPacket)
+	pubcomp.MessageID = packet.MessageID
+	return handler.client.WritePacket(pubcomp)
+}
+
+func (handler *MessageHandler) handlePubcomp(packet *packets.PubcompPacket) error {
+	handler.client.Acknowledge(packet.MessageID)
+	return nil
+}
+
 func (handler *MessageHandler) HandleMessage() error {
 	for {
-		packet, err := packets.ReadPacket(handler.client.Conn)
+		packet, err := packets.ReadPacketWithVersion(handler.client.Conn, handler.client.ProtocolVersion)
 		if err != nil {
 			return fmt.Errorf("read packet got error:%v", err)
 		}
 		if packet == nil {
 			return fmt.Errorf("received nil packet")
 		}
+		handler.server.stats.packetReceived(packet)
 		logger.DEBUG.Printf("received packet：%s", packet.String())
 		//任何消息都会刷新客户端的keepalive
 		handler.client.Touch()
@@ -77,6 +227,22 @@ func (handler *MessageHandler) HandleMessage() error {
 			if err := handler.handlePublish(p); err != nil {
 				return err
 			}
+		case *packets.PubackPacket:
+			if err := handler.handlePuback(p); err != nil {
+				return err
+			}
+		case *packets.PubrecPacket:
+			if err := handler.handlePubrec(p); err != nil {
+				return err
+			}
+		case *packets.PubrelPacket:
+			if err := handler.handlePubrel(p); err != nil {
+				return err
+			}
+		case *packets.PubcompPacket:
+			if err := handler.handlePubcomp(p); err != nil {
+				return err
+			}
 		case *packets.SubscribePacket:
 			if err := handler.handleSubscribe(p); err != nil {
 				return err
@@ -89,6 +255,9 @@ func (handler *MessageHandler) HandleMessage() error {
 			if err := handler.handlePing(p); err != nil {
 				return err
 			}
+		case *packets.AuthPacket:
+			//暂不支持mqtt 5.0的增强认证，连接时没有指定认证方法的客户端不应发送AUTH
+			return fmt.Errorf("unexpected auth packet:%v", p)
 		case *packets.DisconnectPacket:
 			err := handler.handleDisconnect(p)
 			return err
@@ -99,38 +268,114 @@ func (handler *MessageHandler) HandleMessage() error {
 }
 
 func (handler *MessageHandler) handleSubscribe(packet *packets.SubscribePacket) error {
-	suback := packets.NewMqttPacket(packets.Suback).(*packets.SubackPacket)
+	suback := handler.client.NewPacket(packets.Suback).(*packets.SubackPacket)
 	suback.MessageID = packet.MessageID
 	suback.ReturnCodes = make([]byte, len(packet.Topics))
+	var granted []int
+	//mqtt 5.0的订阅选项，订阅之前已经存在的topic过滤器
+	options := make([]packets.SubOptions, len(packet.Topics))
+	existed := make([]bool, len(packet.Topics))
 	for i, topic := range packet.Topics {
-		if handler.client.CanSub(topic) {
-			Subscribe(topic, handler.client.SessionId)
-			//TODO 目前仅支持qos为0的订阅
-			suback.ReturnCodes[i] = 0x00
-		} else {
+		qos := packet.Qoss[i]
+		if i < len(packet.Options) {
+			options[i] = packet.Options[i]
+		}
+		if options[i].RetainHandling > 2 {
+			return fmt.Errorf("invalid retain handling:%d", options[i].RetainHandling)
+		}
+		if group, _, _ := parseSharedSubscription(topic); len(group) > 0 && options[i].NoLocal {
+			//共享订阅设置NoLocal属于协议错误
+			return fmt.Errorf("no local is not allowed on shared subscription:%s", topic)
+		}
+		if qos > 2 {
+			suback.ReturnCodes[i] = 0x80
+		} else if _, _, err := parseSubscription(topic); err != nil {
+			//非法的topic过滤器不能进入订阅树
+			logger.WARN.Printf("invalid topic filter,clientId:%s,topic:%q,error:%s", handler.client.Id, topic, err)
+			suback.ReturnCodes[i] = 0x80
+			if handler.client.ProtocolVersion == packets.MQTT5 {
+				suback.ReturnCodes[i] = packets.ReasonTopicFilterInvalid
+			}
+		} else if !handler.client.CanSub(topic) {
 			//无订阅权限
 			suback.ReturnCodes[i] = 0x80
+			if handler.client.ProtocolVersion == packets.MQTT5 {
+				suback.ReturnCodes[i] = packets.ReasonNotAuthorized
+			}
+		} else if qos, ok := handler.server.onSubscribe(handler.client, topic, qos); ok && qos <= 2 {
+			existed[i], _ = handler.server.subscriptions.subscribeWithOptions(topic, handler.client.SessionId, qos, options[i])
+			handler.server.publishEvent(&event.Subscribed{ClientId: handler.client.Id, Filter: topic, Qos: qos})
+			suback.ReturnCodes[i] = qos
+			granted = append(granted, i)
+		} else if handler.client.ProtocolVersion == packets.MQTT5 {
+			//被钩子拒绝的订阅
+			suback.ReturnCodes[i] = packets.ReasonImplementationSpecificError
+		} else {
+			suback.ReturnCodes[i] = 0x80
+		}
+	}
+	if err := handler.client.WritePacket(suback); err != nil {
+		return err
+	}
+	//订阅成功后发送匹配的保留消息，共享订阅不发送保留消息。
+	//RetainHandling为1时只在新建订阅时发送，为2时不发送
+	for _, i := range granted {
+		if group, _, _ := parseSharedSubscription(packet.Topics[i]); len(group) > 0 {
+			continue
+		}
+		if options[i].RetainHandling == 2 || (options[i].RetainHandling == 1 && existed[i]) {
+			continue
+		}
+		if err := handler.sendRetained(packet.Topics[i], suback.ReturnCodes[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (handler *MessageHandler) sendRetained(filter string, subQos byte) error {
+	for _, msg := range handler.server.retained.GetRetainedMessages(filter) {
+		qos := msg.Qos
+		if subQos < qos {
+			qos = subQos
+		}
+		if !handler.server.onDeliver(handler.client.SessionId, msg, qos, true) {
+			continue
+		}
+		if err := handler.client.Deliver(msg, qos, true); err != nil {
+			return err
 		}
 	}
-	return suback.Write(handler.client.Conn)
+	return nil
 }
 
 func (handler *MessageHandler) handleUnSubscribe(packet *packets.UnsubscribePacket) error {
-	unsuback := packets.NewMqttPacket(packets.Unsuback).(*packets.UnsubackPacket)
+	unsuback := handler.client.NewPacket(packets.Unsuback).(*packets.UnsubackPacket)
 	unsuback.MessageID = packet.MessageID
 	for _, topic := range packet.Topics {
-		Unsubscribe(topic, handler.client.Id)
+		var reasonCode byte = packets.ReasonSuccess
+		if !handler.server.subscriptions.Unsubscribe(topic, handler.client.SessionId) {
+			reasonCode = packets.ReasonNoSubscriptionExisted
+		} else {
+			handler.server.onUnsubscribe(handler.client, topic)
+			handler.server.publishEvent(&event.Unsubscribed{ClientId: handler.client.Id, Filter: topic})
+		}
+		unsuback.ReasonCodes = append(unsuback.ReasonCodes, reasonCode)
 	}
-	return unsuback.Write(handler.client.Conn)
+	return handler.client.WritePacket(unsuback)
 }
 
 func (handler *MessageHandler) handlePing(packet *packets.PingreqPacket) error {
-	pingresp := packets.NewMqttPacket(packets.Pingresp).(*packets.PingrespPacket)
-	return pingresp.Write(handler.client.Conn)
+	pingresp := handler.client.NewPacket(packets.Pingresp).(*packets.PingrespPacket)
+	return handler.client.WritePacket(pingresp)
 }
 
 func (handler *MessageHandler) handleDisconnect(packet *packets.DisconnectPacket) error {
 	logger.INFO.Printf("received a disconnect packet,client will be disconnect:%s", handler.client.Id)
-	client.CloseClient(handler.client)
+	//正常断开连接时丢弃遗嘱消息，mqtt 5.0中客户端可以要求服务端依然发布遗嘱
+	if packet.ReasonCode != packets.ReasonDisconnectWithWill {
+		handler.client.ClearWill()
+	}
+	handler.server.clients.CloseClient(handler.client)
 	return nil
 }
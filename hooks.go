@@ -0,0 +1,169 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/client"
+	"github.com/davidfantasy/embedded-mqtt-broker/packets"
+	"github.com/davidfantasy/embedded-mqtt-broker/security"
+	"github.com/davidfantasy/embedded-mqtt-broker/trie"
+)
+
+//服务端的生命周期钩子，所有方法都在处理连接或转发消息的协程中同步调用，不应阻塞。
+//嵌入HookBase后只需要实现关心的方法
+type Hook interface {
+	//收到CONNECT报文后、用户认证之前调用，返回mqtt 3.1.1的CONNACK返回码，非Accepted时拒绝连接
+	OnConnect(conn net.Conn, cp *packets.ConnectPacket) byte
+	//用户认证之后调用，authentication为认证提供者返回的权限（没有认证提供者时为nil），返回false时以用户名或密码错误拒绝连接
+	OnConnectAuthenticate(cp *packets.ConnectPacket, authentication *security.Authentication) bool
+	//客户端连接断开后调用，客户端发送DISCONNECT正常断开时err为nil，服务端主动断开时为*client.DisconnectError
+	OnDisconnect(c *client.Client, err error)
+	//客户端订阅topic时调用，可以降低授予的qos，返回false时拒绝该订阅
+	OnSubscribe(c *client.Client, filter string, qos byte) (byte, bool)
+	//客户端取消订阅后调用
+	OnUnsubscribe(c *client.Client, filter string)
+	//客户端发布消息、发布客户端的遗嘱或进程内发布消息时调用（进程内发布时c为nil），可以修改msg，返回false时丢弃该消息。
+	//修改后的topic或qos不合法时消息同样会被丢弃，客户端的消息不能被修改到$SYS下
+	OnPublish(c *client.Client, msg *Message) bool
+	//向某个会话投递消息前调用，返回false时不向该会话投递。会话离线或者是进程内订阅者时c为nil，
+	//msg会被多个订阅者共享，不能修改
+	OnDeliver(c *client.Client, sessionId string, msg *Message) bool
+}
+
+//Hook的默认实现，所有方法都不做任何处理
+type HookBase struct{}
+
+func (HookBase) OnConnect(conn net.Conn, cp *packets.ConnectPacket) byte {
+	return packets.Accepted
+}
+
+func (HookBase) OnConnectAuthenticate(cp *packets.ConnectPacket, authentication *security.Authentication) bool {
+	return true
+}
+
+func (HookBase) OnDisconnect(c *client.Client, err error) {}
+
+func (HookBase) OnSubscribe(c *client.Client, filter string, qos byte) (byte, bool) {
+	return qos, true
+}
+
+func (HookBase) OnUnsubscribe(c *client.Client, filter string) {}
+
+func (HookBase) OnPublish(c *client.Client, msg *Message) bool {
+	return true
+}
+
+func (HookBase) OnDeliver(c *client.Client, sessionId string, msg *Message) bool {
+	return true
+}
+
+//注册一个生命周期钩子，多个钩子按照注册顺序调用，需要在服务启动前注册
+func (s *MqttServer) AddHook(hook Hook) {
+	s.hooksMu.Lock()
+	defer s.hooksMu.Unlock()
+	s.hooks = append(s.hooks, hook)
+}
+
+func (s *MqttServer) getHooks() []Hook {
+	s.hooksMu.RLock()
+	defer s.hooksMu.RUnlock()
+	return s.hooks
+}
+
+func (s *MqttServer) onConnect(conn net.Conn, cp *packets.ConnectPacket) byte {
+	for _, hook := range s.getHooks() {
+		if returnCode := hook.OnConnect(conn, cp); returnCode != packets.Accepted {
+			return returnCode
+		}
+	}
+	return packets.Accepted
+}
+
+func (s *MqttServer) onConnectAuthenticate(cp *packets.ConnectPacket, authentication *security.Authentication) bool {
+	for _, hook := range s.getHooks() {
+		if !hook.OnConnectAuthenticate(cp, authentication) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *MqttServer) onDisconnect(c *client.Client, err error) {
+	for _, hook := range s.getHooks() {
+		hook.OnDisconnect(c, err)
+	}
+}
+
+func (s *MqttServer) onSubscribe(c *client.Client, filter string, qos byte) (byte, bool) {
+	for _, hook := range s.getHooks() {
+		var ok bool
+		if qos, ok = hook.OnSubscribe(c, filter, qos); !ok {
+			return qos, false
+		}
+	}
+	return qos, true
+}
+
+func (s *MqttServer) onUnsubscribe(c *client.Client, filter string) {
+	for _, hook := range s.getHooks() {
+		hook.OnUnsubscribe(c, filter)
+	}
+}
+
+//依次调用OnPublish，返回可能被修改后的报文，消息被钩子丢弃时返回nil，钩子修改后的消息不合法时返回错误
+func (s *MqttServer) onPublish(c *client.Client, packet *packets.PublishPacket) (*packets.PublishPacket, error) {
+	hooks := s.getHooks()
+	if len(hooks) == 0 {
+		return packet, nil
+	}
+	msg := newMessage(packet, packet.Qos, packet.Retain)
+	for _, hook := range hooks {
+		if !hook.OnPublish(c, msg) {
+			return nil, nil
+		}
+		//后面的钩子以及转发消息时都依赖合法的topic和qos，每个钩子调用后都需要重新校验
+		if err := validateHookMessage(c, msg); err != nil {
+			return nil, err
+		}
+	}
+	modified := packets.NewMqttPacket(packets.Publish).(*packets.PublishPacket)
+	modified.TopicName = msg.Topic
+	modified.Payload = msg.Payload
+	modified.Qos = msg.Qos
+	modified.Retain = msg.Retain
+	modified.Properties = msg.Properties
+	return modified, nil
+}
+
+//钩子修改后的消息不合法时返回该错误，此时消息不会被发布
+var ErrInvalidHookMessage = errors.New("message modified by hook is invalid")
+
+func validateHookMessage(c *client.Client, msg *Message) error {
+	if msg.Qos > 2 {
+		return fmt.Errorf("%w,invalid qos:%d", ErrInvalidHookMessage, msg.Qos)
+	}
+	if err := trie.ValidateTopicName(msg.Topic); err != nil {
+		return fmt.Errorf("%w,invalid topic %q:%v", ErrInvalidHookMessage, msg.Topic, err)
+	}
+	if c != nil && isSysTopic(msg.Topic) {
+		return fmt.Errorf("%w,client message can not be modified to $SYS topic:%q", ErrInvalidHookMessage, msg.Topic)
+	}
+	return nil
+}
+
+func (s *MqttServer) onDeliver(sessionId string, packet *packets.PublishPacket, qos byte, retain bool) bool {
+	hooks := s.getHooks()
+	if len(hooks) == 0 {
+		return true
+	}
+	msg := newMessage(packet, qos, retain)
+	c := s.clients.FindClientBySessionId(sessionId)
+	for _, hook := range hooks {
+		if !hook.OnDeliver(c, sessionId, msg) {
+			return false
+		}
+	}
+	return true
+}
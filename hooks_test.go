@@ -0,0 +1,148 @@
+package mqtt
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/client"
+	"github.com/davidfantasy/embedded-mqtt-broker/packets"
+	"github.com/davidfantasy/embedded-mqtt-broker/security"
+	"github.com/stretchr/testify/assert"
+)
+
+type testHook struct {
+	HookBase
+	disconnected chan error
+	unsubscribed chan string
+}
+
+func (h *testHook) OnConnect(conn net.Conn, cp *packets.ConnectPacket) byte {
+	if cp.ClientId == "hook-banned" {
+		return packets.ErrRefusedNotAuthorised
+	}
+	return packets.Accepted
+}
+
+func (h *testHook) OnConnectAuthenticate(cp *packets.ConnectPacket, authentication *security.Authentication) bool {
+	return cp.Username != "blocked"
+}
+
+func (h *testHook) OnDisconnect(c *client.Client, err error) {
+	h.disconnected <- err
+}
+
+func (h *testHook) OnSubscribe(c *client.Client, filter string, qos byte) (byte, bool) {
+	if filter == "hook/secret" {
+		return qos, false
+	}
+	return 0, true
+}
+
+func (h *testHook) OnUnsubscribe(c *client.Client, filter string) {
+	h.unsubscribed <- filter
+}
+
+func (h *testHook) OnPublish(c *client.Client, msg *Message) bool {
+	switch msg.Topic {
+	case "hook/drop":
+		return false
+	case "hook/qos":
+		msg.Qos = 3
+	case "hook/sys":
+		msg.Topic = "$SYS/broker/version"
+	}
+	msg.Payload = bytes.ToUpper(msg.Payload)
+	return true
+}
+
+func (h *testHook) OnDeliver(c *client.Client, sessionId string, msg *Message) bool {
+	return c == nil || c.Id != "hook-vetoed"
+}
+
+func TestHooks(t *testing.T) {
+	server := newTestServer()
+	hook := &testHook{disconnected: make(chan error, 10), unsubscribed: make(chan string, 10)}
+	server.AddHook(hook)
+
+	conn, connack := connectTestListener(t, server, testListener, newTestConnectPacket("hook-banned", true))
+	conn.Close()
+	assert.Equal(t, byte(packets.ErrRefusedNotAuthorised), connack.ReturnCode)
+	cp := newTestConnectPacket("hook-blocked", true)
+	cp.UsernameFlag = true
+	cp.Username = "blocked"
+	conn, connack = connectTestListener(t, server, testListener, cp)
+	conn.Close()
+	assert.Equal(t, byte(packets.ErrRefusedBadUsernameOrPassword), connack.ReturnCode)
+
+	sub := connectTestClient(t, server, "hook-sub", true)
+	defer sub.Close()
+	vetoed := connectTestClient(t, server, "hook-vetoed", true)
+	defer vetoed.Close()
+	//钩子把订阅的qos降为0
+	sp := packets.NewMqttPacket(packets.Subscribe).(*packets.SubscribePacket)
+	sp.Qos = 1
+	sp.MessageID = 1
+	sp.Topics = []string{"hook/+", "hook/secret"}
+	sp.Qoss = []byte{1, 1}
+	assert.NoError(t, sp.Write(sub))
+	suback, ok := readTestPacket(t, sub).(*packets.SubackPacket)
+	assert.True(t, ok)
+	assert.Equal(t, []byte{0, 0x80}, suback.ReturnCodes)
+	subscribeTestTopic(t, vetoed, "hook/+", 0)
+
+	pub := connectTestClient(t, server, "hook-pub", true)
+	pp := packets.NewMqttPacket(packets.Publish).(*packets.PublishPacket)
+	pp.TopicName = "hook/drop"
+	pp.Payload = []byte("dropped")
+	assert.NoError(t, pp.Write(pub))
+	pp.TopicName = "hook/data"
+	pp.Payload = []byte("modified")
+	assert.NoError(t, pp.Write(pub))
+	received, ok := readTestPacket(t, sub).(*packets.PublishPacket)
+	assert.True(t, ok)
+	assert.Equal(t, "hook/data", received.TopicName)
+	assert.Equal(t, []byte("MODIFIED"), received.Payload)
+	//被钩子否决的订阅者收不到消息
+	vetoed.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := packets.ReadPacket(vetoed)
+	assert.Error(t, err)
+
+	//钩子修改后的qos或topic不合法时消息被丢弃
+	pp.TopicName = "hook/qos"
+	assert.NoError(t, pp.Write(pub))
+	pp.TopicName = "hook/sys"
+	pp.Retain = true
+	assert.NoError(t, pp.Write(pub))
+	pp.Retain = false
+	//遗嘱消息同样经过钩子
+	cp = newTestConnectPacket("hook-will", true)
+	cp.WillFlag = true
+	cp.WillTopic = "hook/will"
+	cp.WillMessage = []byte("bye")
+	connectTestClientWith(t, server, cp).Close()
+	received, ok = readTestPacket(t, sub).(*packets.PublishPacket)
+	assert.True(t, ok)
+	assert.Equal(t, "hook/will", received.TopicName)
+	assert.Equal(t, []byte("BYE"), received.Payload)
+	assert.Error(t, <-hook.disconnected)
+	assert.Empty(t, server.retained.GetRetainedMessages("$SYS/#"))
+
+	up := packets.NewMqttPacket(packets.Unsubscribe).(*packets.UnsubscribePacket)
+	up.MessageID = 2
+	up.Topics = []string{"hook/+"}
+	assert.NoError(t, up.Write(sub))
+	_, ok = readTestPacket(t, sub).(*packets.UnsubackPacket)
+	assert.True(t, ok)
+	assert.Equal(t, "hook/+", <-hook.unsubscribed)
+
+	assert.NoError(t, packets.NewMqttPacket(packets.Disconnect).Write(pub))
+	assert.NoError(t, <-hook.disconnected)
+	//新连接接管旧连接时，旧连接的断开原因为会话被接管
+	takeover := connectTestClient(t, server, "hook-sub", true)
+	defer takeover.Close()
+	var disconnectErr *client.DisconnectError
+	assert.ErrorAs(t, <-hook.disconnected, &disconnectErr)
+	assert.Equal(t, byte(packets.ReasonSessionTakenOver), disconnectErr.ReasonCode)
+}
@@ -0,0 +1,162 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/config"
+	"github.com/davidfantasy/embedded-mqtt-broker/logger"
+	"github.com/davidfantasy/embedded-mqtt-broker/security"
+)
+
+//运行中的监听
+type listener struct {
+	//当前通过该监听接入的客户端数量，需要通过atomic读写
+	connections int64
+	config      *config.ListenerConfig
+}
+
+func newListener(conf *config.ListenerConfig) *listener {
+	return &listener{config: conf}
+}
+
+//占用一个连接名额，超过最大连接数时返回false
+func (l *listener) acquire() bool {
+	count := atomic.AddInt64(&l.connections, 1)
+	if l.config.MaxConnections > 0 && count > int64(l.config.MaxConnections) {
+		atomic.AddInt64(&l.connections, -1)
+		return false
+	}
+	return true
+}
+
+func (l *listener) release() {
+	atomic.AddInt64(&l.connections, -1)
+}
+
+//该监听使用的权限认证器，允许匿名接入时返回nil
+func (l *listener) authProvider(server *MqttServer) security.AuthenticationProvider {
+	if l.config.Anonymous {
+		return nil
+	}
+	if l.config.AuthProvider != nil {
+		return l.config.AuthProvider
+	}
+	return server.authenticationProvider
+}
+
+//该监听是否使用客户端证书中的身份信息
+func (l *listener) certIdentity() config.CertIdentitySource {
+	if l.config.TLS == nil {
+		return config.CertIdentityNone
+	}
+	return l.config.TLS.CertIdentity
+}
+
+//按照监听的类型创建net.Listener
+func (s *MqttServer) listen(l *listener) (net.Listener, error) {
+	conf := l.config
+	switch conf.Type {
+	case config.ListenerTCP:
+		return net.Listen("tcp", conf.Address)
+	case config.ListenerUnix:
+		//删除上次运行遗留的socket文件
+		if info, err := os.Stat(conf.Address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(conf.Address)
+		}
+		return net.Listen("unix", conf.Address)
+	case config.ListenerTLS:
+		if conf.TLS == nil {
+			return nil, fmt.Errorf("listener %s:tls config is required", conf.Name)
+		}
+		tlsConfig, err := s.newListenerTLSConfig(conf.TLS)
+		if err != nil {
+			return nil, err
+		}
+		return tls.Listen("tcp", conf.Address, tlsConfig)
+	case config.ListenerWebSocket:
+		ln, err := net.Listen("tcp", conf.Address)
+		if err != nil {
+			return nil, err
+		}
+		if conf.TLS != nil {
+			tlsConfig, err := s.newListenerTLSConfig(conf.TLS)
+			if err != nil {
+				ln.Close()
+				return nil, err
+			}
+			ln = tls.NewListener(ln, tlsConfig)
+		}
+		return ln, nil
+	}
+	return nil, fmt.Errorf("listener %s:unsupported listener type %q", conf.Name, conf.Type)
+}
+
+func (s *MqttServer) newListenerTLSConfig(conf *config.TLSConfig) (*tls.Config, error) {
+	tlsConfig, reloader, err := newTLSConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	if reloader != nil {
+		s.certReloadersMu.Lock()
+		s.certReloaders = append(s.certReloaders, reloader)
+		s.certReloadersMu.Unlock()
+	}
+	return tlsConfig, nil
+}
+
+//在net.Listener上接受客户端连接，直到监听被关闭
+func (s *MqttServer) serve(ln net.Listener, l *listener) error {
+	if !s.trackListener(ln) {
+		ln.Close()
+		return ErrServerClosed
+	}
+	defer s.untrackListener(ln)
+	s.sysOnce.Do(func() {
+		go s.publishSysStatsInterval()
+	})
+	if l.config.Type == config.ListenerWebSocket {
+		path := l.config.Path
+		if len(path) == 0 {
+			path = "/"
+		}
+		mux := http.NewServeMux()
+		mux.Handle(path, s.webSocketHandler(l))
+		hs := &http.Server{Handler: mux}
+		s.trackHTTPServer(hs)
+		defer s.untrackHTTPServer(hs)
+		err := hs.Serve(ln)
+		if s.shuttingDown() {
+			return ErrServerClosed
+		}
+		return err
+	}
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			//临时性的错误等待一段时间后重试，参考net/http的处理方式
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				logger.ERROR.Printf("Accept client connection failed:%v,retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go processNewConn(conn, s, l)
+	}
+}
@@ -0,0 +1,144 @@
+package mqtt
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/config"
+	"github.com/davidfantasy/embedded-mqtt-broker/packets"
+	"github.com/davidfantasy/embedded-mqtt-broker/security"
+	"github.com/stretchr/testify/assert"
+)
+
+//通过指定的监听发起连接，返回客户端连接和CONNACK
+func connectTestListener(t *testing.T, server *MqttServer, l *listener, cp *packets.ConnectPacket) (net.Conn, *packets.ConnackPacket) {
+	serverConn, clientConn := net.Pipe()
+	go processNewConn(serverConn, server, l)
+	assert.NoError(t, cp.Write(clientConn))
+	connack, ok := readTestPacket(t, clientConn).(*packets.ConnackPacket)
+	assert.True(t, ok)
+	return clientConn, connack
+}
+
+func TestListenerAuthentication(t *testing.T) {
+	server := newTestServer()
+	server.SetAuthProvider(security.NewStaticUserListAuthProvider([]security.User{{UserName: "admin", Password: "psw"}}))
+	external := newListener(&config.ListenerConfig{Name: "external", Type: config.ListenerTLS})
+	local := newListener(&config.ListenerConfig{Name: "local", Type: config.ListenerUnix, Anonymous: true})
+	conn, connack := connectTestListener(t, server, external, newTestConnectPacket("listener-external", true))
+	defer conn.Close()
+	assert.Equal(t, byte(packets.ErrRefusedBadUsernameOrPassword), connack.ReturnCode)
+	//匿名监听不需要提供用户凭证
+	conn, connack = connectTestListener(t, server, local, newTestConnectPacket("listener-local", true))
+	defer conn.Close()
+	assert.Equal(t, byte(packets.Accepted), connack.ReturnCode)
+}
+
+func TestListenerLimits(t *testing.T) {
+	server := newTestServer()
+	l := newListener(&config.ListenerConfig{Name: "limited", Type: config.ListenerTCP, MaxConnections: 1, ProtocolVersions: []byte{packets.MQTT311}})
+	cp := newTestConnectPacket("listener-v5", true)
+	cp.ProtocolVersion = packets.MQTT5
+	serverConn, clientConn := net.Pipe()
+	go processNewConn(serverConn, server, l)
+	assert.NoError(t, cp.Write(clientConn))
+	connack, ok := readTestPacketWithVersion(t, clientConn, packets.MQTT5).(*packets.ConnackPacket)
+	assert.True(t, ok)
+	assert.Equal(t, byte(packets.ReasonUnsupportedProtocolVersion), connack.ReturnCode)
+	clientConn.Close()
+
+	first, connack := connectTestListener(t, server, l, newTestConnectPacket("listener-first", true))
+	assert.Equal(t, byte(packets.Accepted), connack.ReturnCode)
+	second, connack := connectTestListener(t, server, l, newTestConnectPacket("listener-second", true))
+	defer second.Close()
+	assert.Equal(t, byte(packets.ErrRefusedServerUnavailable), connack.ReturnCode)
+	//连接断开后释放名额
+	assert.NoError(t, packets.NewMqttPacket(packets.Disconnect).Write(first))
+	first.Close()
+	assert.Eventually(t, func() bool { return l.acquire() }, time.Second, 10*time.Millisecond)
+}
+
+//写入总是失败的连接
+type failingWriteConn struct {
+	net.Conn
+}
+
+func (conn failingWriteConn) Write(b []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestConnackWriteFailure(t *testing.T) {
+	server := newTestServer()
+	l := newListener(&config.ListenerConfig{Name: "failing", Type: config.ListenerTCP, MaxConnections: 1})
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	done := make(chan struct{})
+	go func() {
+		processNewConn(failingWriteConn{serverConn}, server, l)
+		close(done)
+	}()
+	assert.NoError(t, newTestConnectPacket("leak", true).Write(clientConn))
+	<-done
+	//CONNACK发送失败后客户端需要被注销，并释放监听的名额
+	assert.Nil(t, server.clients.FindClient("leak"))
+	assert.Equal(t, int64(0), atomic.LoadInt64(&l.connections))
+}
+
+func TestUnixListener(t *testing.T) {
+	server := newTestServer()
+	l := newListener(&config.ListenerConfig{Name: "unix", Type: config.ListenerUnix, Address: filepath.Join(t.TempDir(), "mqtt.sock"), Anonymous: true})
+	ln, err := server.listen(l)
+	assert.NoError(t, err)
+	defer ln.Close()
+	go server.serve(ln, l)
+	conn, err := net.Dial("unix", l.config.Address)
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.NoError(t, newTestConnectPacket("unix-client", true).Write(conn))
+	connack, ok := readTestPacket(t, conn).(*packets.ConnackPacket)
+	assert.True(t, ok)
+	assert.Equal(t, byte(packets.Accepted), connack.ReturnCode)
+}
+
+func TestServe(t *testing.T) {
+	server := newTestServer()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve(ln)
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.NoError(t, newTestConnectPacket("serve-client", true).Write(conn))
+	connack, ok := readTestPacket(t, conn).(*packets.ConnackPacket)
+	assert.True(t, ok)
+	assert.Equal(t, byte(packets.Accepted), connack.ReturnCode)
+	//关闭监听后Serve返回
+	ln.Close()
+	select {
+	case err := <-errCh:
+		assert.ErrorIs(t, err, net.ErrClosed)
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return after the listener was closed")
+	}
+}
+
+func TestListenAndServeBindError(t *testing.T) {
+	occupied, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer occupied.Close()
+	conf := config.NewDefaultConfig()
+	conf.Listeners = []*config.ListenerConfig{
+		{Name: "free", Type: config.ListenerTCP, Address: "127.0.0.1:0"},
+		{Name: "occupied", Type: config.ListenerTCP, Address: occupied.Addr().String()},
+	}
+	err = NewMqttServer(conf).ListenAndServe()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "occupied")
+}
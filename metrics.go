@@ -0,0 +1,118 @@
+package mqtt
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/logger"
+	"github.com/davidfantasy/embedded-mqtt-broker/packets"
+)
+
+//每条消息匹配到的订阅者数量分布的桶上界
+var fanoutBuckets = []int{0, 1, 2, 5, 10, 25, 50, 100, 250, 500, 1000}
+
+//累计分布的直方图，计数器需要通过atomic读写
+type histogram struct {
+	bounds []int
+	//counts[i]为落在(bounds[i-1],bounds[i]]中的观测值数量，最后一个为超出所有上界的数量
+	counts []int64
+	sum    int64
+	count  int64
+}
+
+func newHistogram(bounds []int) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v int) {
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(v))
+	atomic.AddInt64(&h.count, 1)
+}
+
+//按照Prometheus的文本格式输出指标
+type metricsWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *metricsWriter) header(name string, metricType string, help string) {
+	fmt.Fprintf(&w.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func (w *metricsWriter) value(name string, labels string, v int64) {
+	if len(labels) > 0 {
+		fmt.Fprintf(&w.buf, "%s{%s} %d\n", name, labels, v)
+	} else {
+		fmt.Fprintf(&w.buf, "%s %d\n", name, v)
+	}
+}
+
+func (w *metricsWriter) single(name string, metricType string, help string, v int64) {
+	w.header(name, metricType, help)
+	w.value(name, "", v)
+}
+
+func (w *metricsWriter) histogram(name string, help string, h *histogram) {
+	w.header(name, "histogram", help)
+	var cumulative int64
+	for i, bound := range h.bounds {
+		cumulative += atomic.LoadInt64(&h.counts[i])
+		w.value(name+"_bucket", `le="`+strconv.Itoa(bound)+`"`, cumulative)
+	}
+	cumulative += atomic.LoadInt64(&h.counts[len(h.bounds)])
+	w.value(name+"_bucket", `le="+Inf"`, cumulative)
+	w.value(name+"_sum", "", atomic.LoadInt64(&h.sum))
+	w.value(name+"_count", "", atomic.LoadInt64(&h.count))
+}
+
+func (w *metricsWriter) packets(name string, help string, counts *[16]int64) {
+	w.header(name, "counter", help)
+	for t := byte(packets.Connect); t <= packets.Auth; t++ {
+		w.value(name, `type="`+packets.PacketNames[t]+`"`, atomic.LoadInt64(&counts[t]))
+	}
+}
+
+//返回以Prometheus文本格式输出运行指标的http.Handler，可以挂载到已有的http服务上，例如：
+//
+//	http.Handle("/metrics", broker.MetricsHandler())
+//
+//事件总线在event.OverflowDrop和event.OverflowDropAndCount策略下丢弃的事件都会计数，event.OverflowBlock不会丢弃事件
+func (s *MqttServer) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		w := &metricsWriter{}
+		stats := s.stats
+		w.single("mqtt_uptime_seconds", "gauge", "Seconds since the broker was created.", int64(time.Since(stats.startTime)/time.Second))
+		w.single("mqtt_connections", "gauge", "Currently connected clients.", int64(s.clients.CountClients()))
+		w.single("mqtt_connections_total", "counter", "Accepted MQTT connections.", atomic.LoadInt64(&stats.connectionsTotal))
+		w.header("mqtt_connack_refused_total", "counter", "Refused connections by CONNACK return code.")
+		for code := range stats.connackRefused {
+			if n := atomic.LoadInt64(&stats.connackRefused[code]); n > 0 {
+				w.value("mqtt_connack_refused_total", fmt.Sprintf(`code="0x%02X"`, code), n)
+			}
+		}
+		w.packets("mqtt_packets_received_total", "Received MQTT packets by type.", &stats.packetsReceived)
+		w.packets("mqtt_packets_sent_total", "Sent MQTT packets by type.", &stats.packetsSent)
+		w.single("mqtt_bytes_received_total", "counter", "Bytes received from clients.", atomic.LoadInt64(&stats.bytesReceived))
+		w.single("mqtt_bytes_sent_total", "counter", "Bytes sent to clients.", atomic.LoadInt64(&stats.bytesSent))
+		w.single("mqtt_messages_received_total", "counter", "PUBLISH messages received from clients.", atomic.LoadInt64(&stats.messagesReceived))
+		w.single("mqtt_messages_sent_total", "counter", "PUBLISH messages sent to clients.", atomic.LoadInt64(&stats.messagesSent))
+		w.single("mqtt_messages_dropped_total", "counter", "Dropped PUBLISH messages.", atomic.LoadInt64(&stats.messagesDropped))
+		w.histogram("mqtt_publish_fanout", "Number of subscribers matched by each published message.", stats.fanout)
+		w.single("mqtt_subscriptions", "gauge", "Current subscriptions of all sessions.", int64(s.subscriptions.CountSubscriptions()))
+		w.single("mqtt_topic_trie_nodes", "gauge", "Subscribed topic filter nodes in the subscription trie.", int64(s.subscriptions.countTopicNodes()))
+		w.single("mqtt_sessions", "gauge", "Current sessions, including offline persistent sessions.", int64(s.clients.CountSessions()))
+		w.single("mqtt_event_bus_dropped_total", "counter", "Events dropped because a handler buffer was full.", int64(s.eventBus.Dropped()))
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if _, err := rw.Write(w.buf.Bytes()); err != nil {
+			logger.WARN.Println("write metrics failed:", err)
+		}
+	})
+}
@@ -0,0 +1,72 @@
+package mqtt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]int{0, 1, 5})
+	for _, v := range []int{0, 1, 3, 5, 6} {
+		h.observe(v)
+	}
+	assert.Equal(t, []int64{1, 1, 2, 1}, h.counts)
+	assert.Equal(t, int64(15), h.sum)
+	assert.Equal(t, int64(5), h.count)
+}
+
+func TestMetricsHandler(t *testing.T) {
+	server := newTestServer()
+	conn, connack := connectTestListener(t, server, testListener, newTestConnectPacket("", false))
+	conn.Close()
+	assert.Equal(t, byte(packets.ErrRefusedIDRejected), connack.ReturnCode)
+	c := connectTestClient(t, server, "metrics-client", true)
+	defer c.Close()
+	subscribeTestTopic(t, c, "metrics/+", 0)
+	sub, err := server.SubscribeChan("metrics/#", 10)
+	assert.NoError(t, err)
+	defer sub.Unsubscribe()
+	published := make(chan error, 1)
+	go func() {
+		published <- server.Publish("metrics/a", []byte("x"), 0, false)
+	}()
+	_, ok := readTestPacket(t, c).(*packets.PublishPacket)
+	assert.True(t, ok)
+	<-sub.C
+	//等待Publish返回，确保发送计数已经更新
+	assert.NoError(t, <-published)
+
+	rec := httptest.NewRecorder()
+	server.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.True(t, strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4"))
+	lines := strings.Split(rec.Body.String(), "\n")
+	for _, line := range []string{
+		"# TYPE mqtt_connections gauge",
+		"mqtt_connections 1",
+		"mqtt_connections_total 1",
+		`mqtt_connack_refused_total{code="0x02"} 1`,
+		`mqtt_packets_received_total{type="CONNECT"} 2`,
+		`mqtt_packets_received_total{type="SUBSCRIBE"} 1`,
+		`mqtt_packets_sent_total{type="SUBACK"} 1`,
+		`mqtt_packets_sent_total{type="PUBLISH"} 1`,
+		"# TYPE mqtt_publish_fanout histogram",
+		`mqtt_publish_fanout_bucket{le="1"} 0`,
+		`mqtt_publish_fanout_bucket{le="2"} 1`,
+		`mqtt_publish_fanout_bucket{le="+Inf"} 1`,
+		"mqtt_publish_fanout_sum 2",
+		"mqtt_publish_fanout_count 1",
+		//进程内订阅同样计入订阅数
+		"mqtt_subscriptions 2",
+		"mqtt_topic_trie_nodes 2",
+		"mqtt_sessions 1",
+		"mqtt_event_bus_dropped_total 0",
+	} {
+		assert.Contains(t, lines, line)
+	}
+}
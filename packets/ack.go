@@ -0,0 +1,46 @@
+package packets
+
+import (
+	"bytes"
+	"io"
+)
+
+//编码puback、pubrec、pubrel和pubcomp包，mqtt 5.0中原因码为成功且没有属性时可以省略
+func writeAck(fh *FixedHeader, messageId uint16, reasonCode byte, props *Properties, w io.Writer) error {
+	var body bytes.Buffer
+	body.Write(encodeUint16(messageId))
+	if fh.ProtocolVersion == MQTT5 && (reasonCode != ReasonSuccess || !props.isEmpty()) {
+		body.WriteByte(reasonCode)
+		if !props.isEmpty() {
+			body.Write(props.pack())
+		}
+	}
+	fh.RemainingLength = body.Len()
+	packet := fh.pack()
+	packet.Write(body.Bytes())
+	_, err := packet.WriteTo(w)
+	return err
+}
+
+//解码puback、pubrec、pubrel和pubcomp包
+func readAck(fh *FixedHeader, b io.Reader) (uint16, byte, *Properties, error) {
+	messageId, err := decodeUint16(b)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if fh.ProtocolVersion != MQTT5 || fh.RemainingLength <= 2 {
+		return messageId, ReasonSuccess, nil, nil
+	}
+	reasonCode, err := decodeByte(b)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if fh.RemainingLength <= 3 {
+		return messageId, reasonCode, nil, nil
+	}
+	props := &Properties{}
+	if _, err := props.unpack(b); err != nil {
+		return 0, 0, nil, err
+	}
+	return messageId, reasonCode, props, nil
+}
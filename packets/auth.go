@@ -0,0 +1,47 @@
+package packets
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+//auth包，mqtt 5.0中用于增强认证的数据交换
+type AuthPacket struct {
+	FixedHeader
+	ReasonCode byte
+	Properties *Properties
+}
+
+func (a *AuthPacket) String() string {
+	return fmt.Sprintf("%s ReasonCode: %d", a.FixedHeader, a.ReasonCode)
+}
+
+func (a *AuthPacket) Write(w io.Writer) error {
+	var body bytes.Buffer
+	//原因码为成功且没有属性时可以省略
+	if a.ReasonCode != ReasonSuccess || !a.Properties.isEmpty() {
+		body.WriteByte(a.ReasonCode)
+		body.Write(a.Properties.pack())
+	}
+	a.FixedHeader.RemainingLength = body.Len()
+	packet := a.FixedHeader.pack()
+	packet.Write(body.Bytes())
+	_, err := packet.WriteTo(w)
+
+	return err
+}
+
+func (a *AuthPacket) Read(b io.Reader) error {
+	if a.RemainingLength == 0 {
+		return nil
+	}
+	var err error
+	a.ReasonCode, err = decodeByte(b)
+	if err != nil || a.RemainingLength == 1 {
+		return err
+	}
+	a.Properties = &Properties{}
+	_, err = a.Properties.unpack(b)
+	return err
+}
@@ -10,7 +10,9 @@ import (
 type ConnackPacket struct {
 	FixedHeader
 	SessionPresent bool
-	ReturnCode     byte
+	//mqtt 5.0中为原因码
+	ReturnCode byte
+	Properties *Properties
 }
 
 func (ca *ConnackPacket) String() string {
@@ -22,7 +24,10 @@ func (ca *ConnackPacket) Write(w io.Writer) error {
 	var err error
 	body.WriteByte(boolToByte(ca.SessionPresent))
 	body.WriteByte(ca.ReturnCode)
-	ca.FixedHeader.RemainingLength = 2
+	if ca.ProtocolVersion == MQTT5 {
+		body.Write(ca.Properties.pack())
+	}
+	ca.FixedHeader.RemainingLength = body.Len()
 	packet := ca.FixedHeader.pack()
 	packet.Write(body.Bytes())
 	_, err = packet.WriteTo(w)
@@ -36,5 +41,12 @@ func (ca *ConnackPacket) Read(b io.Reader) error {
 	}
 	ca.SessionPresent = 1&flags > 0
 	ca.ReturnCode, err = readByte(b)
+	if err != nil {
+		return err
+	}
+	if ca.ProtocolVersion == MQTT5 && ca.RemainingLength > 2 {
+		ca.Properties = &Properties{}
+		_, err = ca.Properties.unpack(b)
+	}
 	return err
 }
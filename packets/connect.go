@@ -11,7 +11,7 @@ type ConnectPacket struct {
 	FixedHeader
 	ProtocolName    string
 	ProtocolVersion byte
-	CleanSession    bool
+	CleanSession    bool //mqtt 5.0中该标志表示Clean Start
 	WillFlag        bool
 	WillQos         byte
 	WillRetain      bool
@@ -25,6 +25,9 @@ type ConnectPacket struct {
 	WillMessage []byte
 	Username    string
 	Password    []byte
+	//mqtt 5.0的连接属性和遗嘱属性
+	Properties     *Properties
+	WillProperties *Properties
 }
 
 func (cp *ConnectPacket) Write(w io.Writer) error {
@@ -34,8 +37,14 @@ func (cp *ConnectPacket) Write(w io.Writer) error {
 	body.WriteByte(cp.ProtocolVersion)
 	body.WriteByte(boolToByte(cp.CleanSession)<<1 | boolToByte(cp.WillFlag)<<2 | cp.WillQos<<3 | boolToByte(cp.WillRetain)<<5 | boolToByte(cp.PasswordFlag)<<6 | boolToByte(cp.UsernameFlag)<<7)
 	body.Write(encodeUint16(cp.Keepalive))
+	if cp.ProtocolVersion == MQTT5 {
+		body.Write(cp.Properties.pack())
+	}
 	body.Write(encodeString(cp.ClientId))
 	if cp.WillFlag {
+		if cp.ProtocolVersion == MQTT5 {
+			body.Write(cp.WillProperties.pack())
+		}
 		body.Write(encodeString(cp.WillTopic))
 		body.Write(encodeBytes(cp.WillMessage))
 	}
@@ -62,6 +71,7 @@ func (cp *ConnectPacket) Read(b io.Reader) error {
 	if err != nil {
 		return err
 	}
+	cp.FixedHeader.ProtocolVersion = cp.ProtocolVersion
 	options, err := readByte(b)
 	if err != nil {
 		return err
@@ -77,11 +87,23 @@ func (cp *ConnectPacket) Read(b io.Reader) error {
 	if err != nil {
 		return err
 	}
+	if cp.ProtocolVersion == MQTT5 {
+		cp.Properties = &Properties{}
+		if _, err = cp.Properties.unpack(b); err != nil {
+			return err
+		}
+	}
 	cp.ClientId, err = readString(b)
 	if err != nil {
 		return err
 	}
 	if cp.WillFlag {
+		if cp.ProtocolVersion == MQTT5 {
+			cp.WillProperties = &Properties{}
+			if _, err = cp.WillProperties.unpack(b); err != nil {
+				return err
+			}
+		}
 		cp.WillTopic, err = readString(b)
 		if err != nil {
 			return err
@@ -123,10 +145,14 @@ func (c *ConnectPacket) Validate() byte {
 		// Bad reserved bit
 		return ErrProtocolViolation
 	}
-	if (c.ProtocolName == "MQIsdp" && c.ProtocolVersion != 3) || (c.ProtocolName == "MQTT" && c.ProtocolVersion != 4) {
+	if (c.ProtocolName == "MQIsdp" && c.ProtocolVersion != MQTT31) || (c.ProtocolName == "MQTT" && c.ProtocolVersion != MQTT311 && c.ProtocolVersion != MQTT5) {
 		// Mismatched or unsupported protocol version
 		return ErrRefusedBadProtocolVersion
 	}
+	if c.WillQos > 2 || (!c.WillFlag && (c.WillQos != 0 || c.WillRetain)) {
+		// Bad will flags
+		return ErrProtocolViolation
+	}
 	if c.ProtocolName != "MQIsdp" && c.ProtocolName != "MQTT" {
 		// Bad protocol name
 		return ErrProtocolViolation
@@ -135,7 +161,7 @@ func (c *ConnectPacket) Validate() byte {
 		// Bad size field
 		return ErrProtocolViolation
 	}
-	if len(c.ClientId) == 0 && !c.CleanSession {
+	if len(c.ClientId) == 0 && !c.CleanSession && c.ProtocolVersion != MQTT5 {
 		// Bad client identifier
 		return ErrRefusedIDRejected
 	}
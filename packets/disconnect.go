@@ -1,22 +1,47 @@
 package packets
 
-import "io"
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
 
 type DisconnectPacket struct {
 	FixedHeader
+	//mqtt 5.0的原因码和属性
+	ReasonCode byte
+	Properties *Properties
 }
 
 func (d *DisconnectPacket) String() string {
-	return d.FixedHeader.String()
+	return fmt.Sprintf("%s ReasonCode: %d", d.FixedHeader, d.ReasonCode)
 }
 
 func (d *DisconnectPacket) Write(w io.Writer) error {
+	var body bytes.Buffer
+	//mqtt 5.0中原因码为正常断开且没有属性时可以省略
+	if d.ProtocolVersion == MQTT5 && (d.ReasonCode != ReasonNormalDisconnection || !d.Properties.isEmpty()) {
+		body.WriteByte(d.ReasonCode)
+		body.Write(d.Properties.pack())
+	}
+	d.FixedHeader.RemainingLength = body.Len()
 	packet := d.FixedHeader.pack()
+	packet.Write(body.Bytes())
 	_, err := packet.WriteTo(w)
 
 	return err
 }
 
 func (d *DisconnectPacket) Read(b io.Reader) error {
-	return nil
+	if d.ProtocolVersion != MQTT5 || d.RemainingLength == 0 {
+		return nil
+	}
+	var err error
+	d.ReasonCode, err = decodeByte(b)
+	if err != nil || d.RemainingLength == 1 {
+		return err
+	}
+	d.Properties = &Properties{}
+	_, err = d.Properties.unpack(b)
+	return err
 }
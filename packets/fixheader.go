@@ -13,6 +13,13 @@ type FixedHeader struct {
 	Qos             byte
 	Retain          bool
 	RemainingLength int
+	//数据包使用的协议版本，不参与编码，用于决定可变头部和载荷的格式
+	ProtocolVersion byte
+}
+
+//数据包的类型，例如Connect、Publish
+func (fh FixedHeader) PacketType() byte {
+	return fh.MessageType
 }
 
 func (fh *FixedHeader) unpack(typeAndFlags byte, r io.Reader) error {
@@ -23,6 +23,7 @@ const (
 	Pingreq     = 12
 	Pingresp    = 13
 	Disconnect  = 14
+	Auth        = 15
 )
 
 var PacketNames = map[uint8]string{
@@ -40,6 +41,7 @@ var PacketNames = map[uint8]string{
 	12: "PINGREQ",
 	13: "PINGRESP",
 	14: "DISCONNECT",
+	15: "AUTH",
 }
 
 //所有packet的公共接口
@@ -47,6 +49,7 @@ type MqttPacket interface {
 	Write(io.Writer) error
 	Read(io.Reader) error
 	String() string
+	PacketType() byte
 }
 
 const (
@@ -60,8 +63,14 @@ const (
 	ErrProtocolViolation            = 0xFF
 )
 
+//按照mqtt 3.1.1协议读取一个数据包
 func ReadPacket(conn net.Conn) (MqttPacket, error) {
-	var fh FixedHeader
+	return ReadPacketWithVersion(conn, MQTT311)
+}
+
+//按照指定的协议版本读取一个数据包，CONNECT包会使用其自身携带的协议版本
+func ReadPacketWithVersion(conn net.Conn, version byte) (MqttPacket, error) {
+	fh := FixedHeader{ProtocolVersion: version}
 	b := make([]byte, 1)
 
 	_, err := io.ReadFull(conn, b)
@@ -90,29 +99,21 @@ func ReadPacket(conn net.Conn) (MqttPacket, error) {
 }
 
 func NewMqttPacket(messageType byte) MqttPacket {
-	switch messageType {
-	case Connect:
-		return &ConnectPacket{FixedHeader: FixedHeader{MessageType: Connect}}
-	case Connack:
-		return &ConnackPacket{FixedHeader: FixedHeader{MessageType: Connack}}
-	case Publish:
-		return &PublishPacket{FixedHeader: FixedHeader{MessageType: Publish}}
-	case Subscribe:
-		return &SubscribePacket{FixedHeader: FixedHeader{MessageType: Subscribe}}
-	case Suback:
-		return &SubackPacket{FixedHeader: FixedHeader{MessageType: Suback}}
-	case Unsubscribe:
-		return &UnsubscribePacket{FixedHeader: FixedHeader{MessageType: Unsubscribe}}
-	case Unsuback:
-		return &UnsubackPacket{FixedHeader: FixedHeader{MessageType: Unsuback}}
-	case Disconnect:
-		return &DisconnectPacket{FixedHeader: FixedHeader{MessageType: Disconnect}}
-	case Pingreq:
-		return &DisconnectPacket{FixedHeader: FixedHeader{MessageType: Pingreq}}
-	case Pingresp:
-		return &DisconnectPacket{FixedHeader: FixedHeader{MessageType: Pingresp}}
+	return NewMqttPacketWithVersion(messageType, MQTT311)
+}
+
+//创建一个按照指定协议版本编码的数据包
+func NewMqttPacketWithVersion(messageType byte, version byte) MqttPacket {
+	fh := FixedHeader{MessageType: messageType, ProtocolVersion: version}
+	if messageType == Pubrel || messageType == Subscribe || messageType == Unsubscribe {
+		//pubrel、subscribe和unsubscribe固定头部的保留位必须为0010
+		fh.Qos = 1
 	}
-	return nil
+	packet, err := NewMqttPacketWithHeader(fh)
+	if err != nil {
+		return nil
+	}
+	return packet
 }
 
 func NewMqttPacketWithHeader(fh FixedHeader) (MqttPacket, error) {
@@ -120,9 +121,17 @@ func NewMqttPacketWithHeader(fh FixedHeader) (MqttPacket, error) {
 	case Connect:
 		return &ConnectPacket{FixedHeader: fh}, nil
 	case Connack:
-		return &ConnectPacket{FixedHeader: fh}, nil
+		return &ConnackPacket{FixedHeader: fh}, nil
 	case Publish:
 		return &PublishPacket{FixedHeader: fh}, nil
+	case Puback:
+		return &PubackPacket{FixedHeader: fh}, nil
+	case Pubrec:
+		return &PubrecPacket{FixedHeader: fh}, nil
+	case Pubrel:
+		return &PubrelPacket{FixedHeader: fh}, nil
+	case Pubcomp:
+		return &PubcompPacket{FixedHeader: fh}, nil
 	case Subscribe:
 		return &SubscribePacket{FixedHeader: fh}, nil
 	case Suback:
@@ -137,6 +146,8 @@ func NewMqttPacketWithHeader(fh FixedHeader) (MqttPacket, error) {
 		return &PingreqPacket{FixedHeader: fh}, nil
 	case Pingresp:
 		return &PingrespPacket{FixedHeader: fh}, nil
+	case Auth:
+		return &AuthPacket{FixedHeader: fh}, nil
 	}
 
 	return nil, fmt.Errorf("unsupported packet type 0x%x", fh.MessageType)
@@ -0,0 +1,122 @@
+package packets
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//将数据包写入内存管道再按照指定的协议版本读出
+func roundTrip(t *testing.T, packet MqttPacket, version byte) MqttPacket {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go func() {
+		assert.NoError(t, packet.Write(client))
+	}()
+	result, err := ReadPacketWithVersion(server, version)
+	assert.NoError(t, err)
+	return result
+}
+
+func TestPropertiesRoundTrip(t *testing.T) {
+	var expiry uint32 = 3600
+	var format byte = 1
+	props := &Properties{
+		PayloadFormat:          &format,
+		MessageExpiry:          &expiry,
+		ContentType:            "application/json",
+		CorrelationData:        []byte{1, 2, 3},
+		SubscriptionIdentifier: []int{1, 268435455},
+		User:                   []UserProperty{{"k", "v1"}, {"k", "v2"}},
+	}
+	var result Properties
+	n, err := result.unpack(bytes.NewBuffer(props.pack()))
+	assert.NoError(t, err)
+	assert.Equal(t, len(props.pack()), n)
+	assert.Equal(t, *props, result)
+}
+
+func TestConnectV5RoundTrip(t *testing.T) {
+	var expiry uint32 = 60
+	cp := NewMqttPacketWithVersion(Connect, MQTT5).(*ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = MQTT5
+	cp.ClientId = "c1"
+	cp.WillFlag = true
+	cp.WillTopic = "will"
+	cp.WillMessage = []byte("bye")
+	cp.Properties = &Properties{SessionExpiryInterval: &expiry}
+	cp.WillProperties = &Properties{ContentType: "text/plain"}
+	result := roundTrip(t, cp, MQTT311).(*ConnectPacket)
+	assert.Equal(t, byte(Accepted), result.Validate())
+	assert.Equal(t, expiry, *result.Properties.SessionExpiryInterval)
+	assert.Equal(t, "text/plain", result.WillProperties.ContentType)
+	assert.Equal(t, "will", result.WillTopic)
+}
+
+func TestPublishV5RoundTrip(t *testing.T) {
+	pp := NewMqttPacketWithVersion(Publish, MQTT5).(*PublishPacket)
+	pp.Qos = 1
+	pp.MessageID = 3
+	pp.TopicName = "a/b"
+	pp.Payload = []byte("payload")
+	pp.Properties = &Properties{ResponseTopic: "a/resp"}
+	result := roundTrip(t, pp, MQTT5).(*PublishPacket)
+	assert.Equal(t, "a/b", result.TopicName)
+	assert.Equal(t, []byte("payload"), result.Payload)
+	assert.Equal(t, "a/resp", result.Properties.ResponseTopic)
+	assert.Equal(t, uint16(3), result.MessageID)
+
+	//Size与实际编码后的长度一致
+	var buf bytes.Buffer
+	assert.NoError(t, pp.Write(&buf))
+	assert.Equal(t, buf.Len(), pp.Size())
+	pp.Payload = make([]byte, 200)
+	buf.Reset()
+	assert.NoError(t, pp.Write(&buf))
+	assert.Equal(t, buf.Len(), pp.Size())
+}
+
+func TestSubscribeV5RoundTrip(t *testing.T) {
+	sp := NewMqttPacketWithVersion(Subscribe, MQTT5).(*SubscribePacket)
+	sp.MessageID = 1
+	sp.Topics = []string{"a/#", "b"}
+	sp.Qoss = []byte{1, 2}
+	sp.Options = []SubOptions{{NoLocal: true}, {RetainHandling: 2}}
+	result := roundTrip(t, sp, MQTT5).(*SubscribePacket)
+	assert.Equal(t, sp.Topics, result.Topics)
+	assert.Equal(t, sp.Qoss, result.Qoss)
+	assert.Equal(t, sp.Options, result.Options)
+}
+
+func TestAckV5RoundTrip(t *testing.T) {
+	ack := NewMqttPacketWithVersion(Puback, MQTT5).(*PubackPacket)
+	ack.MessageID = 9
+	result := roundTrip(t, ack, MQTT5).(*PubackPacket)
+	assert.Equal(t, 2, result.RemainingLength)
+	assert.Equal(t, byte(ReasonSuccess), result.ReasonCode)
+
+	ack.ReasonCode = ReasonNotAuthorized
+	ack.Properties = &Properties{ReasonString: "denied"}
+	result = roundTrip(t, ack, MQTT5).(*PubackPacket)
+	assert.Equal(t, uint16(9), result.MessageID)
+	assert.Equal(t, byte(ReasonNotAuthorized), result.ReasonCode)
+	assert.Equal(t, "denied", result.Properties.ReasonString)
+}
+
+func TestDisconnectAndAuthV5RoundTrip(t *testing.T) {
+	d := NewMqttPacketWithVersion(Disconnect, MQTT5).(*DisconnectPacket)
+	d.ReasonCode = ReasonServerShuttingDown
+	result := roundTrip(t, d, MQTT5).(*DisconnectPacket)
+	assert.Equal(t, byte(ReasonServerShuttingDown), result.ReasonCode)
+
+	a := NewMqttPacketWithVersion(Auth, MQTT5).(*AuthPacket)
+	a.ReasonCode = ReasonContinueAuthentication
+	a.Properties = &Properties{AuthMethod: "SCRAM-SHA-1"}
+	auth := roundTrip(t, a, MQTT5).(*AuthPacket)
+	assert.Equal(t, byte(ReasonContinueAuthentication), auth.ReasonCode)
+	assert.Equal(t, "SCRAM-SHA-1", auth.Properties.AuthMethod)
+}
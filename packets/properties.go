@@ -0,0 +1,310 @@
+package packets
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// mqtt 5.0中各属性的标识符
+const (
+	PropPayloadFormat          = 0x01
+	PropMessageExpiry          = 0x02
+	PropContentType            = 0x03
+	PropResponseTopic          = 0x08
+	PropCorrelationData        = 0x09
+	PropSubscriptionIdentifier = 0x0B
+	PropSessionExpiryInterval  = 0x11
+	PropAssignedClientID       = 0x12
+	PropServerKeepAlive        = 0x13
+	PropAuthMethod             = 0x15
+	PropAuthData               = 0x16
+	PropRequestProblemInfo     = 0x17
+	PropWillDelayInterval      = 0x18
+	PropRequestResponseInfo    = 0x19
+	PropResponseInfo           = 0x1A
+	PropServerReference        = 0x1C
+	PropReasonString           = 0x1F
+	PropReceiveMaximum         = 0x21
+	PropTopicAliasMaximum      = 0x22
+	PropTopicAlias             = 0x23
+	PropMaximumQOS             = 0x24
+	PropRetainAvailable        = 0x25
+	PropUser                   = 0x26
+	PropMaximumPacketSize      = 0x27
+	PropWildcardSubAvailable   = 0x28
+	PropSubIDAvailable         = 0x29
+	PropSharedSubAvailable     = 0x2A
+)
+
+//用户自定义属性，同一个key可以出现多次
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+//mqtt 5.0的属性集合，指针类型的字段为nil时表示该属性不存在
+type Properties struct {
+	PayloadFormat          *byte
+	MessageExpiry          *uint32
+	ContentType            string
+	ResponseTopic          string
+	CorrelationData        []byte
+	SubscriptionIdentifier []int
+	SessionExpiryInterval  *uint32
+	AssignedClientID       string
+	ServerKeepAlive        *uint16
+	AuthMethod             string
+	AuthData               []byte
+	RequestProblemInfo     *byte
+	WillDelayInterval      *uint32
+	RequestResponseInfo    *byte
+	ResponseInfo           string
+	ServerReference        string
+	ReasonString           string
+	ReceiveMaximum         *uint16
+	TopicAliasMaximum      *uint16
+	TopicAlias             *uint16
+	MaximumQOS             *byte
+	RetainAvailable        *byte
+	User                   []UserProperty
+	MaximumPacketSize      *uint32
+	WildcardSubAvailable   *byte
+	SubIDAvailable         *byte
+	SharedSubAvailable     *byte
+}
+
+//编码属性，返回值包含属性长度前缀，p为nil时编码为长度为0的属性
+func (p *Properties) pack() []byte {
+	if p == nil {
+		return []byte{0}
+	}
+	var b bytes.Buffer
+	writeByteProp := func(id byte, v *byte) {
+		if v != nil {
+			b.WriteByte(id)
+			b.WriteByte(*v)
+		}
+	}
+	writeUint16Prop := func(id byte, v *uint16) {
+		if v != nil {
+			b.WriteByte(id)
+			b.Write(encodeUint16(*v))
+		}
+	}
+	writeUint32Prop := func(id byte, v *uint32) {
+		if v != nil {
+			b.WriteByte(id)
+			b.Write(encodeUint32(*v))
+		}
+	}
+	writeStringProp := func(id byte, v string) {
+		if v != "" {
+			b.WriteByte(id)
+			b.Write(encodeString(v))
+		}
+	}
+	writeBytesProp := func(id byte, v []byte) {
+		if v != nil {
+			b.WriteByte(id)
+			b.Write(encodeBytes(v))
+		}
+	}
+	writeByteProp(PropPayloadFormat, p.PayloadFormat)
+	writeUint32Prop(PropMessageExpiry, p.MessageExpiry)
+	writeStringProp(PropContentType, p.ContentType)
+	writeStringProp(PropResponseTopic, p.ResponseTopic)
+	writeBytesProp(PropCorrelationData, p.CorrelationData)
+	for _, id := range p.SubscriptionIdentifier {
+		b.WriteByte(PropSubscriptionIdentifier)
+		b.Write(encodeLength(id))
+	}
+	writeUint32Prop(PropSessionExpiryInterval, p.SessionExpiryInterval)
+	writeStringProp(PropAssignedClientID, p.AssignedClientID)
+	writeUint16Prop(PropServerKeepAlive, p.ServerKeepAlive)
+	writeStringProp(PropAuthMethod, p.AuthMethod)
+	writeBytesProp(PropAuthData, p.AuthData)
+	writeByteProp(PropRequestProblemInfo, p.RequestProblemInfo)
+	writeUint32Prop(PropWillDelayInterval, p.WillDelayInterval)
+	writeByteProp(PropRequestResponseInfo, p.RequestResponseInfo)
+	writeStringProp(PropResponseInfo, p.ResponseInfo)
+	writeStringProp(PropServerReference, p.ServerReference)
+	writeStringProp(PropReasonString, p.ReasonString)
+	writeUint16Prop(PropReceiveMaximum, p.ReceiveMaximum)
+	writeUint16Prop(PropTopicAliasMaximum, p.TopicAliasMaximum)
+	writeUint16Prop(PropTopicAlias, p.TopicAlias)
+	writeByteProp(PropMaximumQOS, p.MaximumQOS)
+	writeByteProp(PropRetainAvailable, p.RetainAvailable)
+	for _, u := range p.User {
+		b.WriteByte(PropUser)
+		b.Write(encodeString(u.Key))
+		b.Write(encodeString(u.Value))
+	}
+	writeUint32Prop(PropMaximumPacketSize, p.MaximumPacketSize)
+	writeByteProp(PropWildcardSubAvailable, p.WildcardSubAvailable)
+	writeByteProp(PropSubIDAvailable, p.SubIDAvailable)
+	writeByteProp(PropSharedSubAvailable, p.SharedSubAvailable)
+	return append(encodeLength(b.Len()), b.Bytes()...)
+}
+
+//解码属性，返回读取的总字节数（包含属性长度前缀）
+func (p *Properties) unpack(r io.Reader) (int, error) {
+	length, err := decodeLength(r)
+	if err != nil {
+		return 0, err
+	}
+	total := len(encodeLength(length)) + length
+	if length == 0 {
+		return total, nil
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, err
+	}
+	b := bytes.NewBuffer(buf)
+	for b.Len() > 0 {
+		id, err := b.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch id {
+		case PropPayloadFormat:
+			p.PayloadFormat, err = readBytePtr(b)
+		case PropMessageExpiry:
+			p.MessageExpiry, err = readUint32Ptr(b)
+		case PropContentType:
+			p.ContentType, err = readStrictString(b)
+		case PropResponseTopic:
+			p.ResponseTopic, err = readStrictString(b)
+		case PropCorrelationData:
+			p.CorrelationData, err = readStrictBytes(b)
+		case PropSubscriptionIdentifier:
+			var id int
+			id, err = decodeLength(b)
+			p.SubscriptionIdentifier = append(p.SubscriptionIdentifier, id)
+		case PropSessionExpiryInterval:
+			p.SessionExpiryInterval, err = readUint32Ptr(b)
+		case PropAssignedClientID:
+			p.AssignedClientID, err = readStrictString(b)
+		case PropServerKeepAlive:
+			p.ServerKeepAlive, err = readUint16Ptr(b)
+		case PropAuthMethod:
+			p.AuthMethod, err = readStrictString(b)
+		case PropAuthData:
+			p.AuthData, err = readStrictBytes(b)
+		case PropRequestProblemInfo:
+			p.RequestProblemInfo, err = readBytePtr(b)
+		case PropWillDelayInterval:
+			p.WillDelayInterval, err = readUint32Ptr(b)
+		case PropRequestResponseInfo:
+			p.RequestResponseInfo, err = readBytePtr(b)
+		case PropResponseInfo:
+			p.ResponseInfo, err = readStrictString(b)
+		case PropServerReference:
+			p.ServerReference, err = readStrictString(b)
+		case PropReasonString:
+			p.ReasonString, err = readStrictString(b)
+		case PropReceiveMaximum:
+			p.ReceiveMaximum, err = readUint16Ptr(b)
+		case PropTopicAliasMaximum:
+			p.TopicAliasMaximum, err = readUint16Ptr(b)
+		case PropTopicAlias:
+			p.TopicAlias, err = readUint16Ptr(b)
+		case PropMaximumQOS:
+			p.MaximumQOS, err = readBytePtr(b)
+		case PropRetainAvailable:
+			p.RetainAvailable, err = readBytePtr(b)
+		case PropUser:
+			var u UserProperty
+			if u.Key, err = readStrictString(b); err == nil {
+				u.Value, err = readStrictString(b)
+			}
+			p.User = append(p.User, u)
+		case PropMaximumPacketSize:
+			p.MaximumPacketSize, err = readUint32Ptr(b)
+		case PropWildcardSubAvailable:
+			p.WildcardSubAvailable, err = readBytePtr(b)
+		case PropSubIDAvailable:
+			p.SubIDAvailable, err = readBytePtr(b)
+		case PropSharedSubAvailable:
+			p.SharedSubAvailable, err = readBytePtr(b)
+		default:
+			return 0, fmt.Errorf("unknown property identifier 0x%x", id)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+//复制转发给订阅者时需要保留的属性，主题别名和订阅标识符只对单个连接有效，不会被复制
+func (p *Properties) copyForForward() *Properties {
+	if p == nil {
+		return nil
+	}
+	return &Properties{
+		PayloadFormat:   p.PayloadFormat,
+		MessageExpiry:   p.MessageExpiry,
+		ContentType:     p.ContentType,
+		ResponseTopic:   p.ResponseTopic,
+		CorrelationData: p.CorrelationData,
+		User:            p.User,
+	}
+}
+
+//属性的值是否都为空，为空时部分报文可以省略属性部分
+func (p *Properties) isEmpty() bool {
+	return p == nil || len(p.pack()) == 1
+}
+
+func encodeUint32(num uint32) []byte {
+	bytesResult := make([]byte, 4)
+	binary.BigEndian.PutUint32(bytesResult, num)
+	return bytesResult
+}
+
+func readBytePtr(b io.Reader) (*byte, error) {
+	v := make([]byte, 1)
+	if _, err := io.ReadFull(b, v); err != nil {
+		return nil, err
+	}
+	return &v[0], nil
+}
+
+func readUint16Ptr(b io.Reader) (*uint16, error) {
+	v := make([]byte, 2)
+	if _, err := io.ReadFull(b, v); err != nil {
+		return nil, err
+	}
+	num := binary.BigEndian.Uint16(v)
+	return &num, nil
+}
+
+func readUint32Ptr(b io.Reader) (*uint32, error) {
+	v := make([]byte, 4)
+	if _, err := io.ReadFull(b, v); err != nil {
+		return nil, err
+	}
+	num := binary.BigEndian.Uint32(v)
+	return &num, nil
+}
+
+func readStrictString(b io.Reader) (string, error) {
+	buf, err := readStrictBytes(b)
+	return string(buf), err
+}
+
+//与readBytes不同，数据不足时会返回错误
+func readStrictBytes(b io.Reader) ([]byte, error) {
+	v := make([]byte, 2)
+	if _, err := io.ReadFull(b, v); err != nil {
+		return nil, err
+	}
+	field := make([]byte, binary.BigEndian.Uint16(v))
+	if _, err := io.ReadFull(b, field); err != nil {
+		return nil, err
+	}
+	return field, nil
+}
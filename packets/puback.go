@@ -0,0 +1,29 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+//puback包，qos为1的publish包的确认
+type PubackPacket struct {
+	FixedHeader
+	MessageID uint16
+	//mqtt 5.0的原因码和属性
+	ReasonCode byte
+	Properties *Properties
+}
+
+func (pa *PubackPacket) String() string {
+	return fmt.Sprintf("%s MessageID: %d ReasonCode: %d", pa.FixedHeader, pa.MessageID, pa.ReasonCode)
+}
+
+func (pa *PubackPacket) Write(w io.Writer) error {
+	return writeAck(&pa.FixedHeader, pa.MessageID, pa.ReasonCode, pa.Properties, w)
+}
+
+func (pa *PubackPacket) Read(b io.Reader) error {
+	var err error
+	pa.MessageID, pa.ReasonCode, pa.Properties, err = readAck(&pa.FixedHeader, b)
+	return err
+}
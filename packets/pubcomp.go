@@ -0,0 +1,29 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+//pubcomp包，qos为2的消息流程的最后一次确认
+type PubcompPacket struct {
+	FixedHeader
+	MessageID uint16
+	//mqtt 5.0的原因码和属性
+	ReasonCode byte
+	Properties *Properties
+}
+
+func (pc *PubcompPacket) String() string {
+	return fmt.Sprintf("%s MessageID: %d ReasonCode: %d", pc.FixedHeader, pc.MessageID, pc.ReasonCode)
+}
+
+func (pc *PubcompPacket) Write(w io.Writer) error {
+	return writeAck(&pc.FixedHeader, pc.MessageID, pc.ReasonCode, pc.Properties, w)
+}
+
+func (pc *PubcompPacket) Read(b io.Reader) error {
+	var err error
+	pc.MessageID, pc.ReasonCode, pc.Properties, err = readAck(&pc.FixedHeader, b)
+	return err
+}
@@ -13,6 +13,8 @@ type PublishPacket struct {
 	TopicName string
 	MessageID uint16
 	Payload   []byte
+	//mqtt 5.0的发布属性
+	Properties *Properties
 }
 
 func (p *PublishPacket) String() string {
@@ -27,6 +29,9 @@ func (p *PublishPacket) Write(w io.Writer) error {
 	if p.Qos > 0 {
 		body.Write(encodeUint16(p.MessageID))
 	}
+	if p.ProtocolVersion == MQTT5 {
+		body.Write(p.Properties.pack())
+	}
 	p.FixedHeader.RemainingLength = body.Len() + len(p.Payload)
 	packet := p.FixedHeader.pack()
 	packet.Write(body.Bytes())
@@ -36,6 +41,18 @@ func (p *PublishPacket) Write(w io.Writer) error {
 	return err
 }
 
+//编码后整个数据包的字节数，用于检查是否超过了mqtt 5.0客户端允许的最大报文长度
+func (p *PublishPacket) Size() int {
+	remaining := 2 + len(p.TopicName) + len(p.Payload)
+	if p.Qos > 0 {
+		remaining += 2
+	}
+	if p.ProtocolVersion == MQTT5 {
+		remaining += len(p.Properties.pack())
+	}
+	return 1 + len(encodeLength(remaining)) + remaining
+}
+
 // Unpack decodes the details of a ControlPacket after the fixed
 // header has been read
 func (p *PublishPacket) Read(b io.Reader) error {
@@ -55,6 +72,14 @@ func (p *PublishPacket) Read(b io.Reader) error {
 	} else {
 		payloadLength -= len(p.TopicName) + 2
 	}
+	if p.ProtocolVersion == MQTT5 {
+		p.Properties = &Properties{}
+		n, err := p.Properties.unpack(b)
+		if err != nil {
+			return err
+		}
+		payloadLength -= n
+	}
 	if payloadLength < 0 {
 		return fmt.Errorf("error unpacking publish, payload length < 0")
 	}
@@ -64,13 +89,14 @@ func (p *PublishPacket) Read(b io.Reader) error {
 	return err
 }
 
-// Copy creates a new PublishPacket with the same topic and payload
-// but an empty fixed header, useful for when you want to deliver
-// a message with different properties such as Qos but the same
-// content
+// Copy creates a new PublishPacket with the same topic, payload and
+// forwardable properties but an empty fixed header, useful for when
+// you want to deliver a message with different properties such as
+// Qos but the same content
 func (p *PublishPacket) Copy() *PublishPacket {
 	newP := NewMqttPacket(Publish).(*PublishPacket)
 	newP.TopicName = p.TopicName
 	newP.Payload = p.Payload
+	newP.Properties = p.Properties.copyForForward()
 	return newP
 }
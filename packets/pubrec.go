@@ -0,0 +1,29 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+//pubrec包，qos为2的publish包的第一次确认
+type PubrecPacket struct {
+	FixedHeader
+	MessageID uint16
+	//mqtt 5.0的原因码和属性
+	ReasonCode byte
+	Properties *Properties
+}
+
+func (pr *PubrecPacket) String() string {
+	return fmt.Sprintf("%s MessageID: %d ReasonCode: %d", pr.FixedHeader, pr.MessageID, pr.ReasonCode)
+}
+
+func (pr *PubrecPacket) Write(w io.Writer) error {
+	return writeAck(&pr.FixedHeader, pr.MessageID, pr.ReasonCode, pr.Properties, w)
+}
+
+func (pr *PubrecPacket) Read(b io.Reader) error {
+	var err error
+	pr.MessageID, pr.ReasonCode, pr.Properties, err = readAck(&pr.FixedHeader, b)
+	return err
+}
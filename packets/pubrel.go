@@ -0,0 +1,29 @@
+package packets
+
+import (
+	"fmt"
+	"io"
+)
+
+//pubrel包，对pubrec的回应，释放qos为2的消息
+type PubrelPacket struct {
+	FixedHeader
+	MessageID uint16
+	//mqtt 5.0的原因码和属性
+	ReasonCode byte
+	Properties *Properties
+}
+
+func (pr *PubrelPacket) String() string {
+	return fmt.Sprintf("%s MessageID: %d ReasonCode: %d", pr.FixedHeader, pr.MessageID, pr.ReasonCode)
+}
+
+func (pr *PubrelPacket) Write(w io.Writer) error {
+	return writeAck(&pr.FixedHeader, pr.MessageID, pr.ReasonCode, pr.Properties, w)
+}
+
+func (pr *PubrelPacket) Read(b io.Reader) error {
+	var err error
+	pr.MessageID, pr.ReasonCode, pr.Properties, err = readAck(&pr.FixedHeader, b)
+	return err
+}
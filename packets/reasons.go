@@ -0,0 +1,78 @@
+package packets
+
+// mqtt协议版本
+const (
+	MQTT31  = 3
+	MQTT311 = 4
+	MQTT5   = 5
+)
+
+// mqtt 5.0的原因码
+const (
+	ReasonSuccess                             = 0x00
+	ReasonNormalDisconnection                 = 0x00
+	ReasonGrantedQoS0                         = 0x00
+	ReasonGrantedQoS1                         = 0x01
+	ReasonGrantedQoS2                         = 0x02
+	ReasonDisconnectWithWill                  = 0x04
+	ReasonNoMatchingSubscribers               = 0x10
+	ReasonNoSubscriptionExisted               = 0x11
+	ReasonContinueAuthentication              = 0x18
+	ReasonReAuthenticate                      = 0x19
+	ReasonUnspecifiedError                    = 0x80
+	ReasonMalformedPacket                     = 0x81
+	ReasonProtocolError                       = 0x82
+	ReasonImplementationSpecificError         = 0x83
+	ReasonUnsupportedProtocolVersion          = 0x84
+	ReasonClientIdentifierNotValid            = 0x85
+	ReasonBadUserNameOrPassword               = 0x86
+	ReasonNotAuthorized                       = 0x87
+	ReasonServerUnavailable                   = 0x88
+	ReasonServerBusy                          = 0x89
+	ReasonBanned                              = 0x8A
+	ReasonServerShuttingDown                  = 0x8B
+	ReasonBadAuthenticationMethod             = 0x8C
+	ReasonKeepAliveTimeout                    = 0x8D
+	ReasonSessionTakenOver                    = 0x8E
+	ReasonTopicFilterInvalid                  = 0x8F
+	ReasonTopicNameInvalid                    = 0x90
+	ReasonPacketIdentifierInUse               = 0x91
+	ReasonPacketIdentifierNotFound            = 0x92
+	ReasonReceiveMaximumExceeded              = 0x93
+	ReasonTopicAliasInvalid                   = 0x94
+	ReasonPacketTooLarge                      = 0x95
+	ReasonMessageRateTooHigh                  = 0x96
+	ReasonQuotaExceeded                       = 0x97
+	ReasonAdministrativeAction                = 0x98
+	ReasonPayloadFormatInvalid                = 0x99
+	ReasonRetainNotSupported                  = 0x9A
+	ReasonQoSNotSupported                     = 0x9B
+	ReasonUseAnotherServer                    = 0x9C
+	ReasonServerMoved                         = 0x9D
+	ReasonSharedSubscriptionsNotSupported     = 0x9E
+	ReasonConnectionRateExceeded              = 0x9F
+	ReasonMaximumConnectTime                  = 0xA0
+	ReasonSubscriptionIdentifiersNotSupported = 0xA1
+	ReasonWildcardSubscriptionsNotSupported   = 0xA2
+)
+
+//将mqtt 3.1.1的CONNACK返回码转换为mqtt 5.0的原因码
+func ConnackReasonCode(returnCode byte) byte {
+	switch returnCode {
+	case Accepted:
+		return ReasonSuccess
+	case ErrRefusedBadProtocolVersion:
+		return ReasonUnsupportedProtocolVersion
+	case ErrRefusedIDRejected:
+		return ReasonClientIdentifierNotValid
+	case ErrRefusedServerUnavailable:
+		return ReasonServerUnavailable
+	case ErrRefusedBadUsernameOrPassword:
+		return ReasonBadUserNameOrPassword
+	case ErrRefusedNotAuthorised:
+		return ReasonNotAuthorized
+	case ErrProtocolViolation:
+		return ReasonProtocolError
+	}
+	return ReasonUnspecifiedError
+}
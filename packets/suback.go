@@ -8,8 +8,10 @@ import (
 
 type SubackPacket struct {
 	FixedHeader
-	MessageID   uint16
+	MessageID uint16
+	//mqtt 5.0中为每个topic的原因码
 	ReturnCodes []byte
+	Properties  *Properties
 }
 
 func (sa *SubackPacket) String() string {
@@ -20,6 +22,9 @@ func (sa *SubackPacket) Write(w io.Writer) error {
 	var body bytes.Buffer
 	var err error
 	body.Write(encodeUint16(sa.MessageID))
+	if sa.ProtocolVersion == MQTT5 {
+		body.Write(sa.Properties.pack())
+	}
 	body.Write(sa.ReturnCodes)
 	sa.FixedHeader.RemainingLength = body.Len()
 	packet := sa.FixedHeader.pack()
@@ -36,6 +41,12 @@ func (sa *SubackPacket) Read(b io.Reader) error {
 	if err != nil {
 		return err
 	}
+	if sa.ProtocolVersion == MQTT5 {
+		sa.Properties = &Properties{}
+		if _, err = sa.Properties.unpack(b); err != nil {
+			return err
+		}
+	}
 
 	_, err = qosBuffer.ReadFrom(b)
 	if err != nil {
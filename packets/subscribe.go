@@ -11,6 +11,20 @@ type SubscribePacket struct {
 	MessageID uint16
 	Topics    []string
 	Qoss      []byte
+	//mqtt 5.0的订阅属性以及每个topic的订阅选项
+	Properties *Properties
+	Options    []SubOptions
+}
+
+//mqtt 5.0的订阅选项，qos仍然保存在Qoss中
+type SubOptions struct {
+	NoLocal           bool
+	RetainAsPublished bool
+	RetainHandling    byte
+}
+
+func (o SubOptions) pack(qos byte) byte {
+	return qos | boolToByte(o.NoLocal)<<2 | boolToByte(o.RetainAsPublished)<<3 | o.RetainHandling<<4
 }
 
 func (s *SubscribePacket) String() string {
@@ -22,9 +36,16 @@ func (s *SubscribePacket) Write(w io.Writer) error {
 	var err error
 
 	body.Write(encodeUint16(s.MessageID))
+	if s.ProtocolVersion == MQTT5 {
+		body.Write(s.Properties.pack())
+	}
 	for i, topic := range s.Topics {
 		body.Write(encodeString(topic))
-		body.WriteByte(s.Qoss[i])
+		if s.ProtocolVersion == MQTT5 && i < len(s.Options) {
+			body.WriteByte(s.Options[i].pack(s.Qoss[i]))
+		} else {
+			body.WriteByte(s.Qoss[i])
+		}
 	}
 	s.FixedHeader.RemainingLength = body.Len()
 	packet := s.FixedHeader.pack()
@@ -41,17 +62,34 @@ func (s *SubscribePacket) Read(b io.Reader) error {
 		return err
 	}
 	payloadLength := s.FixedHeader.RemainingLength - 2
+	if s.ProtocolVersion == MQTT5 {
+		s.Properties = &Properties{}
+		n, err := s.Properties.unpack(b)
+		if err != nil {
+			return err
+		}
+		payloadLength -= n
+	}
 	for payloadLength > 0 {
 		topic, err := decodeString(b)
 		if err != nil {
 			return err
 		}
 		s.Topics = append(s.Topics, topic)
-		qos, err := decodeByte(b)
+		options, err := decodeByte(b)
 		if err != nil {
 			return err
 		}
-		s.Qoss = append(s.Qoss, qos)
+		if s.ProtocolVersion == MQTT5 {
+			s.Qoss = append(s.Qoss, options&0x03)
+			s.Options = append(s.Options, SubOptions{
+				NoLocal:           options&0x04 > 0,
+				RetainAsPublished: options&0x08 > 0,
+				RetainHandling:    (options >> 4) & 0x03,
+			})
+		} else {
+			s.Qoss = append(s.Qoss, options)
+		}
 		payloadLength -= 2 + len(topic) + 1 // 2 bytes of string length, plus string, plus 1 byte for Qos
 	}
 
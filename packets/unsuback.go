@@ -1,6 +1,7 @@
 package packets
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 )
@@ -8,6 +9,9 @@ import (
 type UnsubackPacket struct {
 	FixedHeader
 	MessageID uint16
+	//mqtt 5.0的属性以及每个topic的原因码
+	Properties  *Properties
+	ReasonCodes []byte
 }
 
 func (ua *UnsubackPacket) String() string {
@@ -15,10 +19,16 @@ func (ua *UnsubackPacket) String() string {
 }
 
 func (ua *UnsubackPacket) Write(w io.Writer) error {
+	var body bytes.Buffer
 	var err error
-	ua.FixedHeader.RemainingLength = 2
+	body.Write(encodeUint16(ua.MessageID))
+	if ua.ProtocolVersion == MQTT5 {
+		body.Write(ua.Properties.pack())
+		body.Write(ua.ReasonCodes)
+	}
+	ua.FixedHeader.RemainingLength = body.Len()
 	packet := ua.FixedHeader.pack()
-	packet.Write(encodeUint16(ua.MessageID))
+	packet.Write(body.Bytes())
 	_, err = packet.WriteTo(w)
 
 	return err
@@ -27,5 +37,13 @@ func (ua *UnsubackPacket) Write(w io.Writer) error {
 func (ua *UnsubackPacket) Read(b io.Reader) error {
 	var err error
 	ua.MessageID, err = decodeUint16(b)
+	if err != nil || ua.ProtocolVersion != MQTT5 {
+		return err
+	}
+	ua.Properties = &Properties{}
+	if _, err = ua.Properties.unpack(b); err != nil {
+		return err
+	}
+	ua.ReasonCodes, err = io.ReadAll(b)
 	return err
 }
@@ -10,6 +10,8 @@ type UnsubscribePacket struct {
 	FixedHeader
 	MessageID uint16
 	Topics    []string
+	//mqtt 5.0的属性
+	Properties *Properties
 }
 
 func (u *UnsubscribePacket) String() string {
@@ -20,6 +22,9 @@ func (u *UnsubscribePacket) Write(w io.Writer) error {
 	var body bytes.Buffer
 	var err error
 	body.Write(encodeUint16(u.MessageID))
+	if u.ProtocolVersion == MQTT5 {
+		body.Write(u.Properties.pack())
+	}
 	for _, topic := range u.Topics {
 		body.Write(encodeString(topic))
 	}
@@ -36,6 +41,12 @@ func (u *UnsubscribePacket) Read(b io.Reader) error {
 	if err != nil {
 		return err
 	}
+	if u.ProtocolVersion == MQTT5 {
+		u.Properties = &Properties{}
+		if _, err = u.Properties.unpack(b); err != nil {
+			return err
+		}
+	}
 
 	for topic, err := decodeString(b); err == nil && topic != ""; topic, err = decodeString(b) {
 		u.Topics = append(u.Topics, topic)
@@ -0,0 +1,66 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/event"
+	"github.com/davidfantasy/embedded-mqtt-broker/packets"
+	"github.com/davidfantasy/embedded-mqtt-broker/trie"
+)
+
+//发布消息时指定的qos不合法
+var ErrInvalidQos = errors.New("qos must be 0, 1 or 2")
+
+//由嵌入的应用程序在进程内发布的消息
+type Message struct {
+	Topic   string
+	Payload []byte
+	Qos     byte
+	Retain  bool
+	//mqtt 5.0的属性，例如ContentType、ResponseTopic和用户属性，只会转发给mqtt 5.0的订阅者
+	Properties *packets.Properties
+}
+
+//在进程内发布一条消息，与客户端发布的消息一样会保存保留消息并按照订阅的qos投递给所有匹配的订阅者，
+//payload在调用后不应再被修改。topic或qos不合法、服务已关闭以及部分订阅者投递失败时返回错误，
+//钩子将消息修改成不合法的消息时返回ErrInvalidHookMessage
+func (s *MqttServer) Publish(topic string, payload []byte, qos byte, retain bool) error {
+	return s.PublishMessage(&Message{Topic: topic, Payload: payload, Qos: qos, Retain: retain})
+}
+
+//与Publish相同，可以同时指定mqtt 5.0的属性
+func (s *MqttServer) PublishMessage(msg *Message) error {
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+	if err := trie.ValidateTopicName(msg.Topic); err != nil {
+		return fmt.Errorf("invalid publish topic %q:%w", msg.Topic, err)
+	}
+	if msg.Qos > 2 {
+		return ErrInvalidQos
+	}
+	packet := packets.NewMqttPacket(packets.Publish).(*packets.PublishPacket)
+	packet.TopicName = msg.Topic
+	packet.Payload = msg.Payload
+	packet.Qos = msg.Qos
+	packet.Retain = msg.Retain
+	packet.Properties = msg.Properties
+	packet, err := s.onPublish(nil, packet)
+	if err != nil {
+		return err
+	}
+	if packet == nil {
+		return nil
+	}
+	s.publishEvent(newMessagePublished("", packet))
+	return s.forwardMessage(packet, "", "")
+}
+
+func newMessagePublished(clientId string, packet *packets.PublishPacket) *event.MessagePublished {
+	return &event.MessagePublished{ClientId: clientId, Topic: packet.TopicName, Payload: packet.Payload, Qos: packet.Qos, Retain: packet.Retain}
+}
+
+func newMessage(packet *packets.PublishPacket, qos byte, retain bool) *Message {
+	return &Message{Topic: packet.TopicName, Payload: packet.Payload, Qos: qos, Retain: retain, Properties: packet.Copy().Properties}
+}
@@ -0,0 +1,68 @@
+package mqtt
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/client"
+	"github.com/davidfantasy/embedded-mqtt-broker/config"
+	"github.com/davidfantasy/embedded-mqtt-broker/packets"
+	"github.com/davidfantasy/embedded-mqtt-broker/trie"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublish(t *testing.T) {
+	server := newTestServer()
+	//没有订阅者时同样会保存保留消息
+	assert.NoError(t, server.Publish("publish/a", []byte("retained"), 1, true))
+	sub := connectTestClient(t, server, "publish-sub", true)
+	defer sub.Close()
+	subscribeTestTopic(t, sub, "publish/+", 1)
+	received, ok := readTestPacket(t, sub).(*packets.PublishPacket)
+	assert.True(t, ok)
+	assert.True(t, received.Retain)
+	assert.Equal(t, []byte("retained"), received.Payload)
+	ack := packets.NewMqttPacket(packets.Puback).(*packets.PubackPacket)
+	ack.MessageID = received.MessageID
+	assert.NoError(t, ack.Write(sub))
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Publish("publish/b", []byte("hello"), 2, false)
+	}()
+	received, ok = readTestPacket(t, sub).(*packets.PublishPacket)
+	assert.True(t, ok)
+	assert.NoError(t, <-errCh)
+	assert.Equal(t, "publish/b", received.TopicName)
+	//投递的qos取发布qos与订阅qos中较小的一个
+	assert.Equal(t, byte(1), received.Qos)
+	assert.False(t, received.Retain)
+	assert.Equal(t, []byte("hello"), received.Payload)
+	ack.MessageID = received.MessageID
+	assert.NoError(t, ack.Write(sub))
+
+	assert.ErrorIs(t, server.Publish("publish/+", nil, 0, false), trie.ErrWildcardInTopicName)
+	assert.ErrorIs(t, server.Publish("publish/a", nil, 3, false), ErrInvalidQos)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	server.Shutdown(ctx)
+	assert.ErrorIs(t, server.Publish("publish/a", nil, 0, false), ErrServerClosed)
+}
+
+func TestPublishQueueFull(t *testing.T) {
+	conf := config.NewDefaultConfig()
+	conf.MaxQueuedMessages = 1
+	conf.QueueOverflowPolicy = config.RejectNew
+	server := NewMqttServer(conf)
+	sub := connectTestClient(t, server, "publish-offline", false)
+	subscribeTestTopic(t, sub, "publish/offline", 1)
+	assert.NoError(t, packets.NewMqttPacket(packets.Disconnect).Write(sub))
+	sub.Close()
+	assert.Eventually(t, func() bool {
+		return server.clients.FindClient("publish-offline") == nil
+	}, time.Second, 10*time.Millisecond)
+	assert.NoError(t, server.Publish("publish/offline", []byte("1"), 1, false))
+	//离线队列已满时返回投递失败的错误
+	assert.ErrorIs(t, server.Publish("publish/offline", []byte("2"), 1, false), client.ErrQueueFull)
+}
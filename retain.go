@@ -0,0 +1,56 @@
+package mqtt
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/consts"
+	"github.com/davidfantasy/embedded-mqtt-broker/packets"
+	"github.com/davidfantasy/embedded-mqtt-broker/trie"
+)
+
+//保存一个服务端实例的所有保留消息
+type retainStore struct {
+	mu sync.RWMutex
+	//每个topic最后一条保留消息
+	messages map[string]*packets.PublishPacket
+}
+
+func newRetainStore() *retainStore {
+	return &retainStore{messages: make(map[string]*packets.PublishPacket)}
+}
+
+//保存一条保留消息，payload为空时删除该topic的保留消息
+func (rs *retainStore) RetainMessage(packet *packets.PublishPacket) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if len(packet.Payload) == 0 {
+		delete(rs.messages, packet.TopicName)
+		return
+	}
+	msg := packet.Copy()
+	msg.Qos = packet.Qos
+	msg.Retain = true
+	rs.messages[packet.TopicName] = msg
+}
+
+//找到与订阅的topic过滤器相匹配的所有保留消息，按topic排序
+func (rs *retainStore) GetRetainedMessages(filter string) []*packets.PublishPacket {
+	if len(filter) == 0 {
+		return nil
+	}
+	filterParts := strings.Split(filter, consts.TOPIC_PART_SPLITTER)
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	var messages []*packets.PublishPacket
+	for topic, msg := range rs.messages {
+		if trie.IsMatched(filterParts, strings.Split(topic, consts.TOPIC_PART_SPLITTER)) {
+			messages = append(messages, msg)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].TopicName < messages[j].TopicName
+	})
+	return messages
+}
@@ -1,6 +1,7 @@
 package security
 
 import (
+	"crypto/x509"
 	"strings"
 
 	"github.com/davidfantasy/embedded-mqtt-broker/consts"
@@ -13,6 +14,12 @@ type AuthenticationProvider interface {
 	Authenticate(username, password string) *Authentication
 }
 
+//支持客户端证书认证的权限认证器，AuthenticationProvider同时实现了该接口时，TLS连接会优先使用该接口进行认证
+type CertificateAuthenticationProvider interface {
+	//根据已通过校验的客户端证书返回授权信息，客户端没有提供证书时cert为nil
+	AuthenticateCertificate(cert *x509.Certificate, username, password string) *Authentication
+}
+
 type Authentication struct {
 	authTopicTrie trie.TopicTrie
 	acls          []Acl
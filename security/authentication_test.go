@@ -68,3 +68,11 @@ func TestDefaultAuthenticationProvider(t *testing.T) {
 		t.Errorf("expected Authenticate to return nil authentication for invalid password")
 	}
 }
+
+func TestSystemTopicAuth(t *testing.T) {
+	//授予#权限的用户同样可以订阅$SYS下的统计信息
+	auth := NewAuthentication([]Acl{{"#", CanSubPub}})
+	if !auth.CanSub("$SYS/broker/uptime") {
+		t.Errorf("expected canSub true for $SYS topic")
+	}
+}
@@ -1,75 +1,216 @@
 package mqtt
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/davidfantasy/embedded-mqtt-broker/client"
 	"github.com/davidfantasy/embedded-mqtt-broker/config"
+	"github.com/davidfantasy/embedded-mqtt-broker/event"
 	"github.com/davidfantasy/embedded-mqtt-broker/logger"
 	"github.com/davidfantasy/embedded-mqtt-broker/packets"
 	"github.com/davidfantasy/embedded-mqtt-broker/security"
+	"github.com/davidfantasy/embedded-mqtt-broker/trie"
 )
 
 type MqttServer struct {
 	config                 *config.ServerConfig
 	authenticationProvider security.AuthenticationProvider
+	stats                  *brokerStats
+	//服务端实例持有的全部状态，不同实例之间互不影响
+	eventBus      *event.AsyncEventBus
+	clients       *client.Registry
+	subscriptions *subscriptionStore
+	retained      *retainStore
+	//用于生成进程内订阅者的sessionId
+	localSeq int64
+	//生命周期钩子
+	hooks   []Hook
+	hooksMu sync.RWMutex
+	//从文件加载的TLS证书，Serve和ReloadCertificate可能并发访问
+	certReloaders   []*certReloader
+	certReloadersMu sync.Mutex
+	//保证$SYS统计信息的发布协程只启动一次
+	sysOnce sync.Once
+	//正在运行的监听和websocket服务，以及所有已接入的连接，关闭服务时需要逐一停止
+	mu          sync.Mutex
+	listeners   map[net.Listener]struct{}
+	httpServers map[*http.Server]struct{}
+	//连接对应的消息处理器，连接还未完成握手时为nil
+	conns map[net.Conn]*MessageHandler
+	//服务是否正在关闭或已经关闭
+	inShutdown   int32
+	shutdownOnce sync.Once
+	//服务关闭时关闭，用于通知后台协程退出
+	done chan struct{}
 }
 
 func NewMqttServer(config *config.ServerConfig) *MqttServer {
-	return &MqttServer{config: config}
+	eventBus := event.NewEventBus(config.EventBus)
+	clients := client.NewRegistry(config, eventBus)
+	s := &MqttServer{
+		config:        config,
+		stats:         newBrokerStats(),
+		eventBus:      eventBus,
+		clients:       clients,
+		subscriptions: newSubscriptionStore(clients),
+		retained:      newRetainStore(),
+		listeners:     make(map[net.Listener]struct{}),
+		httpServers:   make(map[*http.Server]struct{}),
+		conns:         make(map[net.Conn]*MessageHandler),
+		done:          make(chan struct{}),
+	}
+	//会话过期后清除其所有订阅
+	event.On(eventBus, func(e *event.SessionExpired) {
+		s.subscriptions.UnsubscribeAll(e.SessionId)
+	})
+	clients.StartSessionSweeper()
+	return s
+}
+
+//服务端实例的事件总线，可以订阅客户端上下线、会话、订阅和消息等事件，
+//使用event.On可以直接收到类型化的事件数据
+func (s *MqttServer) EventBus() event.EventBus {
+	return s.eventBus
+}
+
+func (s *MqttServer) publishEvent(data event.Payload) {
+	s.eventBus.Publish(event.NewEvent(data))
 }
 
 func (server *MqttServer) SetAuthProvider(authProvider security.AuthenticationProvider) {
 	server.authenticationProvider = authProvider
 }
 
-//启动mqtt broker
+//启动mqtt broker，会阻塞直到所有监听都退出，启动失败时只会记录日志
+//
+//Deprecated: 使用ListenAndServe，可以获取启动失败的错误
 func (s *MqttServer) Startup() {
-	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%v", s.config.Address, s.config.Port))
-	if err != nil {
-		logger.ERROR.Println("mqtt server start failed:", err)
-		return
+	if err := s.ListenAndServe(); err != nil {
+		logger.ERROR.Println("mqtt server stopped:", err)
 	}
-	logger.INFO.Printf("Listening and serving mqtt on: %s:%v", s.config.Address, s.config.Port)
-	for {
-		conn, err := listener.Accept()
+}
+
+//按照配置启动所有监听并阻塞处理客户端连接，任意一个监听启动失败时返回错误，
+//运行中任意一个监听退出时会关闭其它监听并返回该监听的错误
+func (s *MqttServer) ListenAndServe() error {
+	confs := s.config.ListenerConfigs()
+	if len(confs) == 0 {
+		return errors.New("no listener configured")
+	}
+	listeners := make([]*listener, 0, len(confs))
+	lns := make([]net.Listener, 0, len(confs))
+	for _, conf := range confs {
+		l := newListener(conf)
+		ln, err := s.listen(l)
 		if err != nil {
-			logger.ERROR.Println("Accept client connection failed:", err)
-			continue
+			for _, opened := range lns {
+				opened.Close()
+			}
+			return fmt.Errorf("listener %s start failed:%w", conf.Name, err)
 		}
-		go processNewConn(conn, s)
+		logger.INFO.Printf("Listening and serving mqtt on: %s [%s/%s]", ln.Addr(), conf.Name, conf.Type)
+		listeners = append(listeners, l)
+		lns = append(lns, ln)
+	}
+	errCh := make(chan error, len(lns))
+	for i := range lns {
+		go func(ln net.Listener, l *listener) {
+			errCh <- s.serve(ln, l)
+		}(lns[i], listeners[i])
+	}
+	err := <-errCh
+	for _, ln := range lns {
+		ln.Close()
+	}
+	for i := 1; i < len(lns); i++ {
+		<-errCh
 	}
+	return err
 }
 
-func processNewConn(conn net.Conn, server *MqttServer) {
+//在调用方提供的net.Listener上处理mqtt客户端连接，会阻塞直到监听被关闭，
+//可用于systemd的socket激活或对listener进行包装（限流、PROXY协议等）
+func (s *MqttServer) Serve(ln net.Listener) error {
+	return s.ServeListener(ln, &config.ListenerConfig{Name: ln.Addr().Network(), Type: config.ListenerTCP})
+}
+
+//与Serve相同，但是使用指定的监听配置，conf.Address和conf.TLS中的证书配置不会生效
+func (s *MqttServer) ServeListener(ln net.Listener, conf *config.ListenerConfig) error {
+	return s.serve(ln, newListener(conf))
+}
+
+func processNewConn(conn net.Conn, server *MqttServer, l *listener) {
+	if !server.trackConn(conn, nil) {
+		//服务正在关闭，不再接受新的连接
+		conn.Close()
+		return
+	}
+	var c *client.Client
+	var err error
 	defer func() {
 		if err := recover(); err != nil {
 			s := string(debug.Stack())
 			logger.ERROR.Printf("connection panic:%v,%v", err, s)
 		}
+		//没有收到DISCONNECT就断开的连接需要发布遗嘱消息，服务关闭导致的断开不发布遗嘱
+		if c != nil {
+			server.clients.CloseClient(c)
+			if !server.shuttingDown() {
+				server.publishWill(c)
+			}
+			server.subscriptions.forgetPublisher(c.Id)
+			l.release()
+			//服务端主动断开时以断开的原因为准
+			if reason := c.DisconnectReason(); reason != nil {
+				err = reason
+			}
+			server.onDisconnect(c, err)
+			server.publishEvent(&event.ClientDisconnected{ClientId: c.Id, RemoteAddr: c.RemoteAddr(), Listener: c.Listener, Reason: err})
+		}
 		conn.Close()
+		server.untrackConn(conn)
 	}()
 	//mqtt connect handshake
-	c, err := acceptMqttConnect(conn, server)
+	c, err = acceptMqttConnect(newStatsConn(conn, server.stats), server, l)
 	if err != nil {
 		logger.ERROR.Println("mqtt connect err:", err)
-		conn.Close()
+		return
+	}
+	if c == nil {
+		//连接被拒绝，CONNACK已经发送
+		return
 	}
 	logger.DEBUG.Println("new client connected:", c.Id)
-	msgHandler := NewMessageHandler(c)
+	atomic.AddInt64(&server.stats.connectionsTotal, 1)
+	server.publishEvent(&event.ClientConnected{
+		ClientId:        c.Id,
+		Username:        c.Username,
+		RemoteAddr:      c.RemoteAddr(),
+		Listener:        c.Listener,
+		ProtocolVersion: c.ProtocolVersion,
+		CleanSession:    c.CleanSession,
+		Keepalive:       c.Keepalive,
+	})
+	//恢复会话后未被确认的消息已经随CONNACK重发，这里投递离线期间缓存的消息
+	c.DeliverQueued()
+	msgHandler := NewMessageHandler(c, server)
+	server.trackConn(conn, msgHandler)
 	err = msgHandler.HandleMessage()
 	if err != nil {
 		logger.ERROR.Println("handle connection message err:", err)
 	}
-	//关闭消息处理器和客户端
+	//关闭消息处理器，客户端会在defer中关闭
 	msgHandler.close()
-	client.CloseClient(c)
 }
 
-func acceptMqttConnect(conn net.Conn, server *MqttServer) (*client.Client, error) {
+func acceptMqttConnect(conn net.Conn, server *MqttServer, l *listener) (*client.Client, error) {
 	//设置读取超时时间，如果超时时间内还没有收到connect的包，则返回错误
 	err := conn.SetReadDeadline(time.Now().Add(10 * time.Second))
 	if err != nil {
@@ -82,6 +223,7 @@ func acceptMqttConnect(conn net.Conn, server *MqttServer) (*client.Client, error
 	if packet == nil {
 		return nil, fmt.Errorf("received nil packet")
 	}
+	server.stats.packetReceived(packet)
 	cp, ok := packet.(*packets.ConnectPacket)
 	if !ok {
 		return nil, fmt.Errorf("non-CONNECT first packet received:%s", packet.String())
@@ -94,29 +236,115 @@ func acceptMqttConnect(conn net.Conn, server *MqttServer) (*client.Client, error
 	//验证连接报文
 	var returnCode byte = cp.Validate()
 	var authentication *security.Authentication
+	if returnCode == packets.Accepted && cp.WillFlag && trie.ValidateTopicName(cp.WillTopic) != nil {
+		//遗嘱消息的topic同样需要符合topic名称的规范
+		returnCode = packets.ErrProtocolViolation
+	}
+	if returnCode == packets.Accepted && cp.Properties != nil && len(cp.Properties.AuthMethod) != 0 {
+		//暂不支持mqtt 5.0的增强认证
+		returnCode = packets.ReasonBadAuthenticationMethod
+	}
+	if returnCode == packets.Accepted {
+		returnCode = server.onConnect(conn, cp)
+	}
+	requestedClientId := cp.ClientId
+	tlsState := tlsConnectionState(conn)
+	peerCert := verifiedPeerCertificate(tlsState)
+	if returnCode == packets.Accepted && !l.config.AllowProtocolVersion(cp.ProtocolVersion) {
+		logger.WARN.Printf("protocol version %d is not allowed on listener %s", cp.ProtocolVersion, l.config.Name)
+		returnCode = packets.ErrRefusedBadProtocolVersion
+	}
+	if returnCode == packets.Accepted && tlsState != nil && l.certIdentity() != config.CertIdentityNone {
+		//使用客户端证书中的身份信息作为用户名和clientId
+		identity := certificateIdentity(peerCert, l.certIdentity())
+		if len(identity) == 0 {
+			logger.WARN.Println("no identity found in client certificate,remote address:", conn.RemoteAddr())
+			returnCode = packets.ErrRefusedNotAuthorised
+		} else {
+			cp.Username = identity
+			cp.UsernameFlag = true
+			cp.ClientId = identity
+		}
+	}
 	if returnCode == packets.Accepted {
 		//验证用户权限
-		if server.authenticationProvider != nil {
-			authProvider := server.authenticationProvider
-			authentication = authProvider.Authenticate(cp.Username, string(cp.Password))
+		if authProvider := l.authProvider(server); authProvider != nil {
+			if certAuthProvider, ok := authProvider.(security.CertificateAuthenticationProvider); ok && tlsState != nil {
+				authentication = certAuthProvider.AuthenticateCertificate(peerCert, cp.Username, string(cp.Password))
+			} else {
+				authentication = authProvider.Authenticate(cp.Username, string(cp.Password))
+			}
 			if authentication == nil {
 				returnCode = packets.ErrRefusedBadUsernameOrPassword
 			}
 		}
 	}
-	cap := packets.NewMqttPacket(packets.Connack).(*packets.ConnackPacket)
+	if returnCode == packets.Accepted && !server.onConnectAuthenticate(cp, authentication) {
+		returnCode = packets.ErrRefusedBadUsernameOrPassword
+	}
+	if returnCode == packets.Accepted && !l.acquire() {
+		logger.WARN.Printf("listener %s has reached the max connections:%d", l.config.Name, l.config.MaxConnections)
+		returnCode = packets.ErrRefusedServerUnavailable
+	}
+	if returnCode == packets.ErrRefusedBadUsernameOrPassword || returnCode == packets.ErrRefusedNotAuthorised {
+		server.publishEvent(&event.AuthFailed{ClientId: cp.ClientId, Username: cp.Username, RemoteAddr: conn.RemoteAddr().String(), Listener: l.config.Name, ReturnCode: returnCode})
+	}
+	//不支持的协议版本按照mqtt 3.1.1的格式回复
+	var version byte = packets.MQTT311
+	if cp.ProtocolVersion == packets.MQTT5 {
+		version = packets.MQTT5
+	}
+	cap := packets.NewMqttPacketWithVersion(packets.Connack, version).(*packets.ConnackPacket)
 	cap.ReturnCode = returnCode
 	var c *client.Client
-	if cap.ReturnCode != packets.Accepted {
+	if returnCode != packets.Accepted {
 		cap.SessionPresent = false
 	} else {
 		var sessionPresent bool
-		c, sessionPresent = client.NewClient(cp, conn, authentication, server.config)
+		c, sessionPresent = server.clients.NewClient(cp, conn, authentication, l.config.Name)
 		cap.SessionPresent = sessionPresent
 	}
-	err = cap.Write(conn)
+	if version == packets.MQTT5 {
+		if returnCode != packets.ReasonBadAuthenticationMethod {
+			cap.ReturnCode = packets.ConnackReasonCode(returnCode)
+		}
+		if c != nil {
+			cap.Properties = connackProperties(cp, c, requestedClientId)
+		}
+	}
+	if cap.ReturnCode != packets.Accepted {
+		atomic.AddInt64(&server.stats.connackRefused[cap.ReturnCode], 1)
+	}
+	if c != nil {
+		err = c.SendConnack(cap)
+	} else {
+		err = cap.Write(conn)
+	}
 	if err != nil {
+		//客户端已经注册并占用了监听的连接数，CONNACK发送失败时需要注销客户端并释放名额，不发布遗嘱
+		if c != nil {
+			c.ClearWill()
+			server.clients.CloseClient(c)
+			l.release()
+		}
 		return nil, err
 	}
 	return c, nil
 }
+
+//mqtt 5.0的CONNACK中告知客户端服务端的能力以及实际生效的连接参数
+func connackProperties(cp *packets.ConnectPacket, c *client.Client, requestedClientId string) *packets.Properties {
+	var unavailable byte = 0
+	props := &packets.Properties{SubIDAvailable: &unavailable}
+	//clientId由服务端分配或者被替换为证书中的身份信息时，需要告知客户端
+	if c.Id != requestedClientId {
+		props.AssignedClientID = c.Id
+	}
+	if cp.Properties != nil && cp.Properties.SessionExpiryInterval != nil {
+		expiry := uint32(c.SessionExpiryInterval / time.Second)
+		if expiry != *cp.Properties.SessionExpiryInterval {
+			props.SessionExpiryInterval = &expiry
+		}
+	}
+	return props
+}
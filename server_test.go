@@ -0,0 +1,628 @@
+package mqtt
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/config"
+	"github.com/davidfantasy/embedded-mqtt-broker/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+//测试中通过内存管道接入的客户端使用的监听
+var testListener = newListener(&config.ListenerConfig{Name: "test", Type: config.ListenerTCP})
+
+func newTestServer() *MqttServer {
+	config := config.NewDefaultConfig()
+	config.InflightRetryInterval = 100 * time.Millisecond
+	return NewMqttServer(config)
+}
+
+func newTestConnectPacket(clientId string, cleanSession bool) *packets.ConnectPacket {
+	cp := packets.NewMqttPacket(packets.Connect).(*packets.ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = 4
+	cp.ClientId = clientId
+	cp.CleanSession = cleanSession
+	return cp
+}
+
+//通过内存管道建立一个已完成mqtt握手的客户端连接
+func connectTestClient(t *testing.T, server *MqttServer, clientId string, cleanSession bool) net.Conn {
+	return connectTestClientWith(t, server, newTestConnectPacket(clientId, cleanSession))
+}
+
+func connectTestClientWith(t *testing.T, server *MqttServer, cp *packets.ConnectPacket) net.Conn {
+	serverConn, clientConn := net.Pipe()
+	go processNewConn(serverConn, server, testListener)
+	assert.NoError(t, cp.Write(clientConn))
+	connack, ok := readTestPacketWithVersion(t, clientConn, cp.ProtocolVersion).(*packets.ConnackPacket)
+	assert.True(t, ok)
+	assert.Equal(t, byte(packets.Accepted), connack.ReturnCode)
+	return clientConn
+}
+
+func readTestPacket(t *testing.T, conn net.Conn) packets.MqttPacket {
+	return readTestPacketWithVersion(t, conn, packets.MQTT311)
+}
+
+func readTestPacketWithVersion(t *testing.T, conn net.Conn, version byte) packets.MqttPacket {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	packet, err := packets.ReadPacketWithVersion(conn, version)
+	assert.NoError(t, err)
+	return packet
+}
+
+func subscribeTestTopic(t *testing.T, conn net.Conn, topic string, qos byte) {
+	sp := packets.NewMqttPacket(packets.Subscribe).(*packets.SubscribePacket)
+	sp.Qos = 1
+	sp.MessageID = 1
+	sp.Topics = []string{topic}
+	sp.Qoss = []byte{qos}
+	assert.NoError(t, sp.Write(conn))
+	suback, ok := readTestPacket(t, conn).(*packets.SubackPacket)
+	assert.True(t, ok)
+	assert.Equal(t, []byte{qos}, suback.ReturnCodes)
+}
+
+func TestQos1Delivery(t *testing.T) {
+	server := newTestServer()
+	sub := connectTestClient(t, server, "qos1-sub", true)
+	defer sub.Close()
+	pub := connectTestClient(t, server, "qos1-pub", true)
+	defer pub.Close()
+	subscribeTestTopic(t, sub, "qos1/test", 1)
+
+	pp := packets.NewMqttPacket(packets.Publish).(*packets.PublishPacket)
+	pp.Qos = 1
+	pp.MessageID = 10
+	pp.TopicName = "qos1/test"
+	pp.Payload = []byte("hello")
+	assert.NoError(t, pp.Write(pub))
+	puback, ok := readTestPacket(t, pub).(*packets.PubackPacket)
+	assert.True(t, ok)
+	assert.Equal(t, uint16(10), puback.MessageID)
+
+	received, ok := readTestPacket(t, sub).(*packets.PublishPacket)
+	assert.True(t, ok)
+	assert.Equal(t, byte(1), received.Qos)
+	assert.False(t, received.Dup)
+	assert.Equal(t, []byte("hello"), received.Payload)
+	//不发送确认，消息应当在超时后带DUP标志重发
+	resent, ok := readTestPacket(t, sub).(*packets.PublishPacket)
+	assert.True(t, ok)
+	assert.True(t, resent.Dup)
+	assert.Equal(t, received.MessageID, resent.MessageID)
+	ack := packets.NewMqttPacket(packets.Puback).(*packets.PubackPacket)
+	ack.MessageID = resent.MessageID
+	assert.NoError(t, ack.Write(sub))
+}
+
+func TestDeliverWithSubscriptionQos(t *testing.T) {
+	server := newTestServer()
+	sub := connectTestClient(t, server, "qos0-sub", true)
+	defer sub.Close()
+	pub := connectTestClient(t, server, "qos0-pub", true)
+	defer pub.Close()
+	subscribeTestTopic(t, sub, "qos0/test", 0)
+
+	pp := packets.NewMqttPacket(packets.Publish).(*packets.PublishPacket)
+	pp.Qos = 1
+	pp.MessageID = 1
+	pp.TopicName = "qos0/test"
+	pp.Payload = []byte("hello")
+	assert.NoError(t, pp.Write(pub))
+	_, ok := readTestPacket(t, pub).(*packets.PubackPacket)
+	assert.True(t, ok)
+	received, ok := readTestPacket(t, sub).(*packets.PublishPacket)
+	assert.True(t, ok)
+	assert.Equal(t, byte(0), received.Qos)
+}
+
+func TestQos2Delivery(t *testing.T) {
+	server := newTestServer()
+	sub := connectTestClient(t, server, "qos2-sub", true)
+	defer sub.Close()
+	pub := connectTestClient(t, server, "qos2-pub", true)
+	defer pub.Close()
+	subscribeTestTopic(t, sub, "qos2/test", 2)
+
+	pp := packets.NewMqttPacket(packets.Publish).(*packets.PublishPacket)
+	pp.Qos = 2
+	pp.MessageID = 7
+	pp.TopicName = "qos2/test"
+	pp.Payload = []byte("first")
+	assert.NoError(t, pp.Write(pub))
+	pubrec, ok := readTestPacket(t, pub).(*packets.PubrecPacket)
+	assert.True(t, ok)
+	assert.Equal(t, uint16(7), pubrec.MessageID)
+	//在PUBREL之前重复发送同一条消息，不应被再次转发
+	pp.Dup = true
+	assert.NoError(t, pp.Write(pub))
+	_, ok = readTestPacket(t, pub).(*packets.PubrecPacket)
+	assert.True(t, ok)
+	pubrel := packets.NewMqttPacket(packets.Pubrel).(*packets.PubrelPacket)
+	pubrel.MessageID = 7
+	assert.NoError(t, pubrel.Write(pub))
+	pubcomp, ok := readTestPacket(t, pub).(*packets.PubcompPacket)
+	assert.True(t, ok)
+	assert.Equal(t, uint16(7), pubcomp.MessageID)
+
+	received, ok := readTestPacket(t, sub).(*packets.PublishPacket)
+	assert.True(t, ok)
+	assert.Equal(t, byte(2), received.Qos)
+	assert.Equal(t, []byte("first"), received.Payload)
+	rec := packets.NewMqttPacket(packets.Pubrec).(*packets.PubrecPacket)
+	rec.MessageID = received.MessageID
+	assert.NoError(t, rec.Write(sub))
+	rel, ok := readTestPacket(t, sub).(*packets.PubrelPacket)
+	assert.True(t, ok)
+	assert.Equal(t, received.MessageID, rel.MessageID)
+	//未收到PUBCOMP时应当重发PUBREL而不是PUBLISH
+	rel, ok = readTestPacket(t, sub).(*packets.PubrelPacket)
+	assert.True(t, ok)
+	assert.Equal(t, received.MessageID, rel.MessageID)
+	comp := packets.NewMqttPacket(packets.Pubcomp).(*packets.PubcompPacket)
+	comp.MessageID = received.MessageID
+	assert.NoError(t, comp.Write(sub))
+}
+
+func TestRetainedMessage(t *testing.T) {
+	server := newTestServer()
+	pub := connectTestClient(t, server, "retain-pub", true)
+	defer pub.Close()
+	pp := packets.NewMqttPacket(packets.Publish).(*packets.PublishPacket)
+	pp.Qos = 1
+	pp.MessageID = 1
+	pp.Retain = true
+	pp.TopicName = "retain/config"
+	pp.Payload = []byte("v1")
+	assert.NoError(t, pp.Write(pub))
+	_, ok := readTestPacket(t, pub).(*packets.PubackPacket)
+	assert.True(t, ok)
+
+	sub := connectTestClient(t, server, "retain-sub", true)
+	defer sub.Close()
+	assert.Eventually(t, func() bool {
+		return len(server.retained.GetRetainedMessages("retain/#")) == 1
+	}, time.Second, 10*time.Millisecond)
+	subscribeTestTopic(t, sub, "retain/+", 0)
+	received, ok := readTestPacket(t, sub).(*packets.PublishPacket)
+	assert.True(t, ok)
+	assert.True(t, received.Retain)
+	assert.Equal(t, byte(0), received.Qos)
+	assert.Equal(t, []byte("v1"), received.Payload)
+
+	//空payload的保留消息会删除该topic的保留消息
+	clear := packets.NewMqttPacket(packets.Publish).(*packets.PublishPacket)
+	clear.Retain = true
+	clear.TopicName = "retain/config"
+	assert.NoError(t, clear.Write(pub))
+	received, ok = readTestPacket(t, sub).(*packets.PublishPacket)
+	assert.True(t, ok)
+	assert.False(t, received.Retain)
+	assert.Equal(t, 0, len(server.retained.GetRetainedMessages("retain/#")))
+}
+
+func TestWillMessage(t *testing.T) {
+	server := newTestServer()
+	sub := connectTestClient(t, server, "will-sub", true)
+	defer sub.Close()
+	subscribeTestTopic(t, sub, "will/+", 1)
+
+	cp := newTestConnectPacket("will-graceful", true)
+	cp.WillFlag = true
+	cp.WillTopic = "will/graceful"
+	cp.WillMessage = []byte("offline")
+	graceful := connectTestClientWith(t, server, cp)
+	//正常断开连接时遗嘱消息应被丢弃
+	assert.NoError(t, packets.NewMqttPacket(packets.Disconnect).Write(graceful))
+	graceful.Close()
+
+	cp = newTestConnectPacket("will-broken", true)
+	cp.WillFlag = true
+	cp.WillQos = 1
+	cp.WillTopic = "will/broken"
+	cp.WillMessage = []byte("offline")
+	broken := connectTestClientWith(t, server, cp)
+	broken.Close()
+
+	received, ok := readTestPacket(t, sub).(*packets.PublishPacket)
+	assert.True(t, ok)
+	assert.Equal(t, "will/broken", received.TopicName)
+	assert.Equal(t, byte(1), received.Qos)
+	assert.Equal(t, []byte("offline"), received.Payload)
+
+	//遗嘱消息同样不能发布到$SYS下的topic
+	sys, err := server.SubscribeChan("$SYS/#", 1)
+	assert.NoError(t, err)
+	defer sys.Unsubscribe()
+	cp = newTestConnectPacket("will-sys", true)
+	cp.WillFlag = true
+	cp.WillRetain = true
+	cp.WillTopic = "$SYS/broker/version"
+	cp.WillMessage = []byte("spoofed")
+	connectTestClientWith(t, server, cp).Close()
+	assert.Eventually(t, func() bool { return server.clients.FindClient("will-sys") == nil }, time.Second, 10*time.Millisecond)
+	select {
+	case msg := <-sys.C:
+		t.Fatalf("unexpected will message on %s", msg.Topic)
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Empty(t, server.retained.GetRetainedMessages("$SYS/#"))
+}
+
+func TestClientTakeover(t *testing.T) {
+	server := newTestServer()
+	old := connectTestClient(t, server, "takeover", false)
+	defer old.Close()
+	subscribeTestTopic(t, old, "takeover/test", 1)
+
+	cp := newTestConnectPacket("takeover", false)
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go processNewConn(serverConn, server, testListener)
+	assert.NoError(t, cp.Write(clientConn))
+	connack, ok := readTestPacket(t, clientConn).(*packets.ConnackPacket)
+	assert.True(t, ok)
+	assert.True(t, connack.SessionPresent)
+	//旧的连接应当被服务端关闭
+	old.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := packets.ReadPacket(old)
+	assert.Error(t, err)
+
+	//订阅随会话转交给了新的连接
+	pub := connectTestClient(t, server, "takeover-pub", true)
+	defer pub.Close()
+	pp := packets.NewMqttPacket(packets.Publish).(*packets.PublishPacket)
+	pp.TopicName = "takeover/test"
+	pp.Payload = []byte("hello")
+	assert.NoError(t, pp.Write(pub))
+	received, ok := readTestPacket(t, clientConn).(*packets.PublishPacket)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("hello"), received.Payload)
+}
+
+//旧连接不读取数据时，向其发送DISCONNECT会阻塞到写入超时，期间其他客户端的连接不受影响
+func TestSlowTakeover(t *testing.T) {
+	server := newTestServer()
+	cp := newTestConnectPacket("takeover-slow", true)
+	cp.ProtocolVersion = packets.MQTT5
+	old := connectTestClientWith(t, server, cp)
+	defer old.Close()
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go processNewConn(serverConn, server, testListener)
+	assert.NoError(t, cp.Write(clientConn))
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	other := connectTestClient(t, server, "takeover-other", true)
+	defer other.Close()
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+
+	connack, ok := readTestPacketWithVersion(t, clientConn, packets.MQTT5).(*packets.ConnackPacket)
+	assert.True(t, ok)
+	assert.Equal(t, byte(packets.ReasonSuccess), connack.ReturnCode)
+}
+
+func TestOfflineMessageQueue(t *testing.T) {
+	server := newTestServer()
+	sub := connectTestClient(t, server, "offline-sub", false)
+	subscribeTestTopic(t, sub, "offline/test", 1)
+	assert.NoError(t, packets.NewMqttPacket(packets.Disconnect).Write(sub))
+	sub.Close()
+
+	pub := connectTestClient(t, server, "offline-pub", true)
+	defer pub.Close()
+	for i, payload := range []string{"1", "2"} {
+		pp := packets.NewMqttPacket(packets.Publish).(*packets.PublishPacket)
+		pp.Qos = 1
+		pp.MessageID = uint16(i + 1)
+		pp.TopicName = "offline/test"
+		pp.Payload = []byte(payload)
+		assert.NoError(t, pp.Write(pub))
+		_, ok := readTestPacket(t, pub).(*packets.PubackPacket)
+		assert.True(t, ok)
+	}
+	//qos为0的消息不会为离线会话缓存
+	pp := packets.NewMqttPacket(packets.Publish).(*packets.PublishPacket)
+	pp.TopicName = "offline/test"
+	pp.Payload = []byte("qos0")
+	assert.NoError(t, pp.Write(pub))
+	time.Sleep(50 * time.Millisecond)
+
+	sub = connectTestClient(t, server, "offline-sub", false)
+	defer sub.Close()
+	var messageIds []uint16
+	for _, payload := range []string{"1", "2"} {
+		received, ok := readTestPacket(t, sub).(*packets.PublishPacket)
+		assert.True(t, ok)
+		assert.Equal(t, []byte(payload), received.Payload)
+		messageIds = append(messageIds, received.MessageID)
+	}
+	for _, id := range messageIds {
+		ack := packets.NewMqttPacket(packets.Puback).(*packets.PubackPacket)
+		ack.MessageID = id
+		assert.NoError(t, ack.Write(sub))
+	}
+}
+
+func TestMqtt5Interop(t *testing.T) {
+	server := newTestServer()
+	cp := newTestConnectPacket("", true)
+	cp.ProtocolVersion = packets.MQTT5
+	serverConn, v5 := net.Pipe()
+	defer v5.Close()
+	go processNewConn(serverConn, server, testListener)
+	assert.NoError(t, cp.Write(v5))
+	connack, ok := readTestPacketWithVersion(t, v5, packets.MQTT5).(*packets.ConnackPacket)
+	assert.True(t, ok)
+	assert.Equal(t, byte(packets.ReasonSuccess), connack.ReturnCode)
+	//没有提供clientId的客户端会由服务端分配
+	assert.NotEmpty(t, connack.Properties.AssignedClientID)
+
+	sp := packets.NewMqttPacketWithVersion(packets.Subscribe, packets.MQTT5).(*packets.SubscribePacket)
+	sp.MessageID = 1
+	sp.Topics = []string{"interop/#"}
+	sp.Qoss = []byte{1}
+	sp.Options = []packets.SubOptions{{}}
+	assert.NoError(t, sp.Write(v5))
+	suback, ok := readTestPacketWithVersion(t, v5, packets.MQTT5).(*packets.SubackPacket)
+	assert.True(t, ok)
+	assert.Equal(t, []byte{packets.ReasonGrantedQoS1}, suback.ReturnCodes)
+
+	v3 := connectTestClient(t, server, "interop-v3", true)
+	defer v3.Close()
+	subscribeTestTopic(t, v3, "interop/#", 1)
+
+	//mqtt 5.0客户端发布的消息带有用户属性，只有mqtt 5.0的订阅者能收到属性
+	pub := newTestConnectPacket("interop-pub", true)
+	pub.ProtocolVersion = packets.MQTT5
+	pubConn := connectTestClientWith(t, server, pub)
+	defer pubConn.Close()
+	pp := packets.NewMqttPacketWithVersion(packets.Publish, packets.MQTT5).(*packets.PublishPacket)
+	pp.Qos = 1
+	pp.MessageID = 1
+	pp.TopicName = "interop/a"
+	pp.Payload = []byte("hello")
+	pp.Properties = &packets.Properties{User: []packets.UserProperty{{Key: "k", Value: "v"}}}
+	assert.NoError(t, pp.Write(pubConn))
+	_, ok = readTestPacketWithVersion(t, pubConn, packets.MQTT5).(*packets.PubackPacket)
+	assert.True(t, ok)
+
+	received, ok := readTestPacketWithVersion(t, v5, packets.MQTT5).(*packets.PublishPacket)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("hello"), received.Payload)
+	assert.Equal(t, []packets.UserProperty{{Key: "k", Value: "v"}}, received.Properties.User)
+	received, ok = readTestPacket(t, v3).(*packets.PublishPacket)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("hello"), received.Payload)
+	assert.Nil(t, received.Properties)
+}
+
+func TestSubscriptionOptions(t *testing.T) {
+	server := newTestServer()
+	assert.NoError(t, server.Publish("opt/retained", []byte("r"), 1, true))
+	cp := newTestConnectPacket("opt-client", true)
+	cp.ProtocolVersion = packets.MQTT5
+	c := connectTestClientWith(t, server, cp)
+	defer c.Close()
+	subscribe := func(topic string, qos byte, options packets.SubOptions) {
+		sp := packets.NewMqttPacketWithVersion(packets.Subscribe, packets.MQTT5).(*packets.SubscribePacket)
+		sp.MessageID = 1
+		sp.Topics = []string{topic}
+		sp.Qoss = []byte{qos}
+		sp.Options = []packets.SubOptions{options}
+		assert.NoError(t, sp.Write(c))
+		_, ok := readTestPacketWithVersion(t, c, packets.MQTT5).(*packets.SubackPacket)
+		assert.True(t, ok)
+	}
+	readPublish := func() *packets.PublishPacket {
+		p, ok := readTestPacketWithVersion(t, c, packets.MQTT5).(*packets.PublishPacket)
+		assert.True(t, ok)
+		return p
+	}
+	//RetainHandling为2时不发送保留消息，为1时只在新建订阅时发送
+	subscribe("opt/retained", 0, packets.SubOptions{RetainHandling: 2})
+	subscribe("opt/retained", 0, packets.SubOptions{RetainHandling: 1})
+	subscribe("opt/+", 0, packets.SubOptions{RetainHandling: 1})
+	msg := readPublish()
+	assert.Equal(t, "opt/retained", msg.TopicName)
+	assert.True(t, msg.Retain)
+
+	//NoLocal的订阅不会收到自己发布的消息
+	subscribe("local/a", 0, packets.SubOptions{NoLocal: true})
+	pp := packets.NewMqttPacketWithVersion(packets.Publish, packets.MQTT5).(*packets.PublishPacket)
+	pp.TopicName = "local/a"
+	pp.Payload = []byte("self")
+	assert.NoError(t, pp.Write(c))
+	go server.Publish("local/a", []byte("server"), 0, false)
+	assert.Equal(t, []byte("server"), readPublish().Payload)
+
+	//RetainAsPublished的订阅收到的消息保留发布者设置的retain标志
+	subscribe("rap/a", 1, packets.SubOptions{RetainAsPublished: true, RetainHandling: 2})
+	go server.Publish("rap/a", []byte("rap"), 1, true)
+	msg = readPublish()
+	assert.True(t, msg.Retain)
+	//mqtt 5.0的客户端在连接存续期间不会被重发未确认的消息
+	c.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	_, err := packets.ReadPacketWithVersion(c, packets.MQTT5)
+	assert.Error(t, err)
+	c.SetReadDeadline(time.Time{})
+
+	//共享订阅设置NoLocal属于协议错误，连接会被断开
+	sp := packets.NewMqttPacketWithVersion(packets.Subscribe, packets.MQTT5).(*packets.SubscribePacket)
+	sp.MessageID = 2
+	sp.Topics = []string{"$share/g/local/a"}
+	sp.Qoss = []byte{0}
+	sp.Options = []packets.SubOptions{{NoLocal: true}}
+	assert.NoError(t, sp.Write(c))
+	assert.Eventually(t, func() bool { return server.clients.FindClient("opt-client") == nil }, time.Second, 10*time.Millisecond)
+}
+
+func TestMqtt5ClientLimits(t *testing.T) {
+	server := newTestServer()
+	cp := newTestConnectPacket("limit-client", true)
+	cp.ProtocolVersion = packets.MQTT5
+	var receiveMaximum uint16 = 1
+	var maxPacketSize uint32 = 64
+	cp.Properties = &packets.Properties{ReceiveMaximum: &receiveMaximum, MaximumPacketSize: &maxPacketSize}
+	c := connectTestClientWith(t, server, cp)
+	defer c.Close()
+	sp := packets.NewMqttPacketWithVersion(packets.Subscribe, packets.MQTT5).(*packets.SubscribePacket)
+	sp.MessageID = 1
+	sp.Topics = []string{"limit/#"}
+	sp.Qoss = []byte{2}
+	sp.Options = []packets.SubOptions{{}}
+	assert.NoError(t, sp.Write(c))
+	_, ok := readTestPacketWithVersion(t, c, packets.MQTT5).(*packets.SubackPacket)
+	assert.True(t, ok)
+	readPublish := func() *packets.PublishPacket {
+		p, ok := readTestPacketWithVersion(t, c, packets.MQTT5).(*packets.PublishPacket)
+		assert.True(t, ok)
+		return p
+	}
+
+	//超过客户端最大报文长度的消息被丢弃，Receive Maximum为1时同一时刻只有一条消息等待确认
+	go func() {
+		server.Publish("limit/a", make([]byte, 100), 1, false)
+		server.Publish("limit/a", []byte("1"), 2, false)
+		server.Publish("limit/a", []byte("2"), 2, false)
+	}()
+	first := readPublish()
+	assert.Equal(t, []byte("1"), first.Payload)
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := packets.ReadPacketWithVersion(c, packets.MQTT5)
+	assert.Error(t, err)
+	c.SetReadDeadline(time.Time{})
+
+	//原因码大于等于0x80的PUBREC会结束该消息的流程，不会收到PUBREL
+	pubrec := packets.NewMqttPacketWithVersion(packets.Pubrec, packets.MQTT5).(*packets.PubrecPacket)
+	pubrec.MessageID = first.MessageID
+	pubrec.ReasonCode = packets.ReasonQuotaExceeded
+	assert.NoError(t, pubrec.Write(c))
+	second := readPublish()
+	assert.Equal(t, []byte("2"), second.Payload)
+}
+
+func TestUnsupportedProtocolVersion(t *testing.T) {
+	server := newTestServer()
+	cp := newTestConnectPacket("bad-version", true)
+	cp.ProtocolVersion = 6
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go processNewConn(serverConn, server, testListener)
+	assert.NoError(t, cp.Write(clientConn))
+	connack, ok := readTestPacket(t, clientConn).(*packets.ConnackPacket)
+	assert.True(t, ok)
+	assert.Equal(t, byte(packets.ErrRefusedBadProtocolVersion), connack.ReturnCode)
+}
+
+func TestSharedSubscriptionDelivery(t *testing.T) {
+	server := newTestServer()
+	sub1 := connectTestClient(t, server, "shared-sub1", true)
+	defer sub1.Close()
+	sub2 := connectTestClient(t, server, "shared-sub2", true)
+	defer sub2.Close()
+	pub := connectTestClient(t, server, "shared-pub", true)
+	defer pub.Close()
+	subscribeTestTopic(t, sub1, "$share/workers/shared/task", 0)
+	subscribeTestTopic(t, sub2, "$share/workers/shared/task", 0)
+
+	//组内的订阅者轮流接收消息
+	for _, payload := range []string{"task1", "task2"} {
+		pp := packets.NewMqttPacket(packets.Publish).(*packets.PublishPacket)
+		pp.TopicName = "shared/task"
+		pp.Payload = []byte(payload)
+		assert.NoError(t, pp.Write(pub))
+	}
+	received1, ok := readTestPacket(t, sub1).(*packets.PublishPacket)
+	assert.True(t, ok)
+	received2, ok := readTestPacket(t, sub2).(*packets.PublishPacket)
+	assert.True(t, ok)
+	assert.Equal(t, "shared/task", received1.TopicName)
+	assert.ElementsMatch(t, []string{"task1", "task2"}, []string{string(received1.Payload), string(received2.Payload)})
+}
+
+func TestInvalidTopic(t *testing.T) {
+	server := newTestServer()
+	conn := connectTestClient(t, server, "invalid-topic", true)
+	defer conn.Close()
+	sp := packets.NewMqttPacket(packets.Subscribe).(*packets.SubscribePacket)
+	sp.MessageID = 1
+	sp.Topics = []string{"a/#/b", "valid/+", "a+/b"}
+	sp.Qoss = []byte{0, 1, 0}
+	assert.NoError(t, sp.Write(conn))
+	suback, ok := readTestPacket(t, conn).(*packets.SubackPacket)
+	assert.True(t, ok)
+	assert.Equal(t, []byte{0x80, 1, 0x80}, suback.ReturnCodes)
+
+	//topic名称中包含通配符时服务端需要断开连接
+	pp := packets.NewMqttPacket(packets.Publish).(*packets.PublishPacket)
+	pp.TopicName = "a/+"
+	pp.Payload = []byte("hello")
+	assert.NoError(t, pp.Write(conn))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := packets.ReadPacket(conn)
+	assert.Error(t, err)
+}
+
+func TestSysStats(t *testing.T) {
+	server := newTestServer()
+	sysSub := connectTestClient(t, server, "sys-sub", true)
+	defer sysSub.Close()
+	allSub := connectTestClient(t, server, "sys-all", true)
+	defer allSub.Close()
+	subscribeTestTopic(t, sysSub, "$SYS/broker/messages/received", 0)
+	subscribeTestTopic(t, allSub, "+/broker/messages/received", 0)
+
+	pp := packets.NewMqttPacket(packets.Publish).(*packets.PublishPacket)
+	pp.TopicName = "sys/broker/messages/received"
+	pp.Payload = []byte("hello")
+	assert.NoError(t, pp.Write(allSub))
+	received, ok := readTestPacket(t, allSub).(*packets.PublishPacket)
+	assert.True(t, ok)
+	assert.Equal(t, "sys/broker/messages/received", received.TopicName)
+
+	//投递是同步写入连接的，需要在读取的同时发布
+	go server.publishSysStats()
+	stats, ok := readTestPacket(t, sysSub).(*packets.PublishPacket)
+	assert.True(t, ok)
+	assert.Equal(t, "$SYS/broker/messages/received", stats.TopicName)
+	assert.Equal(t, "1", string(stats.Payload))
+	//第一级的通配符不能匹配$SYS下的topic
+	allSub.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err := packets.ReadPacket(allSub)
+	assert.Error(t, err)
+}
+
+func TestMultipleServers(t *testing.T) {
+	internal := newTestServer()
+	external := newTestServer()
+	//两个实例中使用相同的clientId和topic，互不影响
+	sub := connectTestClient(t, internal, "multi-client", true)
+	defer sub.Close()
+	subscribeTestTopic(t, sub, "multi/test", 0)
+	pub := connectTestClient(t, external, "multi-client", true)
+	defer pub.Close()
+	assert.NotNil(t, internal.clients.FindClient("multi-client"))
+	assert.NotNil(t, external.clients.FindClient("multi-client"))
+
+	pp := packets.NewMqttPacket(packets.Publish).(*packets.PublishPacket)
+	pp.TopicName = "multi/test"
+	pp.Retain = true
+	pp.Payload = []byte("external")
+	assert.NoError(t, pp.Write(pub))
+	assert.Eventually(t, func() bool {
+		return len(external.retained.GetRetainedMessages("multi/#")) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, len(internal.retained.GetRetainedMessages("multi/#")))
+	assert.Equal(t, 1, internal.subscriptions.CountSubscriptions())
+	assert.Equal(t, 0, external.subscriptions.CountSubscriptions())
+	//另一个实例发布的消息不会投递给当前实例的订阅者
+	sub.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := packets.ReadPacket(sub)
+	assert.Error(t, err)
+}
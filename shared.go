@@ -0,0 +1,163 @@
+package mqtt
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"strings"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/config"
+	"github.com/davidfantasy/embedded-mqtt-broker/consts"
+)
+
+var errInvalidSharedSubscription = errors.New("invalid shared subscription")
+
+//共享订阅组，每条消息只会投递给组内的一个成员
+type sharedGroup struct {
+	name string
+	//组内成员的sessionId
+	members []string
+	//轮询策略下一次投递的位置
+	next int
+	//粘性策略下每个发布者对应的成员，发布者断开后移除
+	sticky map[string]string
+}
+
+//解析$share/{group}/{filter}格式的共享订阅，非共享订阅返回的group为空
+func parseSharedSubscription(topic string) (string, string, error) {
+	if !strings.HasPrefix(topic, consts.SHARED_SUBSCRIPTION_PREFIX+consts.TOPIC_PART_SPLITTER) {
+		return "", topic, nil
+	}
+	parts := strings.SplitN(topic, consts.TOPIC_PART_SPLITTER, 3)
+	if len(parts) != 3 || len(parts[1]) == 0 || len(parts[2]) == 0 || strings.ContainsAny(parts[1], "+#") {
+		return "", "", errInvalidSharedSubscription
+	}
+	return parts[1], parts[2], nil
+}
+
+//获取订阅对应的topic过滤器，共享订阅会去掉$share/{group}/前缀
+func subscriptionFilter(topic string) string {
+	_, filter, err := parseSharedSubscription(topic)
+	if err != nil {
+		return topic
+	}
+	return filter
+}
+
+func (st *subscriptionStore) joinSharedGroup(sessionId string, group string, filter string) {
+	groups := st.sharedGroupMap[filter]
+	if groups == nil {
+		groups = make(map[string]*sharedGroup)
+		st.sharedGroupMap[filter] = groups
+	}
+	g := groups[group]
+	if g == nil {
+		g = &sharedGroup{name: group, sticky: make(map[string]string)}
+		groups[group] = g
+	}
+	g.members = append(g.members, sessionId)
+}
+
+func (st *subscriptionStore) leaveSharedGroup(sessionId string, group string, filter string) {
+	groups := st.sharedGroupMap[filter]
+	if groups == nil {
+		return
+	}
+	g := groups[group]
+	if g == nil {
+		return
+	}
+	g.members = removeString(g.members, sessionId)
+	for publisher, member := range g.sticky {
+		if member == sessionId {
+			delete(g.sticky, publisher)
+		}
+	}
+	if len(g.members) == 0 {
+		delete(groups, group)
+		if len(groups) == 0 {
+			delete(st.sharedGroupMap, filter)
+		}
+	}
+}
+
+//发布者断开后移除其在所有共享订阅组中对应的粘性成员，避免sticky随发布者的变化无限增长
+func (st *subscriptionStore) forgetPublisher(publisher string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, groups := range st.sharedGroupMap {
+		for _, g := range groups {
+			delete(g.sticky, publisher)
+		}
+	}
+}
+
+//查询topic匹配到的共享订阅组成员中哪些客户端在线。注册表查询可能需要获取会话锁，而持有会话锁时发布的事件
+//又会访问订阅关系，所以只在st.mu的保护下收集成员，在释放锁之后再查询注册表
+func (st *subscriptionStore) onlineMembers(parts []string) map[string]bool {
+	st.mu.Lock()
+	if len(st.sharedGroupMap) == 0 {
+		st.mu.Unlock()
+		return nil
+	}
+	var members []string
+	for _, t := range st.subscribedTopics.MatchMany(parts) {
+		for _, group := range st.sharedGroupMap[t.GetTopic()] {
+			members = append(members, group.members...)
+		}
+	}
+	st.mu.Unlock()
+	online := make(map[string]bool, len(members))
+	for _, member := range members {
+		if _, ok := online[member]; ok {
+			continue
+		}
+		online[member] = st.clients.FindClientBySessionId(member) != nil
+	}
+	return online
+}
+
+//按照负载均衡策略从组内选出一个成员，优先选择在线的成员
+func (g *sharedGroup) pick(topic string, publisher string, strategy config.SharedSubscriptionStrategy, isOnline func(sessionId string) bool) string {
+	candidates := make([]string, 0, len(g.members))
+	for _, member := range g.members {
+		if isOnline(member) {
+			candidates = append(candidates, member)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = g.members
+	}
+	switch strategy {
+	case config.SharedRandom:
+		return candidates[rand.Intn(len(candidates))]
+	case config.SharedSticky:
+		if member, ok := g.sticky[publisher]; ok && containsString(candidates, member) {
+			return member
+		}
+		member := g.roundRobin(candidates)
+		g.sticky[publisher] = member
+		return member
+	case config.SharedTopicHash:
+		h := fnv.New32a()
+		h.Write([]byte(topic))
+		return candidates[h.Sum32()%uint32(len(candidates))]
+	default:
+		return g.roundRobin(candidates)
+	}
+}
+
+func (g *sharedGroup) roundRobin(candidates []string) string {
+	member := candidates[g.next%len(candidates)]
+	g.next = (g.next + 1) % len(candidates)
+	return member
+}
+
+func containsString(slice []string, s string) bool {
+	for _, str := range slice {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
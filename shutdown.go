@@ -0,0 +1,162 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/logger"
+	"github.com/davidfantasy/embedded-mqtt-broker/packets"
+)
+
+//服务关闭后，ListenAndServe、Serve等方法返回该错误
+var ErrServerClosed = errors.New("mqtt: server closed")
+
+//关闭服务时检查消息是否处理完成以及连接是否全部退出的间隔
+const shutdownPollInterval = 10 * time.Millisecond
+
+//优雅地关闭服务：停止接受新连接，等待客户端发送的消息转发完成、发给客户端的qos>0的消息收到确认，
+//然后断开所有客户端（mqtt 5.0的客户端会先收到DISCONNECT）并停止后台协程。
+//ctx到期时不再等待消息处理完成，直接断开剩余的连接并返回ctx的错误
+func (s *MqttServer) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.inShutdown, 1)
+	s.mu.Lock()
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	for hs := range s.httpServers {
+		//websocket连接已经被接管，不受http.Server关闭的影响
+		hs.Close()
+	}
+	s.mu.Unlock()
+	s.shutdownOnce.Do(func() {
+		close(s.done)
+		s.clients.StopSessionSweeper()
+	})
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	//等待在途的消息处理完成
+	var err error
+	for err == nil && !s.drained() {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	if err != nil {
+		logger.WARN.Println("shutdown before all inflight messages were delivered:", err)
+	}
+	s.closeConns()
+	//等待所有连接的处理协程退出
+	for err == nil && s.countConns() > 0 {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	//连接都已关闭，等待事件处理协程处理完缓冲区中的事件后退出，之后发布的事件会被忽略
+	busClosed := make(chan struct{})
+	go func() {
+		s.eventBus.Close()
+		close(busClosed)
+	}()
+	select {
+	case <-busClosed:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	return err
+}
+
+func (s *MqttServer) shuttingDown() bool {
+	return atomic.LoadInt32(&s.inShutdown) != 0
+}
+
+//所有已连接的客户端是否都已没有待处理的消息
+func (s *MqttServer) drained() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, handler := range s.conns {
+		if handler != nil && !handler.drained() {
+			return false
+		}
+	}
+	return true
+}
+
+//断开所有连接，还未完成握手的连接直接关闭
+func (s *MqttServer) closeConns() {
+	s.mu.Lock()
+	conns := make(map[net.Conn]*MessageHandler, len(s.conns))
+	for conn, handler := range s.conns {
+		conns[conn] = handler
+	}
+	s.mu.Unlock()
+	for conn, handler := range conns {
+		if handler == nil {
+			conn.Close()
+		} else if s.config.DisconnectOnShutdown {
+			handler.client.Disconnect(packets.ReasonServerShuttingDown)
+		} else {
+			s.clients.CloseClient(handler.client)
+		}
+	}
+}
+
+func (s *MqttServer) countConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+//记录新的连接或更新连接的消息处理器，服务正在关闭时不再接受新的连接并返回false
+func (s *MqttServer) trackConn(conn net.Conn, handler *MessageHandler) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.conns[conn]; !ok && s.shuttingDown() {
+		return false
+	}
+	s.conns[conn] = handler
+	return true
+}
+
+func (s *MqttServer) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+func (s *MqttServer) trackListener(ln net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown() {
+		return false
+	}
+	s.listeners[ln] = struct{}{}
+	return true
+}
+
+func (s *MqttServer) untrackListener(ln net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, ln)
+}
+
+func (s *MqttServer) trackHTTPServer(hs *http.Server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.httpServers[hs] = struct{}{}
+}
+
+func (s *MqttServer) untrackHTTPServer(hs *http.Server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.httpServers, hs)
+}
@@ -0,0 +1,97 @@
+package mqtt
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdown(t *testing.T) {
+	server := newTestServer()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(ln)
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	cp := newTestConnectPacket("shutdown-v5", true)
+	cp.ProtocolVersion = packets.MQTT5
+	assert.NoError(t, cp.Write(conn))
+	connack, ok := readTestPacketWithVersion(t, conn, packets.MQTT5).(*packets.ConnackPacket)
+	assert.True(t, ok)
+	assert.Equal(t, byte(packets.ReasonSuccess), connack.ReturnCode)
+
+	sub := connectTestClient(t, server, "shutdown-sub", true)
+	defer sub.Close()
+	pub := connectTestClient(t, server, "shutdown-pub", true)
+	defer pub.Close()
+	subscribeTestTopic(t, sub, "shutdown/test", 1)
+	pp := packets.NewMqttPacket(packets.Publish).(*packets.PublishPacket)
+	pp.Qos = 1
+	pp.MessageID = 1
+	pp.TopicName = "shutdown/test"
+	pp.Payload = []byte("bye")
+	assert.NoError(t, pp.Write(pub))
+	_, ok = readTestPacket(t, pub).(*packets.PubackPacket)
+	assert.True(t, ok)
+	received, ok := readTestPacket(t, sub).(*packets.PublishPacket)
+	assert.True(t, ok)
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		shutdownErr <- server.Shutdown(ctx)
+	}()
+	//消息未被确认前不会断开连接
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, shutdownErr, 0)
+	ack := packets.NewMqttPacket(packets.Puback).(*packets.PubackPacket)
+	ack.MessageID = received.MessageID
+	assert.NoError(t, ack.Write(sub))
+	//mqtt 5.0的客户端会收到服务端关闭的原因码
+	disconnect, ok := readTestPacketWithVersion(t, conn, packets.MQTT5).(*packets.DisconnectPacket)
+	assert.True(t, ok)
+	assert.Equal(t, byte(packets.ReasonServerShuttingDown), disconnect.ReasonCode)
+	select {
+	case err := <-shutdownErr:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+	assert.ErrorIs(t, <-serveErr, ErrServerClosed)
+	//关闭后的服务不再接受新的监听
+	ln, err = net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	assert.ErrorIs(t, server.Serve(ln), ErrServerClosed)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	server := newTestServer()
+	sub := connectTestClient(t, server, "shutdown-timeout-sub", true)
+	defer sub.Close()
+	pub := connectTestClient(t, server, "shutdown-timeout-pub", true)
+	defer pub.Close()
+	subscribeTestTopic(t, sub, "shutdown/timeout", 1)
+	pp := packets.NewMqttPacket(packets.Publish).(*packets.PublishPacket)
+	pp.Qos = 1
+	pp.MessageID = 1
+	pp.TopicName = "shutdown/timeout"
+	assert.NoError(t, pp.Write(pub))
+	_, ok := readTestPacket(t, pub).(*packets.PubackPacket)
+	assert.True(t, ok)
+	_, ok = readTestPacket(t, sub).(*packets.PublishPacket)
+	assert.True(t, ok)
+	//订阅者一直不确认消息，ctx到期后强制断开
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, server.Shutdown(ctx), context.DeadlineExceeded)
+	assert.Eventually(t, func() bool { return server.countConns() == 0 }, time.Second, 10*time.Millisecond)
+}
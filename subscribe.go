@@ -0,0 +1,163 @@
+package mqtt
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/event"
+	"github.com/davidfantasy/embedded-mqtt-broker/logger"
+	"github.com/davidfantasy/embedded-mqtt-broker/packets"
+)
+
+//进程内订阅者的sessionId前缀，客户端会话的id由数字组成，不会与其冲突
+const localSessionPrefix = "$local/"
+
+//进程内订阅的通道已满，消息被丢弃
+var ErrSubscriberBusy = errors.New("local subscriber channel is full")
+
+//进程内订阅收到消息时的回调函数
+type MessageCallback func(msg *Message)
+
+//进程内的订阅，通过Unsubscribe取消
+type LocalSubscription struct {
+	id     string
+	filter string
+	server *MqttServer
+	//同步回调，在转发消息的协程中直接调用
+	callback MessageCallback
+	//使用有界通道时匹配的消息会放入该通道，取消订阅后通道会被关闭
+	C  <-chan *Message
+	ch chan *Message
+	//保护通道的关闭，避免向已关闭的通道发送消息
+	mu     sync.Mutex
+	closed bool
+	once   sync.Once
+}
+
+//在进程内订阅topic，支持通配符和$share/{group}/{filter}格式的共享订阅，匹配的消息会同步地调用callback，
+//callback不应阻塞，否则会影响消息的转发；与客户端订阅一样，非共享订阅会先收到已有的保留消息
+func (s *MqttServer) Subscribe(filter string, callback MessageCallback) (*LocalSubscription, error) {
+	if callback == nil {
+		return nil, errors.New("callback must not be nil")
+	}
+	return s.subscribeLocal(filter, &LocalSubscription{callback: callback})
+}
+
+//与Subscribe相同，但匹配的消息会放入容量为size的通道，通道已满时消息会被丢弃并计入丢弃的消息数
+func (s *MqttServer) SubscribeChan(filter string, size int) (*LocalSubscription, error) {
+	if size <= 0 {
+		return nil, errors.New("channel size must be greater than 0")
+	}
+	ch := make(chan *Message, size)
+	return s.subscribeLocal(filter, &LocalSubscription{ch: ch, C: ch})
+}
+
+func (s *MqttServer) subscribeLocal(filter string, ls *LocalSubscription) (*LocalSubscription, error) {
+	if s.shuttingDown() {
+		return nil, ErrServerClosed
+	}
+	ls.id = localSessionPrefix + strconv.FormatInt(atomic.AddInt64(&s.localSeq, 1), 10)
+	ls.filter = filter
+	ls.server = s
+	if err := s.subscriptions.subscribeLocal(ls); err != nil {
+		return nil, err
+	}
+	if group, f, _ := parseSharedSubscription(filter); len(group) == 0 {
+		for _, msg := range s.retained.GetRetainedMessages(f) {
+			if s.onDeliver(ls.id, msg, msg.Qos, true) {
+				ls.deliver(msg, msg.Qos, true)
+			}
+		}
+	}
+	return ls, nil
+}
+
+//订阅的topic过滤器
+func (ls *LocalSubscription) Filter() string {
+	return ls.filter
+}
+
+//取消订阅，可以重复调用；使用通道时会关闭通道，正在执行的回调不受影响
+func (ls *LocalSubscription) Unsubscribe() {
+	ls.once.Do(func() {
+		ls.server.subscriptions.unsubscribeLocal(ls)
+		ls.mu.Lock()
+		defer ls.mu.Unlock()
+		ls.closed = true
+		if ls.ch != nil {
+			close(ls.ch)
+		}
+	})
+}
+
+func (ls *LocalSubscription) deliver(packet *packets.PublishPacket, qos byte, retain bool) error {
+	msg := newMessage(packet, qos, retain)
+	if ls.callback != nil {
+		defer func() {
+			if err := recover(); err != nil {
+				logger.ERROR.Printf("进程内订阅的回调发生异常：%s,%v", ls.filter, err)
+			}
+		}()
+		ls.callback(msg)
+		return nil
+	}
+	ls.mu.Lock()
+	if ls.closed {
+		ls.mu.Unlock()
+		return nil
+	}
+	select {
+	case ls.ch <- msg:
+		ls.mu.Unlock()
+		return nil
+	default:
+	}
+	ls.mu.Unlock()
+	//事件处理器可能会取消该订阅，所以需要在释放ls.mu之后发布事件
+	atomic.AddInt64(&ls.server.stats.messagesDropped, 1)
+	logger.WARN.Printf("进程内订阅的通道已满，该条消息将被丢弃：%s", packet.TopicName)
+	ls.server.publishEvent(&event.MessageDropped{Topic: packet.TopicName, Reason: "subscriber channel full"})
+	return ErrSubscriberBusy
+}
+
+//进程内订阅者与客户端会话一样保存在订阅的前缀树中
+func (st *subscriptionStore) subscribeLocal(ls *LocalSubscription) error {
+	st.mu.Lock()
+	st.local[ls.id] = ls
+	st.mu.Unlock()
+	if err := st.Subscribe(ls.filter, ls.id, 2); err != nil {
+		st.mu.Lock()
+		delete(st.local, ls.id)
+		st.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (st *subscriptionStore) unsubscribeLocal(ls *LocalSubscription) {
+	st.Unsubscribe(ls.filter, ls.id)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.local, ls.id)
+}
+
+//根据sessionId查找进程内订阅者，不是进程内订阅者时返回nil
+func (st *subscriptionStore) findLocal(sessionId string) *LocalSubscription {
+	if !strings.HasPrefix(sessionId, localSessionPrefix) {
+		return nil
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.local[sessionId]
+}
+
+//会话对应的客户端或进程内订阅者是否在线，需要在st.mu的保护下调用，online为onlineMembers预先查询的客户端在线状态
+func (st *subscriptionStore) isOnline(sessionId string, online map[string]bool) bool {
+	if _, ok := st.local[sessionId]; ok {
+		return true
+	}
+	return online[sessionId]
+}
@@ -0,0 +1,111 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/config"
+	"github.com/davidfantasy/embedded-mqtt-broker/event"
+	"github.com/davidfantasy/embedded-mqtt-broker/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalSubscribe(t *testing.T) {
+	server := newTestServer()
+	assert.NoError(t, server.Publish("local/1/status", []byte("online"), 0, true))
+	received := make(chan *Message, 10)
+	sub, err := server.Subscribe("local/+/status", func(msg *Message) {
+		received <- msg
+	})
+	assert.NoError(t, err)
+	//订阅后先收到已有的保留消息
+	msg := <-received
+	assert.True(t, msg.Retain)
+	assert.Equal(t, []byte("online"), msg.Payload)
+	//进程内订阅者与客户端订阅者一样保存在前缀树中
+	assert.Equal(t, []string{sub.id}, server.subscriptions.GetSubscriber("local/2/status"))
+
+	pub := connectTestClient(t, server, "local-pub", true)
+	defer pub.Close()
+	pp := packets.NewMqttPacket(packets.Publish).(*packets.PublishPacket)
+	pp.Qos = 1
+	pp.MessageID = 1
+	pp.TopicName = "local/2/status"
+	pp.Payload = []byte("offline")
+	assert.NoError(t, pp.Write(pub))
+	_, ok := readTestPacket(t, pub).(*packets.PubackPacket)
+	assert.True(t, ok)
+	select {
+	case msg = <-received:
+		assert.Equal(t, "local/2/status", msg.Topic)
+		assert.Equal(t, byte(1), msg.Qos)
+		assert.False(t, msg.Retain)
+		assert.Equal(t, []byte("offline"), msg.Payload)
+	case <-time.After(time.Second):
+		t.Fatal("local subscriber did not receive the message")
+	}
+
+	sub.Unsubscribe()
+	sub.Unsubscribe()
+	assert.Equal(t, 0, len(server.subscriptions.GetSubscriber("local/2/status")))
+	assert.NoError(t, server.Publish("local/3/status", []byte("x"), 0, false))
+	assert.Len(t, received, 0)
+	_, err = server.Subscribe("local/#/status", func(msg *Message) {})
+	assert.Error(t, err)
+}
+
+func TestLocalSubscribeChan(t *testing.T) {
+	server := newTestServer()
+	sub, err := server.SubscribeChan("chan/#", 1)
+	assert.NoError(t, err)
+	assert.NoError(t, server.Publish("chan/a", []byte("1"), 0, false))
+	//通道已满时丢弃消息
+	assert.ErrorIs(t, server.Publish("chan/b", []byte("2"), 0, false), ErrSubscriberBusy)
+	msg := <-sub.C
+	assert.Equal(t, "chan/a", msg.Topic)
+	sub.Unsubscribe()
+	_, ok := <-sub.C
+	assert.False(t, ok, "channel must be closed after unsubscribe")
+	assert.NoError(t, server.Publish("chan/c", []byte("3"), 0, false))
+}
+
+//同步模式下MessageDropped的处理器在投递的协程中执行，处理器中取消订阅不能死锁
+func TestLocalSubscribeChanDropInSyncMode(t *testing.T) {
+	conf := config.NewDefaultConfig()
+	conf.EventBus = event.Options{Sync: true}
+	server := NewMqttServer(conf)
+	sub, err := server.SubscribeChan("drop/#", 1)
+	assert.NoError(t, err)
+	event.On(server.EventBus(), func(e *event.MessageDropped) {
+		sub.Unsubscribe()
+	})
+	assert.NoError(t, server.Publish("drop/a", []byte("1"), 0, false))
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Publish("drop/b", []byte("2"), 0, false)
+	}()
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, ErrSubscriberBusy)
+	case <-time.After(time.Second):
+		t.Fatal("unsubscribe in a MessageDropped handler deadlocked")
+	}
+	assert.Equal(t, 0, len(server.subscriptions.GetSubscriber("drop/a")))
+}
+
+func TestLocalSharedSubscription(t *testing.T) {
+	server := newTestServer()
+	var first, second []string
+	sub1, err := server.Subscribe("$share/db/shared/#", func(msg *Message) { first = append(first, msg.Topic) })
+	assert.NoError(t, err)
+	defer sub1.Unsubscribe()
+	sub2, err := server.Subscribe("$share/db/shared/#", func(msg *Message) { second = append(second, msg.Topic) })
+	assert.NoError(t, err)
+	defer sub2.Unsubscribe()
+	for _, topic := range []string{"shared/1", "shared/2", "shared/3", "shared/4"} {
+		assert.NoError(t, server.Publish(topic, []byte("x"), 0, false))
+	}
+	//组内的进程内订阅者按轮询分摊消息
+	assert.Equal(t, 2, len(first))
+	assert.Equal(t, 2, len(second))
+}
@@ -0,0 +1,118 @@
+package mqtt
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/consts"
+	"github.com/davidfantasy/embedded-mqtt-broker/packets"
+)
+
+//$SYS下的统计信息只能由服务端发布，客户端的消息和遗嘱都不能发布到这些topic
+func isSysTopic(topic string) bool {
+	return strings.HasPrefix(topic, consts.SYS_TOPIC_ROOT+consts.TOPIC_PART_SPLITTER)
+}
+
+//服务端的运行统计，计数器字段需要通过atomic读写
+type brokerStats struct {
+	messagesReceived int64
+	messagesSent     int64
+	messagesDropped  int64
+	bytesReceived    int64
+	bytesSent        int64
+	//成功建立的mqtt连接总数
+	connectionsTotal int64
+	//按CONNACK返回码统计的被拒绝的连接数
+	connackRefused [256]int64
+	//按报文类型统计的收发报文数
+	packetsReceived [16]int64
+	packetsSent     [16]int64
+	//每条消息匹配到的订阅者数量的分布
+	fanout    *histogram
+	startTime time.Time
+}
+
+func newBrokerStats() *brokerStats {
+	return &brokerStats{startTime: time.Now(), fanout: newHistogram(fanoutBuckets)}
+}
+
+func (stats *brokerStats) packetReceived(packet packets.MqttPacket) {
+	atomic.AddInt64(&stats.packetsReceived[packet.PacketType()&0x0F], 1)
+}
+
+//统计连接收发字节数和发送消息数的net.Conn，同时累加到服务端的统计中
+type statsConn struct {
+	net.Conn
+	stats *brokerStats
+	//该连接收发的字节数
+	bytesReceived int64
+	bytesSent     int64
+}
+
+func newStatsConn(conn net.Conn, stats *brokerStats) net.Conn {
+	return &statsConn{Conn: conn, stats: stats}
+}
+
+func (conn *statsConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	atomic.AddInt64(&conn.bytesReceived, int64(n))
+	atomic.AddInt64(&conn.stats.bytesReceived, int64(n))
+	return n, err
+}
+
+//每个报文都是通过一次Write完整写入的，因此可以根据首字节判断是否为PUBLISH报文
+func (conn *statsConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	atomic.AddInt64(&conn.bytesSent, int64(n))
+	atomic.AddInt64(&conn.stats.bytesSent, int64(n))
+	if err == nil && len(b) > 0 {
+		atomic.AddInt64(&conn.stats.packetsSent[b[0]>>4], 1)
+		if b[0]>>4 == packets.Publish {
+			atomic.AddInt64(&conn.stats.messagesSent, 1)
+		}
+	}
+	return n, err
+}
+
+//按照配置的时间间隔发布$SYS统计信息
+func (s *MqttServer) publishSysStatsInterval() {
+	if s.config.SysInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.config.SysInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.publishSysStats()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+//将统计信息作为保留消息发布，新订阅$SYS的客户端可以立即收到最近一次的统计值
+func (s *MqttServer) publishSysStats() {
+	stats := map[string]string{
+		"version":             consts.BROKER_VERSION,
+		"uptime":              strconv.FormatInt(int64(time.Since(s.stats.startTime)/time.Second), 10) + " seconds",
+		"clients/connected":   strconv.Itoa(s.clients.CountClients()),
+		"sessions/total":      strconv.Itoa(s.clients.CountSessions()),
+		"subscriptions/count": strconv.Itoa(s.subscriptions.CountSubscriptions()),
+		"messages/received":   strconv.FormatInt(atomic.LoadInt64(&s.stats.messagesReceived), 10),
+		"messages/sent":       strconv.FormatInt(atomic.LoadInt64(&s.stats.messagesSent), 10),
+		"messages/dropped":    strconv.FormatInt(atomic.LoadInt64(&s.stats.messagesDropped), 10),
+		"bytes/received":      strconv.FormatInt(atomic.LoadInt64(&s.stats.bytesReceived), 10),
+		"bytes/sent":          strconv.FormatInt(atomic.LoadInt64(&s.stats.bytesSent), 10),
+	}
+	for name, value := range stats {
+		packet := packets.NewMqttPacket(packets.Publish).(*packets.PublishPacket)
+		packet.TopicName = consts.SYS_TOPIC_PREFIX + name
+		packet.Payload = []byte(value)
+		packet.Retain = true
+		s.forwardMessage(packet, "", "")
+	}
+}
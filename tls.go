@@ -0,0 +1,208 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/config"
+	"github.com/davidfantasy/embedded-mqtt-broker/logger"
+	"github.com/davidfantasy/embedded-mqtt-broker/websocket"
+)
+
+//从文件加载服务端证书，证书文件更新后在下一次握手时自动重新加载
+type certReloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modTime  time.Time
+	//上一次检查证书文件的时间
+	checkedAt time.Time
+}
+
+func newCertReloader(certFile, keyFile string, interval time.Duration) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile, interval: interval}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+//重新读取证书和私钥文件
+func (r *certReloader) reload() error {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.checkedAt = time.Now()
+	return nil
+}
+
+//证书和私钥文件中较晚的修改时间
+func (r *certReloader) lastModified() (time.Time, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+	return certInfo.ModTime(), nil
+}
+
+//用作tls.Config.GetCertificate，文件发生变化时重新加载，加载失败则继续使用原证书
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	cert, modTime, checkedAt := r.cert, r.modTime, r.checkedAt
+	r.mu.RUnlock()
+	if time.Since(checkedAt) < r.interval {
+		return cert, nil
+	}
+	r.mu.Lock()
+	r.checkedAt = time.Now()
+	r.mu.Unlock()
+	if latest, err := r.lastModified(); err == nil && !latest.Equal(modTime) {
+		if err := r.reload(); err != nil {
+			logger.ERROR.Println("reload tls certificate failed:", err)
+		} else {
+			logger.INFO.Println("tls certificate reloaded:", r.certFile)
+		}
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+//根据配置创建TLS监听使用的tls.Config
+func newTLSConfig(conf *config.TLSConfig) (*tls.Config, *certReloader, error) {
+	var tlsConfig *tls.Config
+	if conf.Config != nil {
+		tlsConfig = conf.Config.Clone()
+	} else {
+		tlsConfig = &tls.Config{}
+	}
+	if conf.MinVersion != 0 {
+		tlsConfig.MinVersion = conf.MinVersion
+	}
+	if tlsConfig.MinVersion == 0 {
+		tlsConfig.MinVersion = tls.VersionTLS12
+	}
+	if len(conf.CipherSuites) != 0 {
+		tlsConfig.CipherSuites = conf.CipherSuites
+	}
+	var reloader *certReloader
+	if len(conf.CertFile) != 0 || len(conf.KeyFile) != 0 {
+		var err error
+		reloader, err = newCertReloader(conf.CertFile, conf.KeyFile, conf.CertReloadInterval)
+		if err != nil {
+			return nil, nil, fmt.Errorf("load tls certificate failed:%v", err)
+		}
+		tlsConfig.Certificates = nil
+		tlsConfig.GetCertificate = reloader.GetCertificate
+	}
+	if len(tlsConfig.Certificates) == 0 && tlsConfig.GetCertificate == nil && tlsConfig.GetConfigForClient == nil {
+		return nil, nil, errors.New("no tls certificate configured")
+	}
+	if len(conf.ClientCAFile) != 0 {
+		pem, err := os.ReadFile(conf.ClientCAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("load client ca failed:%v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no valid certificate found in client ca file:%s", conf.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		if conf.ClientAuth == tls.NoClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	if conf.ClientAuth != tls.NoClientCert {
+		tlsConfig.ClientAuth = conf.ClientAuth
+	}
+	return tlsConfig, reloader, nil
+}
+
+//立即重新加载所有TLS监听的证书文件，用于证书更新后不等待自动检查的场景
+func (s *MqttServer) ReloadCertificate() error {
+	s.certReloadersMu.Lock()
+	reloaders := s.certReloaders
+	s.certReloadersMu.Unlock()
+	if len(reloaders) == 0 {
+		return errors.New("tls certificate is not loaded from files")
+	}
+	for _, reloader := range reloaders {
+		if err := reloader.reload(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//获取TLS连接的状态，非TLS连接返回nil
+func tlsConnectionState(conn net.Conn) *tls.ConnectionState {
+	if sc, ok := conn.(*statsConn); ok {
+		conn = sc.Conn
+	}
+	switch c := conn.(type) {
+	case *tls.Conn:
+		state := c.ConnectionState()
+		return &state
+	case *websocket.Conn:
+		return c.TLSConnectionState()
+	}
+	return nil
+}
+
+//获取已通过CA校验的客户端证书，没有提供证书或证书未经校验时返回nil
+func verifiedPeerCertificate(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	return state.PeerCertificates[0]
+}
+
+//按照配置的方式从客户端证书中取出身份信息
+func certificateIdentity(cert *x509.Certificate, source config.CertIdentitySource) string {
+	if cert == nil {
+		return ""
+	}
+	switch source {
+	case config.CertIdentityCN:
+		return cert.Subject.CommonName
+	case config.CertIdentitySAN:
+		if len(cert.DNSNames) != 0 {
+			return cert.DNSNames[0]
+		}
+		if len(cert.URIs) != 0 {
+			return cert.URIs[0].String()
+		}
+		if len(cert.EmailAddresses) != 0 {
+			return cert.EmailAddresses[0]
+		}
+	case config.CertIdentityOU:
+		if len(cert.Subject.OrganizationalUnit) != 0 {
+			return cert.Subject.OrganizationalUnit[0]
+		}
+	}
+	return ""
+}
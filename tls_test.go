@@ -0,0 +1,212 @@
+package mqtt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/config"
+	"github.com/davidfantasy/embedded-mqtt-broker/packets"
+	"github.com/davidfantasy/embedded-mqtt-broker/security"
+	"github.com/stretchr/testify/assert"
+)
+
+//生成证书，parent为nil时生成自签名证书
+func generateTestCertificate(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	return cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+//生成自签名的服务端证书并写入dir目录，返回证书和私钥的文件路径
+func writeTestCertificate(t *testing.T, dir string, serial int64) (string, string) {
+	_, _, certPEM, keyPEM := generateTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, nil, nil)
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	assert.NoError(t, os.WriteFile(certFile, certPEM, 0600))
+	assert.NoError(t, os.WriteFile(keyFile, keyPEM, 0600))
+	return certFile, keyFile
+}
+
+func TestTLSListener(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, 1)
+	tlsConf := config.NewDefaultTLSConfig()
+	tlsConf.CertFile = certFile
+	tlsConf.KeyFile = keyFile
+	tlsConf.CertReloadInterval = 0
+	tlsConfig, reloader, err := newTLSConfig(tlsConf)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), tlsConfig.MinVersion)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	assert.NoError(t, err)
+	defer listener.Close()
+	server := newTestServer()
+	server.certReloaders = []*certReloader{reloader}
+	go server.serve(listener, newListener(&config.ListenerConfig{Name: "tls", Type: config.ListenerTLS, TLS: tlsConf}))
+
+	dial := func() *tls.Conn {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		assert.NoError(t, err)
+		return conn
+	}
+	conn := dial()
+	defer conn.Close()
+	assert.Equal(t, int64(1), conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64())
+	assert.NoError(t, newTestConnectPacket("tls-client", true).Write(conn))
+	connack, ok := readTestPacket(t, conn).(*packets.ConnackPacket)
+	assert.True(t, ok)
+	assert.Equal(t, byte(packets.Accepted), connack.ReturnCode)
+
+	//更新证书文件后，新的连接使用新的证书
+	writeTestCertificate(t, dir, 2)
+	future := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(certFile, future, future))
+	reloaded := dial()
+	defer reloaded.Close()
+	assert.Equal(t, int64(2), reloaded.ConnectionState().PeerCertificates[0].SerialNumber.Int64())
+	assert.NoError(t, server.ReloadCertificate())
+}
+
+func TestReloadCertificateConcurrently(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir(), 1)
+	tlsConf := config.NewDefaultTLSConfig()
+	tlsConf.CertFile = certFile
+	tlsConf.KeyFile = keyFile
+	tlsConf.CertReloadInterval = 0
+	server := newTestServer()
+	_, err := server.newListenerTLSConfig(tlsConf)
+	assert.NoError(t, err)
+	//启动监听时加载证书与重新加载证书可能同时发生
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := server.newListenerTLSConfig(tlsConf)
+			assert.NoError(t, err)
+		}()
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, server.ReloadCertificate())
+		}()
+	}
+	wg.Wait()
+}
+
+func TestTLSConfigWithoutCertificate(t *testing.T) {
+	_, _, err := newTLSConfig(config.NewDefaultTLSConfig())
+	assert.Error(t, err)
+}
+
+//记录认证时收到的客户端证书
+type testCertAuthProvider struct {
+	cert     *x509.Certificate
+	username string
+}
+
+func (p *testCertAuthProvider) Authenticate(username, password string) *security.Authentication {
+	return nil
+}
+
+func (p *testCertAuthProvider) AuthenticateCertificate(cert *x509.Certificate, username, password string) *security.Authentication {
+	p.cert = cert
+	p.username = username
+	if cert == nil {
+		return nil
+	}
+	return security.NewAuthentication([]security.Acl{{Topic: "devices/" + username + "/#", Access: security.CanSubPub}})
+}
+
+func TestClientCertificateAuthentication(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, 1)
+	ca, caKey, caPEM, _ := generateTestCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(10),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}, nil, nil)
+	caFile := filepath.Join(dir, "ca.crt")
+	assert.NoError(t, os.WriteFile(caFile, caPEM, 0600))
+	_, _, clientPEM, clientKeyPEM := generateTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(11),
+		Subject:      pkix.Name{CommonName: "device-001", OrganizationalUnit: []string{"plant-a"}},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	clientCert, err := tls.X509KeyPair(clientPEM, clientKeyPEM)
+	assert.NoError(t, err)
+
+	tlsConf := config.NewDefaultTLSConfig()
+	tlsConf.CertFile = certFile
+	tlsConf.KeyFile = keyFile
+	tlsConf.ClientCAFile = caFile
+	tlsConf.CertIdentity = config.CertIdentityCN
+	authProvider := &testCertAuthProvider{}
+	l := newListener(&config.ListenerConfig{Name: "devices", Type: config.ListenerTLS, Address: "127.0.0.1:0", TLS: tlsConf, AuthProvider: authProvider})
+	server := newTestServer()
+	listener, err := server.listen(l)
+	assert.NoError(t, err)
+	defer listener.Close()
+	go server.serve(listener, l)
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{clientCert}})
+	assert.NoError(t, err)
+	defer conn.Close()
+	//证书中的CN会替换客户端提供的用户名和clientId
+	cp := newTestConnectPacket("any-id", true)
+	cp.ProtocolVersion = packets.MQTT5
+	assert.NoError(t, cp.Write(conn))
+	connack, ok := readTestPacketWithVersion(t, conn, packets.MQTT5).(*packets.ConnackPacket)
+	assert.True(t, ok)
+	assert.Equal(t, byte(packets.ReasonSuccess), connack.ReturnCode)
+	assert.Equal(t, "device-001", connack.Properties.AssignedClientID)
+	assert.Equal(t, "device-001", authProvider.username)
+	assert.Equal(t, "device-001", authProvider.cert.Subject.CommonName)
+	c := server.clients.FindClient("device-001")
+	assert.NotNil(t, c)
+	assert.Equal(t, "devices", c.Listener)
+}
+
+func TestCertificateIdentity(t *testing.T) {
+	uri, _ := url.Parse("spiffe://plant/device-002")
+	cert := &x509.Certificate{
+		Subject: pkix.Name{CommonName: "device-001", OrganizationalUnit: []string{"plant-a"}},
+		URIs:    []*url.URL{uri},
+	}
+	assert.Equal(t, "device-001", certificateIdentity(cert, config.CertIdentityCN))
+	assert.Equal(t, "spiffe://plant/device-002", certificateIdentity(cert, config.CertIdentitySAN))
+	assert.Equal(t, "plant-a", certificateIdentity(cert, config.CertIdentityOU))
+	assert.Equal(t, "", certificateIdentity(nil, config.CertIdentityCN))
+}
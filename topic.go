@@ -1,136 +1,310 @@
 package mqtt
 
 import (
+	"sort"
 	"strings"
 	"sync"
 
 	"github.com/davidfantasy/embedded-mqtt-broker/client"
+	"github.com/davidfantasy/embedded-mqtt-broker/config"
 	"github.com/davidfantasy/embedded-mqtt-broker/consts"
-	"github.com/davidfantasy/embedded-mqtt-broker/event"
+	"github.com/davidfantasy/embedded-mqtt-broker/packets"
 	"github.com/davidfantasy/embedded-mqtt-broker/trie"
 )
 
-var subscribeMu sync.Mutex
+//保存一个服务端实例的所有订阅关系
+type subscriptionStore struct {
+	mu sync.Mutex
+	//所有已订阅topic构成的前缀树，注意第一级节点为根节点，不保存实际的topic值
+	subscribedTopics *trie.TopicTrie
+	sessionTopicMap  map[string][]string
+	topicSessionMap  map[string][]string
+	//会话对每个topic订阅时授予的qos
+	sessionTopicQosMap map[string]map[string]byte
+	//mqtt 5.0的会话对topic订阅时指定的订阅选项，只保存非默认值的选项
+	sessionTopicOptionsMap map[string]map[string]packets.SubOptions
+	//共享订阅的topic过滤器 -> 组名 -> 共享订阅组
+	sharedGroupMap map[string]map[string]*sharedGroup
+	//进程内订阅者，key为其sessionId
+	local map[string]*LocalSubscription
+	//用于判断共享订阅组的成员是否在线
+	clients *client.Registry
+}
 
-//所有已订阅topic构成的前缀树，注意第一级节点为根节点，不保存实际的topic值
-var subscribedTopics *trie.TopicTrie = trie.NewRootTopicTrie()
+//某个会话对topic的一条订阅
+type Subscription struct {
+	SessionId string
+	Qos       byte
+	//不接收该会话对应的clientId自己发布的消息
+	NoLocal bool
+	//转发消息时保留发布者设置的retain标志
+	RetainAsPublished bool
+}
 
-var sessionTopicMap map[string][]string = make(map[string][]string)
-var topicSessionMap map[string][]string = make(map[string][]string)
+func newSubscriptionStore(clients *client.Registry) *subscriptionStore {
+	return &subscriptionStore{
+		subscribedTopics:       trie.NewRootTopicTrie(),
+		sessionTopicMap:        make(map[string][]string),
+		topicSessionMap:        make(map[string][]string),
+		sessionTopicQosMap:     make(map[string]map[string]byte),
+		sessionTopicOptionsMap: make(map[string]map[string]packets.SubOptions),
+		sharedGroupMap:         make(map[string]map[string]*sharedGroup),
+		local:                  make(map[string]*LocalSubscription),
+		clients:                clients,
+	}
+}
 
-func init() {
-	event.DefaultEventBus.Subscribe(event.SESSION_EXPIRIED, func(event event.Event) {
-		session := event.Data.(*client.Session)
-		UnsubscribeAll(session.Id)
-	})
+//订阅topic，支持$share/{group}/{filter}格式的共享订阅
+func (st *subscriptionStore) Subscribe(topic string, sessionId string, qos byte) error {
+	_, err := st.subscribeWithOptions(topic, sessionId, qos, packets.SubOptions{})
+	return err
 }
 
-func Subscribe(topic string, sessionId string) {
+//按照mqtt 5.0的订阅选项订阅topic，返回该订阅之前是否已经存在
+func (st *subscriptionStore) subscribeWithOptions(topic string, sessionId string, qos byte, options packets.SubOptions) (bool, error) {
 	if len(topic) == 0 || len(sessionId) == 0 {
-		return
+		return false, nil
 	}
-	parts := strings.Split(topic, consts.TOPIC_PART_SPLITTER)
-	subscribeMu.Lock()
-	defer subscribeMu.Unlock()
-	//已经订阅了则不再处理
-	if hasSubscribed(topic, sessionId) {
+	group, filter, err := parseSubscription(topic)
+	if err != nil {
+		return false, err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	//已经订阅了则只更新qos和订阅选项
+	if st.hasSubscribed(topic, sessionId) {
+		st.sessionTopicQosMap[sessionId][topic] = qos
+		st.setOptions(sessionId, topic, options)
+		return true, nil
+	}
+	st.subscribedTopics.Insert(strings.Split(filter, consts.TOPIC_PART_SPLITTER), "")
+	st.bindTopicAndSession(sessionId, topic, qos)
+	st.setOptions(sessionId, topic, options)
+	if len(group) > 0 {
+		st.joinSharedGroup(sessionId, group, filter)
+	}
+	return false, nil
+}
+
+func (st *subscriptionStore) setOptions(sessionId string, topic string, options packets.SubOptions) {
+	topicOptions := st.sessionTopicOptionsMap[sessionId]
+	if options == (packets.SubOptions{}) {
+		if topicOptions != nil {
+			delete(topicOptions, topic)
+			if len(topicOptions) == 0 {
+				delete(st.sessionTopicOptionsMap, sessionId)
+			}
+		}
 		return
 	}
-	subscribedTopics.Insert(parts, "")
-	bindTopicAndSession(sessionId, topic)
+	if topicOptions == nil {
+		topicOptions = make(map[string]packets.SubOptions)
+		st.sessionTopicOptionsMap[sessionId] = topicOptions
+	}
+	topicOptions[topic] = options
+}
+
+//解析并校验订阅的topic过滤器，返回共享订阅的组名（非共享订阅为空）和实际的topic过滤器
+func parseSubscription(topic string) (string, string, error) {
+	group, filter, err := parseSharedSubscription(topic)
+	if err != nil {
+		return "", "", err
+	}
+	if err := trie.ValidateTopicFilter(filter); err != nil {
+		return "", "", err
+	}
+	return group, filter, nil
 }
 
 //找到某个topic的所有订阅者
-func GetSubscriber(topic string) []string {
+func (st *subscriptionStore) GetSubscriber(topic string) []string {
+	subscriptions := st.GetSubscriptions(topic)
+	if len(subscriptions) == 0 {
+		return nil
+	}
+	sessionIds := make([]string, len(subscriptions))
+	for i, sub := range subscriptions {
+		sessionIds[i] = sub.SessionId
+	}
+	return sessionIds
+}
+
+//找到某个topic的所有订阅，同一个会话有多个订阅匹配时取其中最大的qos，只要有一个订阅没有设置NoLocal就需要投递，
+//共享订阅按照轮询策略从每个组中选出一个订阅者
+func (st *subscriptionStore) GetSubscriptions(topic string) []Subscription {
+	return st.matchSubscriptions(topic, "", config.SharedRoundRobin)
+}
+
+//找到某个topic的所有订阅，publisher为消息发布者的clientId，用于共享订阅的负载均衡
+func (st *subscriptionStore) matchSubscriptions(topic string, publisher string, strategy config.SharedSubscriptionStrategy) []Subscription {
 	if len(topic) == 0 {
 		return nil
 	}
 	parts := strings.Split(topic, consts.TOPIC_PART_SPLITTER)
-	subscribeMu.Lock()
-	defer subscribeMu.Unlock()
-	tries := subscribedTopics.MatchMany(parts)
-	var clients map[string]interface{} = make(map[string]interface{})
-	var clientsSlice []string
+	online := st.onlineMembers(parts)
+	isOnline := func(sessionId string) bool {
+		return st.isOnline(sessionId, online)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	tries := st.subscribedTopics.MatchMany(parts)
+	//对匹配到的sessionId去重
+	matched := make(map[string]*Subscription)
+	merge := func(sessionId string, topic string) {
+		qos := st.sessionTopicQosMap[sessionId][topic]
+		options := st.sessionTopicOptionsMap[sessionId][topic]
+		sub, ok := matched[sessionId]
+		if !ok {
+			matched[sessionId] = &Subscription{SessionId: sessionId, Qos: qos, NoLocal: options.NoLocal, RetainAsPublished: options.RetainAsPublished}
+			return
+		}
+		if qos > sub.Qos {
+			sub.Qos = qos
+		}
+		sub.NoLocal = sub.NoLocal && options.NoLocal
+		sub.RetainAsPublished = sub.RetainAsPublished || options.RetainAsPublished
+	}
 	for _, t := range tries {
-		subscribers := topicSessionMap[t.GetTopic()]
-		for _, clientId := range subscribers {
-			//对添加的clientId去重
-			if _, ok := clients[clientId]; !ok {
-				clients[clientId] = struct{}{}
-				clientsSlice = append(clientsSlice, clientId)
-			}
+		for _, sessionId := range st.topicSessionMap[t.GetTopic()] {
+			merge(sessionId, t.GetTopic())
 		}
+		//每个共享订阅组只会选出一个成员接收消息
+		for _, group := range st.sharedGroupMap[t.GetTopic()] {
+			sessionId := group.pick(topic, publisher, strategy, isOnline)
+			shareTopic := consts.SHARED_SUBSCRIPTION_PREFIX + consts.TOPIC_PART_SPLITTER + group.name + consts.TOPIC_PART_SPLITTER + t.GetTopic()
+			merge(sessionId, shareTopic)
+		}
+	}
+	subscriptions := make([]Subscription, 0, len(matched))
+	for _, sub := range matched {
+		subscriptions = append(subscriptions, *sub)
 	}
-	return clientsSlice
+	sort.Slice(subscriptions, func(i, j int) bool {
+		return subscriptions[i].SessionId < subscriptions[j].SessionId
+	})
+	return subscriptions
 }
 
-func Unsubscribe(topic string, clientId string) {
-	if len(topic) == 0 || len(clientId) == 0 {
-		return
+//取消会话对某个topic的订阅，如果该订阅不存在则返回false
+func (st *subscriptionStore) Unsubscribe(topic string, sessionId string) bool {
+	if len(topic) == 0 || len(sessionId) == 0 {
+		return false
 	}
-	subscribeMu.Lock()
-	defer subscribeMu.Unlock()
-	hasSubscriber := unbindTopicAndSession(topic, clientId)
-	//如果某个topic已经没有订阅者了，则从字典树中删除
-	if !hasSubscriber {
-		parts := strings.Split(topic, consts.TOPIC_PART_SPLITTER)
-		subscribedTopics.Remove(parts)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.hasSubscribed(topic, sessionId) {
+		return false
 	}
+	st.unbindTopicAndSession(sessionId, topic)
+	st.subscribedTopics.Remove(strings.Split(subscriptionFilter(topic), consts.TOPIC_PART_SPLITTER))
+	return true
 }
 
-func UnsubscribeAll(sessionId string) {
+func (st *subscriptionStore) UnsubscribeAll(sessionId string) {
 	if len(sessionId) == 0 {
 		return
 	}
-	subscribeMu.Lock()
-	defer subscribeMu.Unlock()
-	if topics, ok := sessionTopicMap[sessionId]; ok {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if topics, ok := st.sessionTopicMap[sessionId]; ok {
 		//复制一份数据，避免循环时对topic进行了修改后会导致index错乱
 		topicsCopy := make([]string, len(topics))
 		copy(topicsCopy, topics)
 		for _, topic := range topicsCopy {
-			hasSubscriber := unbindTopicAndSession(sessionId, topic)
-			if !hasSubscriber {
-				parts := strings.Split(topic, consts.TOPIC_PART_SPLITTER)
-				subscribedTopics.Remove(parts)
-			}
+			st.unbindTopicAndSession(sessionId, topic)
+			//字典树节点的引用数与订阅数一致，每移除一个订阅都需要减少一次引用
+			st.subscribedTopics.Remove(strings.Split(subscriptionFilter(topic), consts.TOPIC_PART_SPLITTER))
 		}
 	}
 }
 
-func bindTopicAndSession(sessionId string, topic string) {
-	topics := sessionTopicMap[sessionId]
+//当前所有会话的订阅总数
+func (st *subscriptionStore) CountSubscriptions() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	count := 0
+	for _, topics := range st.sessionTopicMap {
+		count += len(topics)
+	}
+	return count
+}
+
+//订阅前缀树中已订阅的topic过滤器节点数量
+func (st *subscriptionStore) countTopicNodes() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.subscribedTopics.CountNodes()
+}
+
+//某个会话的所有订阅，按照topic过滤器排序
+func (st *subscriptionStore) sessionSubscriptions(sessionId string) []SubscriptionInfo {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	topicQos := st.sessionTopicQosMap[sessionId]
+	subscriptions := make([]SubscriptionInfo, 0, len(topicQos))
+	for topic, qos := range topicQos {
+		subscriptions = append(subscriptions, SubscriptionInfo{Filter: topic, Qos: qos})
+	}
+	sort.Slice(subscriptions, func(i, j int) bool {
+		return subscriptions[i].Filter < subscriptions[j].Filter
+	})
+	return subscriptions
+}
+
+func (st *subscriptionStore) bindTopicAndSession(sessionId string, topic string, qos byte) {
+	topics := st.sessionTopicMap[sessionId]
 	if topics == nil {
 		topics = make([]string, 0)
 	}
-	sessionTopicMap[sessionId] = append(topics, topic)
-	clients := topicSessionMap[topic]
+	st.sessionTopicMap[sessionId] = append(topics, topic)
+	topicQos := st.sessionTopicQosMap[sessionId]
+	if topicQos == nil {
+		topicQos = make(map[string]byte)
+		st.sessionTopicQosMap[sessionId] = topicQos
+	}
+	topicQos[topic] = qos
+	//共享订阅的订阅者保存在共享订阅组中
+	if group, _, _ := parseSharedSubscription(topic); len(group) > 0 {
+		return
+	}
+	clients := st.topicSessionMap[topic]
 	if clients == nil {
 		clients = make([]string, 0)
 	}
-	topicSessionMap[topic] = append(clients, sessionId)
+	st.topicSessionMap[topic] = append(clients, sessionId)
 }
 
-func unbindTopicAndSession(sessionId string, topic string) bool {
+func (st *subscriptionStore) unbindTopicAndSession(sessionId string, topic string) bool {
 	//该topic是否还有订阅者
 	var hasSubscriber bool = true
-	topics := sessionTopicMap[sessionId]
+	topics := st.sessionTopicMap[sessionId]
 	if topics != nil {
 		topics = removeString(topics, topic)
 		if len(topics) == 0 {
-			delete(sessionTopicMap, sessionId)
+			delete(st.sessionTopicMap, sessionId)
 		} else {
-			sessionTopicMap[sessionId] = topics
+			st.sessionTopicMap[sessionId] = topics
 		}
 	}
-	clients := topicSessionMap[topic]
+	if topicQos := st.sessionTopicQosMap[sessionId]; topicQos != nil {
+		delete(topicQos, topic)
+		if len(topicQos) == 0 {
+			delete(st.sessionTopicQosMap, sessionId)
+		}
+	}
+	st.setOptions(sessionId, topic, packets.SubOptions{})
+	if group, filter, _ := parseSharedSubscription(topic); len(group) > 0 {
+		st.leaveSharedGroup(sessionId, group, filter)
+		return st.sharedGroupMap[filter][group] != nil
+	}
+	clients := st.topicSessionMap[topic]
 	if clients != nil {
 		clients = removeString(clients, sessionId)
 		if len(clients) == 0 {
-			delete(topicSessionMap, topic)
+			delete(st.topicSessionMap, topic)
 			hasSubscriber = false
 		} else {
-			topicSessionMap[topic] = clients
+			st.topicSessionMap[topic] = clients
 		}
 	} else {
 		hasSubscriber = false
@@ -138,8 +312,8 @@ func unbindTopicAndSession(sessionId string, topic string) bool {
 	return hasSubscriber
 }
 
-func hasSubscribed(topic string, clientId string) bool {
-	subTopics := sessionTopicMap[clientId]
+func (st *subscriptionStore) hasSubscribed(topic string, clientId string) bool {
+	subTopics := st.sessionTopicMap[clientId]
 	if subTopics == nil {
 		return false
 	}
@@ -3,63 +3,130 @@ package mqtt
 import (
 	"testing"
 
+	"github.com/davidfantasy/embedded-mqtt-broker/client"
+	"github.com/davidfantasy/embedded-mqtt-broker/config"
+	"github.com/davidfantasy/embedded-mqtt-broker/event"
 	"github.com/stretchr/testify/assert"
 )
 
+func newTestSubscriptionStore() *subscriptionStore {
+	return newSubscriptionStore(client.NewRegistry(config.NewDefaultConfig(), event.NewAsyncEventBus()))
+}
+
 func TestAddSubscriber(t *testing.T) {
-	Subscribe("t/a/b", "c1")
-	Subscribe("t/a/c", "c1")
-	Subscribe("t/b/#", "c1")
-	Subscribe("t/a/+", "c2")
-	Subscribe("t/+/+/a", "c2")
+	store := newTestSubscriptionStore()
+	store.Subscribe("t/a/b", "c1", 0)
+	store.Subscribe("t/a/c", "c1", 0)
+	store.Subscribe("t/b/#", "c1", 0)
+	store.Subscribe("t/a/+", "c2", 0)
+	store.Subscribe("t/+/+/a", "c2", 0)
 	//测试重复订阅
-	Subscribe("t/+/+/a", "c2")
-	Subscribe("t/b/#", "c3")
-	Subscribe("t/c/user/1", "c3")
-	Subscribe("t/c/user/2", "c3")
-	assert.Equal(t, 3, len(sessionTopicMap["c1"]), "topic count must equal")
-	assert.Equal(t, 2, len(sessionTopicMap["c2"]), "topic count must equal")
-	assert.Equal(t, 3, len(sessionTopicMap["c3"]), "topic count must equal")
-	sessions := GetSubscriber("t/c/2")
+	store.Subscribe("t/+/+/a", "c2", 0)
+	store.Subscribe("t/b/#", "c3", 0)
+	store.Subscribe("t/c/user/1", "c3", 0)
+	store.Subscribe("t/c/user/2", "c3", 0)
+	assert.Equal(t, 3, len(store.sessionTopicMap["c1"]), "topic count must equal")
+	assert.Equal(t, 2, len(store.sessionTopicMap["c2"]), "topic count must equal")
+	assert.Equal(t, 3, len(store.sessionTopicMap["c3"]), "topic count must equal")
+	sessions := store.GetSubscriber("t/c/2")
 	assert.Equal(t, 0, len(sessions), "session must equal")
-	sessions = GetSubscriber("t/c/user/1")
+	sessions = store.GetSubscriber("t/c/user/1")
 	assert.Equal(t, []string{"c3"}, sessions, "session must equal")
-	sessions = GetSubscriber("t/a/b")
+	sessions = store.GetSubscriber("t/a/b")
 	assert.Equal(t, []string{"c1", "c2"}, sessions, "session must equal")
-	sessions = GetSubscriber("t/s/m/a")
+	sessions = store.GetSubscriber("t/s/m/a")
 	assert.Equal(t, []string{"c2"}, sessions, "session must equal")
-	sessions = GetSubscriber("t/b/s/m/d")
+	sessions = store.GetSubscriber("t/b/s/m/d")
 	assert.Equal(t, []string{"c1", "c3"}, sessions, "session must equal")
 }
 
 func TestUnsubscribe(t *testing.T) {
-	Subscribe("t/a/b", "c1")
-	Subscribe("t/a/c", "c1")
-	Subscribe("t/b/#", "c1")
-	Subscribe("t/a/+", "c2")
-	Subscribe("t/+/+/a", "c2")
-	Subscribe("t/+/+/a", "c2")
-	Subscribe("t/b/#", "c3")
-	Subscribe("t/c/user/1", "c3")
-	Subscribe("t/c/user/2", "c3")
-	sessions := GetSubscriber("t/a/b")
+	store := newTestSubscriptionStore()
+	store.Subscribe("t/a/b", "c1", 0)
+	store.Subscribe("t/a/c", "c1", 0)
+	store.Subscribe("t/b/#", "c1", 0)
+	store.Subscribe("t/a/+", "c2", 0)
+	store.Subscribe("t/+/+/a", "c2", 0)
+	store.Subscribe("t/+/+/a", "c2", 0)
+	store.Subscribe("t/b/#", "c3", 0)
+	store.Subscribe("t/c/user/1", "c3", 0)
+	store.Subscribe("t/c/user/2", "c3", 0)
+	sessions := store.GetSubscriber("t/a/b")
 	assert.Contains(t, sessions, "c1", "client must equal")
 	assert.Contains(t, sessions, "c2", "client must equal")
-	Unsubscribe("t/a/b", "c1")
-	sessions = GetSubscriber("t/a/b")
+	store.Unsubscribe("t/a/b", "c1")
+	sessions = store.GetSubscriber("t/a/b")
 	assert.Equal(t, []string{"c2"}, sessions, "client must equal")
-	Unsubscribe("t/a/+", "c2")
-	sessions = GetSubscriber("t/a/b")
+	store.Unsubscribe("t/a/+", "c2")
+	sessions = store.GetSubscriber("t/a/b")
 	assert.Equal(t, len(sessions), 0, "client must equal")
-	UnsubscribeAll("c3")
-	sessions = GetSubscriber("t/c/user/1")
+	store.UnsubscribeAll("c3")
+	sessions = store.GetSubscriber("t/c/user/1")
 	assert.Equal(t, len(sessions), 0, "client must equal")
-	sessions = GetSubscriber("t/c/user/2")
+	sessions = store.GetSubscriber("t/c/user/2")
 	assert.Equal(t, len(sessions), 0, "client must equal")
 	//测试重复移除
-	Unsubscribe("t/a/b", "c1")
+	store.Unsubscribe("t/a/b", "c1")
 	//测试不存在的客户端ID
-	Unsubscribe("t/a/b", "not_existed_client")
+	store.Unsubscribe("t/a/b", "not_existed_client")
 	//测试移除不存在的topic
-	Unsubscribe("t/s", "c1")
+	store.Unsubscribe("t/s", "c1")
+}
+
+func TestSharedSubscription(t *testing.T) {
+	store := newTestSubscriptionStore()
+	store.Subscribe("$share/g1/s/+/data", "s1", 1)
+	store.Subscribe("$share/g1/s/+/data", "s2", 0)
+	store.Subscribe("$share/g2/s/#", "s3", 0)
+	store.Subscribe("s/a/data", "s4", 0)
+	//每个共享订阅组按轮询各选出一个订阅者
+	sessions := store.GetSubscriber("s/a/data")
+	assert.Equal(t, []string{"s1", "s3", "s4"}, sessions, "session must equal")
+	sessions = store.GetSubscriber("s/a/data")
+	assert.Equal(t, []string{"s2", "s3", "s4"}, sessions, "session must equal")
+	subscriptions := store.GetSubscriptions("s/a/data")
+	assert.Equal(t, Subscription{SessionId: "s1", Qos: 1}, subscriptions[0], "subscription must equal")
+	//取消共享订阅后不再参与负载均衡
+	assert.True(t, store.Unsubscribe("$share/g1/s/+/data", "s1"))
+	sessions = store.GetSubscriber("s/a/data")
+	assert.Equal(t, []string{"s2", "s3", "s4"}, sessions, "session must equal")
+	assert.False(t, store.Unsubscribe("s/+/data", "s2"))
+	store.UnsubscribeAll("s2")
+	store.UnsubscribeAll("s3")
+	sessions = store.GetSubscriber("s/a/data")
+	assert.Equal(t, []string{"s4"}, sessions, "session must equal")
+	assert.Nil(t, store.sharedGroupMap["s/+/data"], "shared group must be removed")
+	assert.Nil(t, store.sharedGroupMap["s/#"], "shared group must be removed")
+	store.UnsubscribeAll("s4")
+	//非法的共享订阅
+	assert.Error(t, store.Subscribe("$share/g1", "s1", 0))
+	assert.Error(t, store.Subscribe("$share//s/a", "s1", 0))
+	assert.Error(t, store.Subscribe("$share/g+/s/a", "s1", 0))
+}
+
+func TestSharedSubscriptionStrategy(t *testing.T) {
+	store := newTestSubscriptionStore()
+	store.Subscribe("$share/g/h/#", "h1", 0)
+	store.Subscribe("$share/g/h/#", "h2", 0)
+	store.Subscribe("$share/g/h/#", "h3", 0)
+	defer func() {
+		for _, id := range []string{"h1", "h2", "h3"} {
+			store.UnsubscribeAll(id)
+		}
+	}()
+	first := store.matchSubscriptions("h/1", "p1", config.SharedSticky)
+	second := store.matchSubscriptions("h/2", "p1", config.SharedSticky)
+	other := store.matchSubscriptions("h/1", "p2", config.SharedSticky)
+	assert.Equal(t, first, second, "same publisher must stick to the same member")
+	assert.NotEqual(t, first, other, "different publisher must be balanced")
+	//发布者断开后不再保留其粘性成员
+	group := store.sharedGroupMap["h/#"]["g"]
+	assert.Len(t, group.sticky, 2)
+	store.forgetPublisher("p1")
+	assert.Len(t, group.sticky, 1)
+	assert.NotContains(t, group.sticky, "p1")
+	first = store.matchSubscriptions("h/1", "p1", config.SharedTopicHash)
+	second = store.matchSubscriptions("h/1", "p2", config.SharedTopicHash)
+	assert.Equal(t, first, second, "same topic must be delivered to the same member")
+	assert.Equal(t, 1, len(store.matchSubscriptions("h/1", "p1", config.SharedRandom)))
 }
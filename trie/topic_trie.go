@@ -93,6 +93,10 @@ func (trie *TopicTrie) searchTrieWithMutiMatch(topicParts []string) []*TopicTrie
 			}
 		}
 	}
+	//以$开头的topic不能被第一级的通配符匹配
+	if trie.parent == nil && isSystemTopicPart(part) {
+		return tries
+	}
 	//单层通配符处理
 	singleWildNext := trie.children[SINGLE_WILDCARD]
 	if singleWildNext != nil {
@@ -114,6 +118,7 @@ func (trie *TopicTrie) searchTrieWithMutiMatch(topicParts []string) []*TopicTrie
 }
 
 //查找与某个topic最匹配的节点，如果没有找到，则返回nil
+//该方法用于权限判断，第一级的通配符同样可以匹配以$开头的topic
 func (trie *TopicTrie) MatchOne(topicParts []string) *TopicTrie {
 	result := trie.searchTrieWithSingleMatch(topicParts)
 	size := len(topicParts)
@@ -209,3 +214,27 @@ func (trie *TopicTrie) IsEnded() bool {
 func (trie *TopicTrie) GetTopic() string {
 	return trie.topic
 }
+
+//判断topic是否与含通配符的topic过滤器相匹配
+func IsMatched(filterParts []string, topicParts []string) bool {
+	if len(filterParts) > 0 && len(topicParts) > 0 && isSystemTopicPart(topicParts[0]) && filterParts[0] != topicParts[0] {
+		return false
+	}
+	for i, part := range filterParts {
+		if part == MULTI_WILDCARD {
+			return true
+		}
+		if i >= len(topicParts) {
+			return false
+		}
+		if part != SINGLE_WILDCARD && part != topicParts[i] {
+			return false
+		}
+	}
+	return len(filterParts) == len(topicParts)
+}
+
+//以$开头的topic（如$SYS）为服务端内部使用，第一级的通配符不能匹配这类topic
+func isSystemTopicPart(part string) bool {
+	return strings.HasPrefix(part, "$")
+}
@@ -137,3 +137,40 @@ func nodeValueEQ(t *testing.T, node *TopicTrie, expectedVal interface{}) {
 	}
 	assert.Equal(t, expectedVal, node.Value, "Node value must equal")
 }
+
+func TestIsMatched(t *testing.T) {
+	tests := []struct {
+		filter   string
+		topic    string
+		expected bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a/b/c", true},
+		{"a/#", "a", true},
+		{"+/+", "a", false},
+		{"a/b/c", "a/b", false},
+		{"#", "$SYS/broker/uptime", false},
+		{"+/broker/uptime", "$SYS/broker/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"a/+/c", "a/$b/c", true},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%v-%v", test.filter, test.topic), func(t *testing.T) {
+			assert.Equal(t, test.expected, IsMatched(topic2parts(test.filter), topic2parts(test.topic)))
+		})
+	}
+}
+
+func TestMatchSystemTopic(t *testing.T) {
+	root := NewRootTopicTrie()
+	root.Insert(topic2parts("#"), "")
+	root.Insert(topic2parts("+/broker/#"), "")
+	root.Insert(topic2parts("$SYS/#"), "")
+	tries := root.MatchMany(topic2parts("$SYS/broker/uptime"))
+	assert.Equal(t, 1, len(tries))
+	assert.Equal(t, "$SYS/#", tries[0].GetTopic())
+	assert.Equal(t, 2, len(root.MatchMany(topic2parts("a/broker/uptime"))))
+	assert.Equal(t, "$SYS/#", root.MatchOne(topic2parts("$SYS/broker/uptime")).GetTopic())
+}
@@ -0,0 +1,67 @@
+package trie
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/consts"
+)
+
+//topic的最大长度，与mqtt协议中UTF-8字符串的长度上限一致
+const MAX_TOPIC_LENGTH = 65535
+
+var (
+	ErrEmptyTopic            = errors.New("topic must not be empty")
+	ErrTopicTooLong          = errors.New("topic exceeds the maximum length")
+	ErrInvalidUTF8Topic      = errors.New("topic is not a valid UTF-8 string")
+	ErrNullCharInTopic       = errors.New("topic must not contain the null character")
+	ErrWildcardInTopicName   = errors.New("topic name must not contain wildcards")
+	ErrInvalidMultiWildcard  = errors.New("multi-level wildcard must occupy the last level of the topic filter")
+	ErrInvalidSingleWildcard = errors.New("single-level wildcard must occupy an entire level of the topic filter")
+)
+
+//校验发布消息时使用的topic名称，topic名称中不能包含通配符
+func ValidateTopicName(topic string) error {
+	if err := validateTopicString(topic); err != nil {
+		return err
+	}
+	if strings.ContainsAny(topic, MULTI_WILDCARD+SINGLE_WILDCARD) {
+		return ErrWildcardInTopicName
+	}
+	return nil
+}
+
+//校验订阅时使用的topic过滤器，#只能作为最后一级出现，通配符必须独占一级
+func ValidateTopicFilter(filter string) error {
+	if err := validateTopicString(filter); err != nil {
+		return err
+	}
+	parts := strings.Split(filter, consts.TOPIC_PART_SPLITTER)
+	for i, part := range parts {
+		if strings.Contains(part, MULTI_WILDCARD) && (part != MULTI_WILDCARD || i != len(parts)-1) {
+			return ErrInvalidMultiWildcard
+		}
+		if strings.Contains(part, SINGLE_WILDCARD) && part != SINGLE_WILDCARD {
+			return ErrInvalidSingleWildcard
+		}
+	}
+	return nil
+}
+
+func validateTopicString(topic string) error {
+	if len(topic) == 0 {
+		return ErrEmptyTopic
+	}
+	if len(topic) > MAX_TOPIC_LENGTH {
+		return ErrTopicTooLong
+	}
+	//utf8.ValidString同样会拒绝U+D800到U+DFFF之间的代理码点
+	if !utf8.ValidString(topic) {
+		return ErrInvalidUTF8Topic
+	}
+	if strings.ContainsRune(topic, 0) {
+		return ErrNullCharInTopic
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package trie
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateTopicName(t *testing.T) {
+	tests := []struct {
+		topic    string
+		expected error
+	}{
+		{"a/b/c", nil},
+		{"/a/b/", nil},
+		{"$SYS/broker", nil},
+		{"", ErrEmptyTopic},
+		{"a/+/c", ErrWildcardInTopicName},
+		{"a/#", ErrWildcardInTopicName},
+		{"a\x00b", ErrNullCharInTopic},
+		{"a/\xff", ErrInvalidUTF8Topic},
+		{strings.Repeat("a", MAX_TOPIC_LENGTH+1), ErrTopicTooLong},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, ValidateTopicName(test.topic), test.topic)
+	}
+}
+
+func TestValidateTopicFilter(t *testing.T) {
+	tests := []struct {
+		filter   string
+		expected error
+	}{
+		{"a/b/c", nil},
+		{"#", nil},
+		{"+", nil},
+		{"a/+/c/#", nil},
+		{"+/+", nil},
+		{"", ErrEmptyTopic},
+		{"a/#/b", ErrInvalidMultiWildcard},
+		{"a/b#", ErrInvalidMultiWildcard},
+		{"a+/b", ErrInvalidSingleWildcard},
+		{"a/+b", ErrInvalidSingleWildcard},
+		{"a/\x00", ErrNullCharInTopic},
+		{"\xed\xa0\x80", ErrInvalidUTF8Topic},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, ValidateTopicFilter(test.filter), test.filter)
+	}
+}
@@ -0,0 +1,258 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+//websocket帧的操作码
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+//关闭帧中的状态码
+const (
+	closeNormal          = 1000
+	closeProtocolError   = 1002
+	closeUnsupportedData = 1003
+	closeMessageTooBig   = 1009
+)
+
+//单个数据帧允许的最大长度，mqtt报文的最大长度为256MB
+const maxFramePayload = 268435455 + 5
+
+var (
+	ErrUnmaskedFrame = errors.New("websocket: client frame is not masked")
+	ErrTextFrame     = errors.New("websocket: text frame is not supported")
+	ErrInvalidFrame  = errors.New("websocket: invalid frame")
+	ErrFrameTooLarge = errors.New("websocket: frame payload too large")
+)
+
+//将websocket的二进制帧适配为字节流的net.Conn，数据帧的边界与mqtt报文的边界无关
+type Conn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	//客户端发送的帧需要使用掩码，服务端发送的帧不能使用掩码
+	isClient bool
+	//协商后的子协议
+	subprotocol string
+	tlsState    *tls.ConnectionState
+	//当前数据帧中还未读取的字节数
+	remaining int64
+	masked    bool
+	maskKey   [4]byte
+	maskPos   int
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, isClient bool) *Conn {
+	if br == nil {
+		br = bufio.NewReader(conn)
+	}
+	return &Conn{conn: conn, br: br, isClient: isClient}
+}
+
+//握手时协商的子协议
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+//通过https升级的连接返回其TLS状态，否则返回nil
+func (c *Conn) TLSConnectionState() *tls.ConnectionState {
+	return c.tlsState
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.br.Read(b)
+	if c.masked {
+		for i := 0; i < n; i++ {
+			b[i] ^= c.maskKey[c.maskPos&3]
+			c.maskPos++
+		}
+	}
+	c.remaining -= int64(n)
+	return n, err
+}
+
+//读取下一个数据帧的帧头，期间收到的控制帧会被直接处理
+func (c *Conn) nextFrame() error {
+	for {
+		var header [2]byte
+		if _, err := io.ReadFull(c.br, header[:]); err != nil {
+			return err
+		}
+		fin := header[0]&0x80 != 0
+		opcode := header[0] & 0x0F
+		if header[0]&0x70 != 0 {
+			//没有协商任何扩展，RSV位必须为0
+			c.writeClose(closeProtocolError)
+			return ErrInvalidFrame
+		}
+		masked := header[1]&0x80 != 0
+		if masked == c.isClient {
+			c.writeClose(closeProtocolError)
+			return ErrUnmaskedFrame
+		}
+		length := int64(header[1] & 0x7F)
+		switch length {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+				return err
+			}
+			length = int64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+				return err
+			}
+			length = int64(binary.BigEndian.Uint64(ext[:]))
+		}
+		if length < 0 || length > maxFramePayload {
+			c.writeClose(closeMessageTooBig)
+			return ErrFrameTooLarge
+		}
+		c.masked = masked
+		c.maskPos = 0
+		if masked {
+			if _, err := io.ReadFull(c.br, c.maskKey[:]); err != nil {
+				return err
+			}
+		}
+		switch opcode {
+		case opBinary, opContinuation:
+			c.remaining = length
+			if length > 0 {
+				return nil
+			}
+		case opText:
+			//mqtt报文只能通过二进制帧传输
+			c.writeClose(closeUnsupportedData)
+			return ErrTextFrame
+		case opClose, opPing, opPong:
+			if !fin || length > 125 {
+				c.writeClose(closeProtocolError)
+				return ErrInvalidFrame
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(c.br, payload); err != nil {
+				return err
+			}
+			if masked {
+				for i := range payload {
+					payload[i] ^= c.maskKey[i&3]
+				}
+			}
+			if opcode == opClose {
+				c.writeClose(closeNormal)
+				return io.EOF
+			}
+			if opcode == opPing {
+				if err := c.writeFrame(opPong, payload); err != nil {
+					return err
+				}
+			}
+		default:
+			c.writeClose(closeProtocolError)
+			return ErrInvalidFrame
+		}
+	}
+}
+
+//每次写入都会发送一个完整的二进制帧
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(opBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, len(payload)+14)
+	frame = append(frame, 0x80|opcode)
+	var maskBit byte
+	if c.isClient {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, maskBit|126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(len(payload)))
+		frame = append(frame, maskBit|127)
+		frame = append(frame, ext[:]...)
+	}
+	if c.isClient {
+		var maskKey [4]byte
+		if _, err := rand.Read(maskKey[:]); err != nil {
+			return err
+		}
+		frame = append(frame, maskKey[:]...)
+		for i, b := range payload {
+			frame = append(frame, b^maskKey[i&3])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+//尽力发送关闭帧，发送失败时忽略错误
+func (c *Conn) writeClose(code uint16) {
+	c.closeOnce.Do(func() {
+		c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c.writeFrame(opClose, []byte{byte(code >> 8), byte(code)})
+	})
+}
+
+func (c *Conn) Close() error {
+	c.writeClose(closeNormal)
+	return c.conn.Close()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
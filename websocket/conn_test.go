@@ -0,0 +1,71 @@
+package websocket
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newEchoServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r, []string{"mqtt"})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}))
+}
+
+func TestEcho(t *testing.T) {
+	server := newEchoServer(t)
+	defer server.Close()
+	conn, err := Dial("ws"+strings.TrimPrefix(server.URL, "http"), []string{"mqttv3.1", "mqtt"}, nil)
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "mqtt", conn.Subprotocol())
+	//数据帧的边界与读取的边界无关
+	_, err = conn.Write([]byte("hello "))
+	assert.NoError(t, err)
+	_, err = conn.Write([]byte(strings.Repeat("a", 70000)))
+	assert.NoError(t, err)
+	buf := make([]byte, 70006)
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello "+strings.Repeat("a", 70000), string(buf))
+	//服务端需要响应ping
+	assert.NoError(t, conn.writeFrame(opPing, []byte("ping")))
+	_, err = conn.Write([]byte("after ping"))
+	assert.NoError(t, err)
+	buf = make([]byte, 10)
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "after ping", string(buf))
+}
+
+func TestTextFrameRejected(t *testing.T) {
+	server := newEchoServer(t)
+	defer server.Close()
+	conn, err := Dial("ws"+strings.TrimPrefix(server.URL, "http"), []string{"mqtt"}, nil)
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.NoError(t, conn.writeFrame(opText, []byte("text")))
+	//服务端回复关闭帧后断开连接
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestUnsupportedSubprotocol(t *testing.T) {
+	server := newEchoServer(t)
+	defer server.Close()
+	_, err := Dial("ws"+strings.TrimPrefix(server.URL, "http"), []string{"chat"}, nil)
+	assert.ErrorIs(t, err, ErrBadHandshake)
+	resp, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -0,0 +1,163 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//握手时用于计算Sec-WebSocket-Accept的固定GUID
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var ErrBadHandshake = errors.New("websocket: bad handshake")
+
+//将http请求升级为websocket连接，subprotocols为服务端支持的子协议，
+//客户端提供了子协议但都不被支持时拒绝升级，客户端没有提供子协议时不进行协商
+func Upgrade(w http.ResponseWriter, r *http.Request, subprotocols []string) (*Conn, error) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return nil, fmt.Errorf("%w: method %s", ErrBadHandshake, r.Method)
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") || len(key) == 0 {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return nil, fmt.Errorf("%w: not a websocket upgrade request", ErrBadHandshake)
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, http.StatusText(http.StatusUpgradeRequired), http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("%w: unsupported version", ErrBadHandshake)
+	}
+	offered := headerValues(r.Header, "Sec-WebSocket-Protocol")
+	subprotocol := selectSubprotocol(offered, subprotocols)
+	if len(offered) != 0 && len(subprotocol) == 0 {
+		http.Error(w, "unsupported websocket subprotocol", http.StatusBadRequest)
+		return nil, fmt.Errorf("%w: unsupported subprotocols %v", ErrBadHandshake, offered)
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, fmt.Errorf("%w: response does not support hijacking", ErrBadHandshake)
+	}
+	netConn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	//清除http服务设置的超时时间，之后由mqtt的keepalive机制检测连接状态
+	netConn.SetDeadline(time.Time{})
+	response := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + acceptKey(key) + "\r\n"
+	if len(subprotocol) != 0 {
+		response += "Sec-WebSocket-Protocol: " + subprotocol + "\r\n"
+	}
+	if _, err := netConn.Write([]byte(response + "\r\n")); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	conn := newConn(netConn, brw.Reader, false)
+	conn.subprotocol = subprotocol
+	if r.TLS != nil {
+		state := *r.TLS
+		conn.tlsState = &state
+	}
+	return conn, nil
+}
+
+//作为客户端连接websocket服务，rawURL的scheme为ws或wss
+func Dial(rawURL string, subprotocols []string, tlsConfig *tls.Config) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	var netConn net.Conn
+	switch u.Scheme {
+	case "ws":
+		netConn, err = net.Dial("tcp", u.Host)
+	case "wss":
+		netConn, err = tls.Dial("tcp", u.Host, tlsConfig)
+	default:
+		return nil, fmt.Errorf("websocket: unsupported scheme %s", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := &http.Request{Method: http.MethodGet, URL: u, Host: u.Host, Header: make(http.Header)}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if len(subprotocols) != 0 {
+		req.Header.Set("Sec-WebSocket-Protocol", strings.Join(subprotocols, ", "))
+	}
+	if err := req.Write(netConn); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(netConn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		netConn.Close()
+		return nil, fmt.Errorf("%w: status %s", ErrBadHandshake, resp.Status)
+	}
+	conn := newConn(netConn, br, true)
+	conn.subprotocol = resp.Header.Get("Sec-WebSocket-Protocol")
+	return conn, nil
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+//按照客户端提供的顺序选择第一个服务端支持的子协议
+func selectSubprotocol(offered []string, supported []string) string {
+	for _, protocol := range offered {
+		for _, s := range supported {
+			if strings.EqualFold(protocol, s) {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+//请求头中以逗号分隔的所有值
+func headerValues(header http.Header, name string) []string {
+	var values []string
+	for _, value := range header.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); len(v) != 0 {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
+
+func headerContains(header http.Header, name string, value string) bool {
+	for _, v := range headerValues(header, name) {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,30 @@
+package mqtt
+
+import (
+	"net/http"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/config"
+	"github.com/davidfantasy/embedded-mqtt-broker/logger"
+	"github.com/davidfantasy/embedded-mqtt-broker/websocket"
+)
+
+//mqtt over websocket支持的子协议，mqttv3.1用于兼容旧版本的客户端
+var mqttSubprotocols = []string{"mqtt", "mqttv3.1"}
+
+//返回处理mqtt over websocket连接的http.Handler，可以挂载到已有的http服务上，
+//通过该handler接入的客户端使用名称为ws的默认监听配置
+func (s *MqttServer) WebSocketHandler() http.Handler {
+	return s.webSocketHandler(newListener(&config.ListenerConfig{Name: "ws", Type: config.ListenerWebSocket}))
+}
+
+func (s *MqttServer) webSocketHandler(l *listener) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Upgrade(w, r, mqttSubprotocols)
+		if err != nil {
+			logger.WARN.Println("websocket upgrade failed:", err)
+			return
+		}
+		//连接已经被接管，直接在当前协程中处理mqtt报文
+		processNewConn(conn, s, l)
+	})
+}
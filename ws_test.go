@@ -0,0 +1,37 @@
+package mqtt
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/davidfantasy/embedded-mqtt-broker/packets"
+	"github.com/davidfantasy/embedded-mqtt-broker/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebSocketTransport(t *testing.T) {
+	server := newTestServer()
+	httpServer := httptest.NewServer(server.WebSocketHandler())
+	defer httpServer.Close()
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http")+"/mqtt", []string{"mqtt"}, nil)
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "mqtt", conn.Subprotocol())
+	assert.NoError(t, newTestConnectPacket("ws-client", true).Write(conn))
+	connack, ok := readTestPacket(t, conn).(*packets.ConnackPacket)
+	assert.True(t, ok)
+	assert.Equal(t, byte(packets.Accepted), connack.ReturnCode)
+
+	//websocket客户端与tcp客户端可以互相收发消息
+	subscribeTestTopic(t, conn, "ws/test", 0)
+	pub := connectTestClient(t, server, "ws-pub", true)
+	defer pub.Close()
+	pp := packets.NewMqttPacket(packets.Publish).(*packets.PublishPacket)
+	pp.TopicName = "ws/test"
+	pp.Payload = []byte("hello")
+	assert.NoError(t, pp.Write(pub))
+	received, ok := readTestPacket(t, conn).(*packets.PublishPacket)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("hello"), received.Payload)
+}